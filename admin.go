@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth admits requests carrying one of keys, either as
+// "Authorization: Bearer <key>" or in an X-API-Key header.
+func adminAuth(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if validAdminKey(c, keys) {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid admin API key"})
+	}
+}
+
+func validAdminKey(c *gin.Context, keys []string) bool {
+	key := c.GetHeader("X-API-Key")
+	if key == "" {
+		key, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	for _, candidate := range keys {
+		if key != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// flushCache drops every cached copy of image bytes, leaving the directory
+// index alone.
+func flushCache(c *gin.Context) {
+	c.JSON(http.StatusOK, purgeCaches("all images", nil))
+}
+
+// purgeCache handles POST /admin/cache/purge, which evicts cached copies
+// of some images, such as ones replaced on the NAS without their size or
+// mtime changing. The body names what to evict: {"all": true}, {"paths":
+// [...]} with NAS paths or image IDs, or {"prefix": "/dir"} for every
+// image under a directory.
+func purgeCache(c *gin.Context) {
+	var body struct {
+		All    bool     `json:"all"`
+		Paths  []string `json:"paths"`
+		Prefix string   `json:"prefix"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purge request: " + err.Error()})
+		return
+	}
+	given := 0
+	for _, set := range []bool{body.All, len(body.Paths) > 0, body.Prefix != ""} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `Give exactly one of "all": true, "paths" or "prefix"`})
+		return
+	}
+
+	switch {
+	case body.All:
+		c.JSON(http.StatusOK, purgeCaches("all images", nil))
+	case body.Prefix != "":
+		if !path.IsAbs(body.Prefix) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "prefix must be an absolute path"})
+			return
+		}
+		prefix := path.Clean(body.Prefix)
+		c.JSON(http.StatusOK, purgeCaches("images under "+prefix, func(p string) bool { return underDirectory(p, prefix) }))
+	default:
+		paths := map[string]bool{}
+		for _, value := range body.Paths {
+			p := value
+			if !strings.HasPrefix(value, "/") {
+				var err error
+				if p, _, err = parseImageID(value); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q is neither an absolute path nor an image ID: %v", value, err)})
+					return
+				}
+			}
+			paths[path.Clean(p)] = true
+		}
+		c.JSON(http.StatusOK, purgeCaches(fmt.Sprintf("%d images", len(paths)), func(p string) bool { return paths[p] }))
+	}
+}
+
+// purgeCaches evicts the cached copies of the images match accepts, or of
+// every image when match is nil, and describes what was freed. Checksums
+// and verification results go too, so the images are hashed and checked
+// afresh.
+func purgeCaches(target string, match func(path string) bool) gin.H {
+	var transformEntries, diskEntries, dimensionEntries, checksumEntries, verified, released int
+	var transformBytes, diskBytes int64
+	if match == nil {
+		transformEntries, transformBytes = transformCache.purge()
+		diskEntries, diskBytes = imageDiskCache.purge()
+		dimensionEntries = dimensions.purge()
+		checksumEntries = checksums.purge()
+		verified, released = verification.purge()
+	} else {
+		transformEntries, transformBytes = transformCache.purgeMatching(match)
+		diskEntries, diskBytes = imageDiskCache.purgeMatching(match)
+		dimensionEntries = dimensions.purgeMatching(match)
+		checksumEntries = checksums.purgeMatching(match)
+		verified, released = verification.purgeMatching(match)
+	}
+	logger.Info("caches purged", "target", target,
+		"transformed_images", transformEntries, "transformed_bytes", transformBytes,
+		"disk_files", diskEntries, "disk_bytes", diskBytes, "dimensions", dimensionEntries,
+		"checksums", checksumEntries, "verification_results", verified, "quarantine_released", released)
+
+	return gin.H{
+		"transform_cache": gin.H{"entries": transformEntries, "bytes": transformBytes},
+		"disk_cache":      gin.H{"entries": diskEntries, "bytes": diskBytes},
+		"dimension_cache": gin.H{"entries": dimensionEntries},
+		"checksums":       gin.H{"entries": checksumEntries},
+		"verification":    gin.H{"entries": verified, "quarantine_released": released},
+		"entries":         transformEntries + diskEntries + dimensionEntries + checksumEntries + verified + released,
+		"bytes":           transformBytes + diskBytes,
+	}
+}
+
+// maxIndexImportSize bounds the body accepted by importIndex.
+const maxIndexImportSize = 32 << 20
+
+func exportIndex(c *gin.Context) {
+	c.Header("Content-Disposition", `attachment; filename="index.json"`)
+	c.IndentedJSON(http.StatusOK, imageIndex.export())
+}
+
+// indexEntryProblem is an invalid entry of an uploaded index: Entry is
+// its position in a list field or its key in a map field.
+type indexEntryProblem struct {
+	Field string `json:"field"`
+	Entry any    `json:"entry"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// importIndex replaces the live index with an uploaded indexFile, as
+// produced by exportIndex. Nothing changes unless every entry is valid.
+func importIndex(c *gin.Context) {
+	var f indexFile
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxIndexImportSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&f); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid index document: " + err.Error()})
+		return
+	}
+	if f.Version != indexFileVersion {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported index version %d, want %d", f.Version, indexFileVersion)})
+		return
+	}
+
+	if problems := indexFileProblems(f); len(problems) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("%d invalid index entries", len(problems)), "entries": problems})
+		return
+	}
+
+	if f.ScannedAt.IsZero() {
+		f.ScannedAt = time.Now()
+	}
+	imageIndex.restore(f)
+	saveIndexCache()
+	logger.Info("index imported", "with_images", imageIndex.len())
+	c.JSON(http.StatusOK, gin.H{"directories_with_images": imageIndex.len()})
+}
+
+// indexFileProblems checks every path in f: each must be absolute, clean
+// and under a scan root, images must lie in one of f's directories, and
+// the timeline may only count f's directories. Keys by imageCacheKey and
+// checksums must be well formed.
+func indexFileProblems(f indexFile) []indexEntryProblem {
+	var problems []indexEntryProblem
+	report := func(field string, entry any, p, msg string) {
+		problems = append(problems, indexEntryProblem{Field: field, Entry: entry, Path: p, Error: msg})
+	}
+
+	dirs := map[string]bool{}
+	for i, dir := range f.Directories {
+		if msg := indexPathProblem(dir); msg != "" {
+			report("directories", i, dir, msg)
+			continue
+		}
+		dirs[dir] = true
+	}
+	imageProblem := func(p string) string {
+		if msg := indexPathProblem(p); msg != "" {
+			return msg
+		}
+		if archive, _, ok := splitZipPath(p); ok && dirs[archive] {
+			return ""
+		}
+		if !dirs[path.Dir(p)] {
+			return "image is not in any of the directories"
+		}
+		return ""
+	}
+
+	images := map[string]bool{}
+	for i, p := range f.Images {
+		if msg := imageProblem(p); msg != "" {
+			report("images", i, p, msg)
+		}
+		images[p] = true
+	}
+	for i, file := range f.Files {
+		switch msg := imageProblem(file.Path); {
+		case msg != "":
+			report("files", i, file.Path, msg)
+		case !images[file.Path]:
+			report("files", i, file.Path, "file is not in images")
+		case file.Size < 0:
+			report("files", i, file.Path, "size is negative")
+		}
+	}
+	for i, entry := range f.Quarantine {
+		if msg := imageProblem(entry.Path); msg != "" {
+			report("quarantine", i, entry.Path, msg)
+		} else if !isImageCacheKey(entry.Key) {
+			report("quarantine", i, entry.Path, "key is not an image cache key")
+		}
+	}
+	for i, key := range f.Verified {
+		if !isImageCacheKey(key) {
+			report("verified", i, "", "not an image cache key")
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(f.Checksums)) {
+		sum, err := hex.DecodeString(f.Checksums[key])
+		switch {
+		case !isImageCacheKey(key):
+			report("checksums", key, "", "not an image cache key")
+		case err != nil || len(sum) != sha256.Size:
+			report("checksums", key, "", "checksum is not a hex SHA-256")
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(f.CreationDates)) {
+		if msg := imageProblem(p); msg != "" {
+			report("creation_dates", p, p, msg)
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(f.Tags)) {
+		if msg := imageProblem(p); msg != "" {
+			report("tags", p, p, msg)
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(f.Ratings)) {
+		if msg := imageProblem(p); msg != "" {
+			report("ratings", p, p, msg)
+		} else if rating := f.Ratings[p]; rating < minRating || rating > maxRating {
+			report("ratings", p, p, fmt.Sprintf("rating %d is not between %d and %d", rating, minRating, maxRating))
+		}
+	}
+	for _, dir := range slices.Sorted(maps.Keys(f.Timeline)) {
+		if msg := indexPathProblem(dir); msg != "" {
+			report("timeline", dir, dir, msg)
+		} else if !dirs[dir] {
+			report("timeline", dir, dir, "not one of the directories")
+		}
+	}
+	return problems
+}
+
+// indexPathProblem says what is wrong with p as a path in an uploaded
+// index, or returns "".
+func indexPathProblem(p string) string {
+	switch {
+	case !path.IsAbs(p):
+		return "path is not absolute"
+	case path.Clean(p) != p:
+		return "path is not clean; use " + path.Clean(p)
+	case !underScanRoot(p):
+		return "path is outside the scan roots " + strings.Join(scanRoots, ", ")
+	}
+	return ""
+}
+
+// isImageCacheKey reports whether key has the form imageCacheKey gives.
+func isImageCacheKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 16 && key == strings.ToLower(key)
+}
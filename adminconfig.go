@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedSecret stands in for a secret in /admin/config: "***" and the
+// same short SHA-256 fingerprint the share-link key ID uses, enough to
+// tell which secret is loaded without revealing it.
+func redactedSecret(secret string) any {
+	if secret == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return gin.H{"value": "***", "fingerprint": "sha256:" + hex.EncodeToString(sum[:4])}
+}
+
+// redactedURL hides the password in the user info of raw and its query,
+// where API tokens tend to go.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "***"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "***"
+	}
+	return u.Redacted()
+}
+
+// getConfig handles GET /admin/config: the configuration the process
+// resolved from the environment, secret files, flags and defaults, with
+// derived values such as the image extensions in effect. Secrets only
+// ever appear as redactedSecret; new secret settings must go through it.
+func getConfig(cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminKeys := make([]any, len(cfg.adminAPIKeys))
+		for i, key := range cfg.adminAPIKeys {
+			adminKeys[i] = redactedSecret(key)
+		}
+		referers := make([]string, len(cfg.allowedReferers))
+		for i, p := range cfg.allowedReferers {
+			referers[i] = p.scheme + "://" + p.host
+		}
+		headers := map[string]string{}
+		for _, h := range cfg.customHeaders {
+			headers[h.name] = h.value
+		}
+		albumPatterns := map[string][]string{}
+		for _, a := range cfg.albums {
+			albumPatterns[a.name] = a.patterns
+		}
+		prefixes := func(set prefixSet) []string {
+			out := make([]string, len(set))
+			for i, p := range set {
+				out[i] = p.String()
+			}
+			return out
+		}
+		var quiet any
+		if q := cfg.quietHours; q != nil {
+			quiet = gin.H{
+				"window":   fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60),
+				"timezone": q.loc.String(),
+				"mode":     q.mode,
+			}
+		}
+		var tlsCert any
+		if cert := cfg.httpTuning.certificate; cert != nil && cert.Leaf != nil {
+			sum := sha256.Sum256(cert.Leaf.Raw)
+			tlsCert = gin.H{
+				"subject":     cert.Leaf.Subject.CommonName,
+				"dns_names":   cert.Leaf.DNSNames,
+				"not_after":   cert.Leaf.NotAfter,
+				"fingerprint": "sha256:" + hex.EncodeToString(sum[:]),
+			}
+		}
+		var jwksURL, otlpEndpoint string
+		if cfg.jwksURL != "" {
+			jwksURL = redactedURL(cfg.jwksURL)
+		}
+		if cfg.otlpEndpoint != "" {
+			otlpEndpoint = redactedURL(cfg.otlpEndpoint)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"nas": gin.H{
+				"user":                  cfg.sshUser,
+				"password":              redactedSecret(cfg.sshPassword),
+				"host":                  cfg.sshHost,
+				"port":                  cfg.sshPort,
+				"host_key_mode":         cfg.sshHostKeyMode,
+				"host_key_file":         cfg.sshHostKeyFile,
+				"dial_timeout":          cfg.sshDialTimeout.String(),
+				"handshake_timeout":     cfg.sshHandshakeTimeout.String(),
+				"op_timeout":            cfg.sftpOpTimeout.String(),
+				"max_packet":            cfg.sftpMaxPacket,
+				"concurrent_reads":      cfg.sftpConcurrentReads,
+				"breaker_threshold":     cfg.breakerThreshold,
+				"breaker_cooldown":      cfg.breakerCooldown.String(),
+				"reconnect_max_backoff": cfg.reconnectMaxBackoff.String(),
+			},
+			"http": gin.H{
+				"host":                   cfg.serverHost,
+				"ports":                  cfg.serverPorts,
+				"port_file":              cfg.portFile,
+				"unix_socket":            cfg.unixSocket,
+				"unix_socket_mode":       fmt.Sprintf("%#o", cfg.unixSocketMode),
+				"timeouts":               gin.H{"read_header": cfg.httpTimeouts.readHeader.String(), "write": cfg.httpTimeouts.write.String(), "idle": cfg.httpTimeouts.idle.String()},
+				"drain_timeout":          cfg.drainTimeout.String(),
+				"shutdown_timeout":       cfg.shutdownTimeout.String(),
+				"tls_certificate":        tlsCert,
+				"h2c":                    cfg.httpTuning.h2c,
+				"max_header_bytes":       cfg.httpTuning.maxHeaderBytes,
+				"max_concurrent_streams": cfg.httpTuning.maxConcurrentStreams,
+				"custom_headers":         headers,
+				"serve_demo_ui":          cfg.serveDemoUI,
+				"server_header":          cfg.serverHeader,
+			},
+			"auth": gin.H{
+				"jwt_secret":     redactedSecret(cfg.jwtSecret),
+				"jwks_url":       jwksURL,
+				"jwt_clock_skew": cfg.jwtClockSkew.String(),
+				"jwks_refresh":   cfg.jwksRefresh.String(),
+				"admin_api_keys": adminKeys,
+				"share_secret":   redactedSecret(cfg.shareSecret),
+				"share_max_ttl":  cfg.shareMaxTTL.String(),
+				// Named only: the values live in the files.
+				"secrets_from_files_over_env": cfg.shadowedSecrets,
+			},
+			"access": gin.H{
+				"cors_origins":        cfg.corsOrigins,
+				"cors_credentials":    cfg.corsCredentials,
+				"cors_max_age":        cfg.corsMaxAge.String(),
+				"allowed_referers":    referers,
+				"allow_empty_referer": cfg.allowEmptyReferer,
+				"hotlink_placeholder": cfg.hotlinkPlaceholder,
+				"placeholder_dir":     cfg.placeholderDir,
+				"placeholder_images":  cfg.errorPlaceholders.count(),
+				"placeholder_image":   cfg.placeholderImagePath,
+				"fallback_mode":       cfg.fallbackMode,
+				"ip_allow":            prefixes(cfg.ipAllow),
+				"ip_deny":             prefixes(cfg.ipDeny),
+				"trusted_proxies":     prefixes(cfg.trustedProxies),
+			},
+			"limits": gin.H{
+				"max_inflight_requests":   cfg.maxInflightRequests,
+				"max_inflight_transforms": cfg.maxInflightTransforms,
+				"max_concurrent_per_ip":   cfg.maxConcurrentPerIP,
+				"max_change_waiters":      cfg.maxChangeWaiters,
+				"random_images_max_count": cfg.randomImagesMaxCount,
+				"random_images_max_bytes": cfg.randomImagesMaxBytes,
+				"montage_max_count":       cfg.montageMaxCount,
+				"montage_max_tile_size":   cfg.montageMaxTileSize,
+			},
+			"images": gin.H{
+				"extensions":             imageExts,
+				"content_type_overrides": cfg.contentTypeOverrides,
+				"jpeg_quality":           cfg.jpegQuality,
+				"reencode_jpeg_quality":  cfg.reencodeJPEGQuality,
+				"default_mode":           cfg.defaultImageMode,
+				"svg_safe_mode":          cfg.svgSafeMode,
+				"verify":                 cfg.verifyImages,
+				"content_sha256":         cfg.contentSHA256,
+				"creation_date_skew":     cfg.creationDateSkew.String(),
+				"min_width":              cfg.minImageWidth,
+				"min_height":             cfg.minImageHeight,
+				"strategy":               cfg.strategy,
+				"directory_weights":      cfg.directoryWeights,
+				"recency_bias":           cfg.recencyBias.String(),
+				"global_history_size":    cfg.globalHistorySize,
+				"albums":                 albumPatterns,
+				"display_timezone":       cfg.displayTimezone.String(),
+				"quiet_hours":            quiet,
+			},
+			"caching": gin.H{
+				"disk_cache_dir":              cfg.diskCacheDir,
+				"disk_cache_max_size":         cfg.diskCacheMaxSize,
+				"transform_cache_size":        cfg.transformCacheSize,
+				"min_free_memory":             cfg.minFreeMemory,
+				"image_cache_max_age":         cfg.imageCacheMaxAge.String(),
+				"random_cache_control":        cfg.randomCacheControl,
+				"json_cache_max_age":          cfg.jsonCacheMaxAge.String(),
+				"json_stale_while_revalidate": cfg.jsonStaleWhileRevalidate.String(),
+				"stream_buffer_size":          cfg.streamBufferSize,
+				"stream_read_ahead":           cfg.streamReadAhead,
+				"copy_buffer_size":            cfg.copyBufferSize,
+				"warm_cache":                  cfg.warmCache,
+				"warm_cache_prefetch":         cfg.warmCachePrefetch,
+			},
+			"scan": gin.H{
+				"roots":              cfg.scanRoots,
+				"ignored_roots":      cfg.nestedScanRoots,
+				"exclude":            cfg.scanExcludes,
+				"on_startup":         cfg.scanOnStartup,
+				"index_cache_file":   cfg.indexCacheFile,
+				"compare_tally_file": cfg.compareTallyFile,
+				"index_max_age":      cfg.indexMaxAge.String(),
+				"manifest_file":      cfg.manifestFile,
+				"manifest_max_age":   cfg.manifestMaxAge.String(),
+				"timeout":            cfg.scanTimeout.String(),
+				"stall_timeout":      cfg.scanStallTimeout.String(),
+				"stall_retries":      cfg.scanStallRetries,
+				"progress_every":     cfg.scanProgressEvery,
+				"embedded_xmp":       cfg.scanEmbeddedXMP,
+				"zips":               cfg.scanZips,
+				"print_tree":         cfg.printTree,
+				"webdav_listing":     cfg.webdavListing,
+			},
+			"logging": gin.H{
+				"format":         cfg.logFormat,
+				"error_log_size": cfg.errorLogSize,
+				"level":          cfg.logLevel.String(),
+				"otlp_endpoint":  otlpEndpoint,
+			},
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// album is a named set of directories, given as globs. Membership is
+// worked out against the live index on every request, so directories
+// added by a rescan join matching albums straight away.
+type album struct {
+	name     string
+	patterns []string
+}
+
+var albums []album
+
+// parseAlbums parses "2019 summer:/photos/2019-07*,/photos/2019-08*;Japan:2024-Japan".
+// Patterns use path.Match syntax. One starting with / matches whole
+// directory paths; any other is matched against the trailing components,
+// so "2024-Japan" finds that folder wherever it lives.
+func parseAlbums(value string) ([]album, error) {
+	var parsed []album
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("entry %q is not in name:glob,glob form", entry)
+		}
+		if slices.ContainsFunc(parsed, func(a album) bool { return a.name == name }) {
+			return nil, fmt.Errorf("album %q is defined twice", name)
+		}
+		a := album{name: name}
+		for _, pattern := range strings.Split(list, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("album %q: invalid pattern %q", name, pattern)
+			}
+			a.patterns = append(a.patterns, strings.TrimSuffix(pattern, "/"))
+		}
+		if len(a.patterns) == 0 {
+			return nil, fmt.Errorf("album %q has no patterns", name)
+		}
+		parsed = append(parsed, a)
+	}
+	return parsed, nil
+}
+
+func findAlbum(name string) (album, bool) {
+	for _, a := range albums {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return album{}, false
+}
+
+func (a album) contains(dir string) bool {
+	for _, pattern := range a.patterns {
+		target := dir
+		if !strings.HasPrefix(pattern, "/") {
+			components := strings.Split(strings.Trim(dir, "/"), "/")
+			n := strings.Count(pattern, "/") + 1
+			if n > len(components) {
+				continue
+			}
+			target = strings.Join(components[len(components)-n:], "/")
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a album) directories(dirs []string) []string {
+	var matched []string
+	for _, dir := range dirs {
+		if a.contains(dir) {
+			matched = append(matched, dir)
+		}
+	}
+	return matched
+}
+
+// albumsOf lists the albums containing the image at p.
+func albumsOf(p string) []string {
+	var names []string
+	dir := path.Dir(p)
+	for _, a := range albums {
+		if a.contains(dir) {
+			names = append(names, a.name)
+		}
+	}
+	return names
+}
+
+// imageMetadata describes info in JSON responses.
+func imageMetadata(info ImageInfo) gin.H {
+	meta := gin.H{
+		"id":            imageID(info),
+		"path":          info.Path,
+		"size":          info.Size,
+		"creation_date": formatDate(info.CreationDate),
+		// As recorded: UTC for file mtimes, the camera's zone for EXIF.
+		"creation_date_raw": info.CreationDate.Format(time.RFC3339),
+	}
+	if n, ok := imageIndex.imageNumber(info.Path); ok {
+		meta["number"] = n
+	}
+	if names := albumsOf(info.Path); len(names) > 0 {
+		meta["albums"] = names
+	}
+	if tags := imageTags.of(info.Path); len(tags) > 0 {
+		meta["tags"] = tags
+	}
+	if rating, ok := imageRatings.of(info.Path); ok {
+		meta["rating"] = rating
+	}
+	return meta
+}
+
+func listAlbums(c *gin.Context) {
+	indexed := allowedDirectories(c, imageIndex.snapshot())
+	list := make([]gin.H, 0, len(albums))
+	for _, a := range albums {
+		list = append(list, gin.H{
+			"name":        a.name,
+			"patterns":    a.patterns,
+			"directories": len(a.directories(indexed)),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"albums": list})
+}
+
+// albumDirectories resolves :name to the indexed directories the caller
+// may see. On failure the error response has already been written.
+func albumDirectories(c *gin.Context) (album, []string, bool) {
+	a, ok := findAlbum(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No album named %q", c.Param("name"))})
+		return album{}, nil, false
+	}
+	dirs := a.directories(allowedDirectories(c, imageIndex.snapshot()))
+	if len(dirs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Album %q has no indexed directories", a.name)})
+		return album{}, nil, false
+	}
+	return a, dirs, true
+}
+
+// listAlbumImages lists the images of an album, optionally only those
+// with ?tag=.
+func listAlbumImages(c *gin.Context) {
+	tag, err := parseTagParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a, dirs, ok := albumDirectories(c)
+	if !ok {
+		return
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+
+	images := []gin.H{}
+	for _, dir := range dirs {
+		c.Set(nasPathKey, dir)
+		var entries []os.FileInfo
+		readStart := time.Now()
+		_, span := startSpan(c.Request.Context(), "sftp.readdir", pathAttr(dir))
+		err := sftpCall(func() (err error) {
+			entries, err = readImageDir(client, dir)
+			return err
+		})
+		span.SetAttributes(attribute.Int("entries", len(entries)))
+		endSpan(span, err)
+		recordStage(c, stageSFTP, readStart, phaseReadDir)
+		if os.IsNotExist(err) {
+			imageIndex.remove(dir)
+			continue
+		}
+		if err != nil {
+			respondSFTPError(c, "Failed to read directory: ", err)
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(entry.Name()) {
+				continue
+			}
+			p := joinImagePath(dir, entry.Name())
+			if tag != "" && !imageTags.has(p, tag) {
+				continue
+			}
+			images = append(images, imageMetadata(ImageInfo{
+				Path:         p,
+				CreationDate: creationDate(p, entry.ModTime()),
+				Size:         entry.Size(),
+			}))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"album": a.name, "images": images})
+}
+
+func getAlbumRandomImage(c *gin.Context) {
+	if _, dirs, ok := albumDirectories(c); ok {
+		serveRandomImage(c, dirs)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+// isAnimated reports whether data holds more than one frame. Only the
+// container structure is inspected; nothing is decoded and the file
+// extension is irrelevant.
+func isAnimated(data []byte) bool {
+	switch {
+	case isGIF(data):
+		return gifFrameCount(data, 2) > 1
+	case isWebP(data):
+		return len(webpChunks(data, "ANMF")) > 1
+	}
+	return false
+}
+
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// gifFrameCount walks the GIF block structure counting image descriptors,
+// stopping early once limit frames have been seen. Truncated files report
+// the frames found before the damage.
+func gifFrameCount(data []byte, limit int) int {
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	if packed := data[10]; packed&0x80 != 0 {
+		pos += 3 << ((packed & 0x07) + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			n := int(data[pos])
+			pos++
+			if n == 0 {
+				return true
+			}
+			pos += n
+		}
+		return false
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if !skipSubBlocks() {
+				return frames
+			}
+		case 0x2C: // image descriptor
+			frames++
+			if frames >= limit || pos+10 > len(data) {
+				return frames
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << ((packed & 0x07) + 1)
+			}
+			pos++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return frames
+			}
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// webpChunks returns the payloads of the top-level RIFF chunks named fourCC.
+func webpChunks(data []byte, fourCC string) [][]byte {
+	var chunks [][]byte
+	forEachRIFFChunk(data[min(12, len(data)):], func(id string, payload []byte) {
+		if id == fourCC {
+			chunks = append(chunks, payload)
+		}
+	})
+	return chunks
+}
+
+func forEachRIFFChunk(data []byte, fn func(id string, payload []byte)) {
+	for len(data) >= 8 {
+		id := string(data[0:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size > len(data)-8 {
+			return
+		}
+		fn(id, data[8:8+size])
+		data = data[min(8+size+size%2, len(data)):]
+	}
+}
+
+// firstWebPFrame rebuilds the first frame of an animated WebP as a
+// standalone still WebP, which the x/image decoder can read.
+func firstWebPFrame(data []byte) ([]byte, error) {
+	frames := webpChunks(data, "ANMF")
+	if len(frames) == 0 {
+		return nil, errors.New("webp: no animation frames")
+	}
+	frame := frames[0]
+	if len(frame) < 16 {
+		return nil, errors.New("webp: truncated animation frame")
+	}
+	// Both ANMF and VP8X store the dimensions minus one.
+	widthMinusOne := uint32(frame[6]) | uint32(frame[7])<<8 | uint32(frame[8])<<16
+	heightMinusOne := uint32(frame[9]) | uint32(frame[10])<<8 | uint32(frame[11])<<16
+
+	var alpha, bitstream []byte
+	var bitstreamID string
+	forEachRIFFChunk(frame[16:], func(id string, payload []byte) {
+		switch id {
+		case "ALPH":
+			alpha = payload
+		case "VP8 ", "VP8L":
+			if bitstream == nil {
+				bitstream, bitstreamID = payload, id
+			}
+		}
+	})
+	if bitstream == nil {
+		return nil, errors.New("webp: animation frame has no image data")
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if alpha != nil && bitstreamID == "VP8 " {
+		header := make([]byte, 10)
+		header[0] = 0x10 // alpha present
+		putUint24(header[4:7], widthMinusOne)
+		putUint24(header[7:10], heightMinusOne)
+		writeRIFFChunk(&body, "VP8X", header)
+		writeRIFFChunk(&body, "ALPH", alpha)
+	}
+	writeRIFFChunk(&body, bitstreamID, bitstream)
+
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:8], uint32(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, id string, payload []byte) {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(payload)))
+	buf.WriteString(id)
+	buf.Write(size[:])
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// maxAnimatedPixels bounds width x height x frames for resizeAnimatedGIF,
+// which holds every composited frame in memory at once.
+const maxAnimatedPixels = 1 << 28
+
+// resizeAnimatedGIF applies opts to every frame of an animated GIF,
+// keeping frame delays and the loop count. Frames are composited onto the
+// full canvas first, honouring their disposal methods, so partial frames
+// scale consistently; the output stores each frame whole.
+func resizeAnimatedGIF(data []byte, opts transformOptions) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding animated GIF: %w", err)
+	}
+	canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvasRect.Empty() || int64(canvasRect.Dx())*int64(canvasRect.Dy())*int64(len(g.Image)) > maxAnimatedPixels {
+		return data, nil
+	}
+
+	canvas := image.NewRGBA(canvasRect)
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvasRect)
+			draw.Draw(previous, canvasRect, canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		scaled := resizeImage(canvas, opts)
+		bounds := scaled.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), frame.Palette)
+		draw.Draw(paletted, paletted.Bounds(), scaled, bounds.Min, draw.Src)
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	out.Config = image.Config{Width: out.Image[0].Bounds().Dx(), Height: out.Image[0].Bounds().Dy()}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, fmt.Errorf("encoding animated GIF: %w", err)
+	}
+	return buf.Bytes(), nil
+}
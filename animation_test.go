@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testGIF encodes a width x height GIF with the given number of frames,
+// each filled with a different colour.
+func testGIF(t *testing.T, frames, width, height int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}}
+	g := &gif.GIF{LoopCount: 0}
+	for i := range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % len(palette))
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testStillWebP is a 1x1 lossless WebP.
+var testStillWebP, _ = base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+
+// testAnimatedWebP wraps the VP8L bitstream of testStillWebP in frames
+// ANMF chunks behind the VP8X and ANIM headers of an animated WebP.
+func testAnimatedWebP(t *testing.T, frames int) []byte {
+	t.Helper()
+	bitstream := webpChunks(testStillWebP, "VP8L")
+	if len(bitstream) != 1 {
+		t.Fatal("fixture has no VP8L chunk")
+	}
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 // animation
+	writeRIFFChunk(&body, "VP8X", vp8x)
+	writeRIFFChunk(&body, "ANIM", make([]byte, 6))
+	for range frames {
+		var frame bytes.Buffer
+		frame.Write(make([]byte, 16)) // origin 0,0, size 1x1, no duration
+		writeRIFFChunk(&frame, "VP8L", bitstream[0])
+		writeRIFFChunk(&body, "ANMF", frame.Bytes())
+	}
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+func TestIsAnimated(t *testing.T) {
+	var still bytes.Buffer
+	if err := png.Encode(&still, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	animated := testGIF(t, 3, 8, 8)
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"multi-frame GIF", animated, true},
+		{"single-frame GIF", testGIF(t, 1, 8, 8), false},
+		{"truncated multi-frame GIF", animated[:len(animated)/2], false},
+		{"PNG", still.Bytes(), false},
+		{"animated WebP", testAnimatedWebP(t, 2), true},
+		{"one-frame animated WebP", testAnimatedWebP(t, 1), false},
+		{"still WebP", testStillWebP, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isAnimated(tt.data); got != tt.want {
+			t.Errorf("isAnimated(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	data := testGIF(t, 5, 8, 8)
+	if n := gifFrameCount(data, 100); n != 5 {
+		t.Errorf("gifFrameCount = %d, want 5", n)
+	}
+	if n := gifFrameCount(data, 2); n != 2 {
+		t.Errorf("gifFrameCount with limit 2 = %d, want 2", n)
+	}
+}
+
+func TestFirstWebPFrame(t *testing.T) {
+	frame, err := firstWebPFrame(testAnimatedWebP(t, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("first frame does not decode: %v", err)
+	}
+	if config.Width != 1 || config.Height != 1 {
+		t.Errorf("first frame is %dx%d, want 1x1", config.Width, config.Height)
+	}
+
+	if _, err := firstWebPFrame(testStillWebP); err == nil {
+		t.Error("firstWebPFrame accepted a still WebP")
+	}
+}
+
+func TestTransformAnimatedPassesThrough(t *testing.T) {
+	data := testGIF(t, 3, 16, 16)
+	out, contentType, err := transformImage(data, "image/gif", transformOptions{format: "gif"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) || contentType != "image/gif" {
+		t.Errorf("animated GIF asked for as a GIF was not passed through untouched (got %s)", contentType)
+	}
+
+	webpData := testAnimatedWebP(t, 2)
+	out, contentType, err = transformImage(webpData, "image/webp", transformOptions{width: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, webpData) || contentType != "image/webp" {
+		t.Errorf("animated WebP was not passed through untouched (got %s)", contentType)
+	}
+}
+
+func TestTransformFirstFrame(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+	}{
+		{"GIF", testGIF(t, 3, 16, 16), "image/gif"},
+		{"WebP", testAnimatedWebP(t, 2), "image/webp"},
+	}
+	for _, tt := range tests {
+		out, contentType, err := transformImage(tt.data, tt.contentType, transformOptions{width: 8, upscale: true, firstFrame: true, format: "png"})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if contentType != "image/png" {
+			t.Errorf("%s: content type %s, want image/png", tt.name, contentType)
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: output is not a PNG: %v", tt.name, err)
+		}
+		if w := img.Bounds().Dx(); w != 8 {
+			t.Errorf("%s: first frame is %d wide, want 8", tt.name, w)
+		}
+	}
+}
+
+func TestTransformAnimatedToOtherFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		format      string
+	}{
+		{"GIF to PNG", testGIF(t, 3, 16, 16), "image/gif", "png"},
+		{"GIF to JPEG", testGIF(t, 3, 16, 16), "image/gif", "jpeg"},
+		{"WebP to PNG", testAnimatedWebP(t, 2), "image/webp", "png"},
+		{"WebP to GIF", testAnimatedWebP(t, 2), "image/webp", "gif"},
+	}
+	for _, tt := range tests {
+		// Without a resize, too: the format alone is a conversion.
+		out, contentType, err := transformImage(tt.data, tt.contentType, transformOptions{format: tt.format})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if contentType != outputFormats[tt.format] {
+			t.Errorf("%s: content type %s, want %s", tt.name, contentType, outputFormats[tt.format])
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != tt.format {
+			t.Errorf("%s: output decodes as %q (%v), want %s", tt.name, format, err, tt.format)
+		}
+	}
+}
+
+func TestResizeAnimatedGIFKeepsFrames(t *testing.T) {
+	out, contentType, err := transformImage(testGIF(t, 3, 16, 16), "image/gif", transformOptions{width: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "image/gif" {
+		t.Fatalf("content type %s, want image/gif", contentType)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output is not a GIF: %v", err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("resized GIF has %d frames, want 3", len(g.Image))
+	}
+	if g.Config.Width != 8 || g.Config.Height != 8 {
+		t.Errorf("resized GIF is %dx%d, want 8x8", g.Config.Width, g.Config.Height)
+	}
+	for i, frame := range g.Image {
+		if b := frame.Bounds(); b.Dx() != 8 || b.Dy() != 8 {
+			t.Errorf("frame %d is %dx%d, want 8x8", i, b.Dx(), b.Dy())
+		}
+		if want := 10 * (i + 1); g.Delay[i] != want {
+			t.Errorf("frame %d has delay %d, want %d", i, g.Delay[i], want)
+		}
+	}
+}
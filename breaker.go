@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var errCircuitOpen = errors.New("NAS unavailable: circuit breaker is open")
+
+// circuitBreaker fast-fails SFTP operations after threshold consecutive
+// failures. Once the cooldown has elapsed a single probe is let through;
+// its outcome either closes the circuit again or restarts the cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+type breakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAfter          int        `json:"retry_after_seconds,omitempty"`
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isNASFailure(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// retryAfter is the time left until the breaker lets a probe through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.cooldown-time.Since(b.openedAt), 0)
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := breakerStatus{State: b.state.String(), ConsecutiveFailures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+	if b.state == breakerOpen {
+		st.RetryAfter = int(max(b.cooldown-time.Since(b.openedAt), 0).Seconds() + 0.5)
+	}
+	return st
+}
+
+// isNASFailure reports whether err says something about the health of the
+// NAS itself. Missing files and permission problems are answered normally by
+// the server and therefore don't count against the breaker.
+func isNASFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, errShortRead) && !isContextError(err)
+}
+
+// sftpOpTimeout bounds each operation run through sftpCall; zero waits
+// indefinitely.
+var sftpOpTimeout time.Duration
+
+var errSFTPTimeout = errors.New("SFTP operation timed out")
+
+// sftpCall runs fn under the breaker and reports the outcome to the
+// connection manager. Whole-file transfers should only open the file
+// through sftpCall, since they can legitimately outlast sftpOpTimeout.
+func sftpCall(fn func() error) error {
+	if err := breaker.allow(); err != nil {
+		return err
+	}
+	if sftpOpTimeout <= 0 {
+		err := fn()
+		recordSFTPResult(err)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(sftpOpTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		recordSFTPResult(err)
+		return err
+	case <-timer.C:
+	}
+	// The sftp package has no deadlines of its own. Reporting the timeout
+	// drops the connection, which fails fn's pending request; waiting for
+	// it keeps fn from writing to the caller's variables after we return.
+	err := fmt.Errorf("%w after %s", errSFTPTimeout, sftpOpTimeout)
+	recordSFTPResult(err)
+	<-done
+	return err
+}
+
+// recordSFTPResult reports the outcome of an SFTP operation that was
+// started through sftpCall but finished outside it, such as a streamed read.
+func recordSFTPResult(err error) {
+	breaker.record(err)
+	nasConn.recordResult(err)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the pooled buffers that image bytes are
+// copied through (COPY_BUFFER_SIZE).
+var copyBufferSize = 32 * 1024
+
+// maxPooledScratch keeps the odd huge transform from pinning its
+// scratch space in the pool.
+const maxPooledScratch = 64 << 20
+
+// byteBuffers pools fixed-size buffers by size, so a copy costs the same
+// few allocations whatever the size of the image.
+var byteBuffers sync.Map // int -> *sync.Pool of *[]byte
+
+func bytePool(size int) *sync.Pool {
+	if pool, ok := byteBuffers.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := byteBuffers.LoadOrStore(size, &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}})
+	return pool.(*sync.Pool)
+}
+
+func getBuffer(size int) *[]byte {
+	return bytePool(size).Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	bytePool(len(*buf)).Put(buf)
+}
+
+// copyPooled is io.Copy through a pooled buffer. Sources that implement
+// io.WriterTo, such as *sftp.File, still copy themselves.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := getBuffer(copyBufferSize)
+	defer putBuffer(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+var bufioReaders sync.Map // int -> *sync.Pool of *bufio.Reader
+
+// getBufferedReader returns a pooled bufio.Reader of size reading r.
+func getBufferedReader(r io.Reader, size int) *bufio.Reader {
+	pool, ok := bufioReaders.Load(size)
+	if !ok {
+		pool, _ = bufioReaders.LoadOrStore(size, &sync.Pool{})
+	}
+	if br, ok := pool.(*sync.Pool).Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func putBufferedReader(br *bufio.Reader) {
+	br.Reset(nil)
+	if pool, ok := bufioReaders.Load(br.Size()); ok {
+		pool.(*sync.Pool).Put(br)
+	}
+}
+
+// scratchBuffers are scratch pixel space for transforms, grown to the
+// largest image seen.
+var scratchBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+func getScratch(n int) *[]byte {
+	buf := scratchBuffers.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func putScratch(buf *[]byte) {
+	if cap(*buf) <= maxPooledScratch {
+		scratchBuffers.Put(buf)
+	}
+}
+
+// encodeBuffers are scratch space for encoding transformed images; the
+// result is copied out at its final size.
+var encodeBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getEncodeBuffer() *bytes.Buffer {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledScratch {
+		encodeBuffers.Put(buf)
+	}
+}
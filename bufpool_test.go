@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// BenchmarkStreamAllocs streams images of growing size with read-ahead.
+// From memory, allocs/op and B/op stay flat whatever the size, as every
+// buffer is pooled. From the test NAS they grow with what the sftp and ssh
+// packages allocate per packet; sftp-only copies the same files through
+// one reused buffer for comparison.
+func BenchmarkStreamAllocs(b *testing.B) {
+	sizes := []int{64 << 10, 1 << 20, 4 << 20}
+	nas := newTestNAS(b, 0)
+	for _, size := range sizes {
+		nas.put(b, fmt.Sprintf("/photos/%d.tif", size), bytes.Repeat([]byte{0x5a}, size))
+	}
+	setStreaming(b, 256*1024, 4)
+
+	for _, size := range sizes {
+		name := fmt.Sprintf("/photos/%d.tif", size)
+		data := bytes.Repeat([]byte{0x5a}, size)
+		b.Run(fmt.Sprintf("memory/%dKB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				n, readErr, writeErr := copyBuffered(context.Background(), bytes.NewReader(data), io.Discard, int64(size), time.Now())
+				if n != int64(size) || readErr != nil || writeErr != nil {
+					b.Fatal(fmt.Sprint(n, readErr, writeErr))
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("nas/%dKB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				file, err := nas.client.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, readErr, writeErr := copyBuffered(context.Background(), file, io.Discard, int64(size), time.Now())
+				file.Close()
+				if n != int64(size) || readErr != nil || writeErr != nil {
+					b.Fatal(fmt.Sprint(n, readErr, writeErr))
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("sftp-only/%dKB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 256*1024)
+			for range b.N {
+				file, err := nas.client.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = io.CopyBuffer(io.Discard, struct{ io.Reader }{file}, buf)
+				file.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache-Control policies, built from config in run. imageCacheControl is
+// only used for versioned image IDs, whose content never changes.
+var (
+	imageCacheControl  = "public, max-age=31536000, immutable"
+	randomCacheControl = "no-store"
+	jsonCacheControl   = "public, max-age=10, stale-while-revalidate=60"
+)
+
+// cacheControl sets policy on successful responses whose handler did not
+// choose one itself. Errors are never cached.
+func cacheControl(policy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &cacheControlWriter{ResponseWriter: c.Writer, policy: policy}
+		c.Next()
+	}
+}
+
+type cacheControlWriter struct {
+	gin.ResponseWriter
+	policy string
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	switch {
+	case code >= 400:
+		w.Header().Set("Cache-Control", "no-store")
+	case w.Header().Get("Cache-Control") == "":
+		w.Header().Set("Cache-Control", w.policy)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// varyAuthorization marks responses as depending on the caller's token.
+func varyAuthorization(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Authorization")
+	c.Next()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds for /wait-for-change. maxChangeWaiters is MAX_CHANGE_WAITERS,
+// where 0 makes every poll answer at once; maxChangeWait is kept under WRITE_TIMEOUT so a poll that times out can
+// still write its answer.
+var (
+	maxChangeWaiters int64 = 100
+	maxChangeWait          = 5 * time.Minute
+	changeWaiters    atomic.Int64
+)
+
+const defaultChangeWait = 30 * time.Second
+
+// waitForChange handles GET /wait-for-change?since=<generation>: it answers
+// as soon as the index generation differs from since, or after ?timeout=
+// seconds with changed false. Without since it answers at once, which is
+// how a client learns the generation to wait on.
+func waitForChange(c *gin.Context) {
+	since := -1
+	if value := c.Query("since"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a non-negative integer"})
+			return
+		}
+		since = n
+	}
+	seconds, err := parseMinDimension(c, "timeout", int(defaultChangeWait/time.Second))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	wait := min(time.Duration(seconds)*time.Second, maxChangeWait)
+
+	generation, images, changed := imageIndex.watch()
+	if since >= 0 && generation == since && wait > 0 && maxChangeWaiters > 0 {
+		if changeWaiters.Add(1) > maxChangeWaiters {
+			changeWaiters.Add(-1)
+			respondOverloaded(c)
+			return
+		}
+		defer changeWaiters.Add(-1)
+		// A parked poll does no work, so it hands its MAX_INFLIGHT_REQUESTS
+		// slot back; MAX_CHANGE_WAITERS bounds it instead.
+		defer requestLimiter.park()()
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			generation, images, _ = imageIndex.watch()
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+			return
+		case <-shuttingDown:
+		}
+	}
+
+	var delta any
+	if since >= 0 {
+		if before, ok := imageIndex.imageCount(since); ok {
+			delta = images - before
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"generation":   generation,
+		"changed":      since >= 0 && generation != since,
+		"images":       images,
+		"images_delta": delta,
+	})
+}
+
+// changeWaitLimit keeps a poll's wait inside the write timeout, leaving a
+// quarter of it to write the response.
+func changeWaitLimit(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return min(5*time.Minute, writeTimeout*3/4)
+}
+
+// writeChangeWaiterMetrics appends the number of parked long polls in the
+// Prometheus text format.
+func writeChangeWaiterMetrics(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP change_waiters Clients waiting in /wait-for-change.\n# TYPE change_waiters gauge\nchange_waiters %d\n", changeWaiters.Load())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// checkReport prints one PASS, FAIL or SKIP line per preflight check.
+type checkReport struct {
+	failed int
+}
+
+func (r *checkReport) pass(name, detail string) {
+	fmt.Printf("PASS  %s: %s\n", name, detail)
+}
+
+func (r *checkReport) fail(name string, err error) {
+	r.failed++
+	fmt.Printf("FAIL  %s: %v\n", name, err)
+}
+
+func (r *checkReport) skip(name, reason string) {
+	fmt.Printf("SKIP  %s: %s\n", name, reason)
+}
+
+// preflight runs the --check (DRY_RUN) checks: the configuration, binding
+// and releasing the listen addresses, the TLS certificate, connecting to
+// the NAS and reading each scan root. It goes through the same code as a
+// normal start, so passing predicts a working one, but nothing is scanned
+// or served and no host key is pinned. The exit status is 0 only if every
+// check passed.
+func preflight(cfg *config, problems []string) int {
+	report := &checkReport{}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			report.fail("config", fmt.Errorf("%s", problem))
+		}
+		report.skip("listen, tls, nas, scan roots", "the configuration is invalid")
+		return 1
+	}
+	report.pass("config", "valid")
+
+	logger = newLogger(cfg.logFormat, cfg.logLevel)
+	applyConfig(cfg)
+
+	listenCfg := *cfg
+	listenCfg.portFile = ""
+	if listeners, err := openListeners(&listenCfg); err != nil {
+		report.fail("listen", err)
+	} else {
+		closeListeners(listeners)
+		report.pass("listen", "can bind "+strings.Join(listenAddresses.Load().([]string), ", "))
+	}
+
+	if cert := cfg.httpTuning.certificate; cert == nil {
+		report.skip("tls", "TLS_CERT_FILE is not set")
+	} else if leaf := cert.Leaf; time.Now().After(leaf.NotAfter) {
+		report.fail("tls", fmt.Errorf("certificate for %s expired on %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.DateOnly)))
+	} else {
+		report.pass("tls", fmt.Sprintf("certificate for %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.DateOnly)))
+	}
+
+	if err := connectNAS(cfg); err != nil {
+		report.fail("nas", err)
+		report.skip("scan roots", "no NAS connection")
+		return min(report.failed, 1)
+	}
+	defer nasConn.close()
+	client, err := nasConn.client()
+	if err != nil {
+		report.fail("nas", err)
+		return 1
+	}
+	report.pass("nas", "connected to "+cfg.sshUser+"@"+cfg.sshHost+":"+cfg.sshPort)
+
+	for _, root := range scanRoots {
+		entries, err := readDirContext(context.Background(), client, root)
+		if err != nil {
+			report.fail("scan root "+root, err)
+			continue
+		}
+		report.pass("scan root "+root, fmt.Sprintf("readable, %d entries", len(entries)))
+	}
+	return min(report.failed, 1)
+}
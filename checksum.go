@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// contentSHA256Enabled adds X-Content-SHA256 to image responses. Bodies
+// built in memory (transformed or sanitized images) are hashed as sent.
+// Streamed originals use the file's cached hash, so the header is missing
+// the first time a file is streamed and present from then on; the hash is
+// computed from that first stream and never costs an extra read.
+var contentSHA256Enabled bool
+
+// checksumStore caches SHA-256 hashes of NAS files by imageCacheKey, so an
+// edited file is hashed afresh.
+type checksumStore struct {
+	mu   sync.RWMutex
+	sums map[string]checksumEntry
+}
+
+// checksumEntry is a hash and the image it is of. path is empty for
+// hashes restored from the index cache, which does not record it.
+type checksumEntry struct {
+	path string
+	sum  string
+}
+
+var checksums = &checksumStore{sums: map[string]checksumEntry{}}
+
+func (s *checksumStore) get(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.sums[key]
+	return entry.sum, ok
+}
+
+func (s *checksumStore) put(key, path, sum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sums[key] = checksumEntry{path, sum}
+}
+
+func (s *checksumStore) purge() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.sums)
+	clear(s.sums)
+	return n
+}
+
+// purgeMatching drops the hashes of images match accepts, and those whose
+// image is unknown.
+func (s *checksumStore) purgeMatching(match func(path string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.sums)
+	maps.DeleteFunc(s.sums, func(_ string, entry checksumEntry) bool { return entry.path == "" || match(entry.path) })
+	return n - len(s.sums)
+}
+
+func (s *checksumStore) export() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]string, len(s.sums))
+	for key, entry := range s.sums {
+		out[key] = entry.sum
+	}
+	return out
+}
+
+func (s *checksumStore) restore(sums map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.sums)
+	for key, sum := range sums {
+		s.sums[key] = checksumEntry{sum: sum}
+	}
+}
+
+// fileChecksum returns the SHA-256 of info's contents, reading the file
+// if the hash is not cached yet.
+func fileChecksum(client *sftp.Client, info ImageInfo) (string, error) {
+	key := imageCacheKey(info)
+	if sum, ok := checksums.get(key); ok {
+		return sum, nil
+	}
+	var file io.ReadCloser
+	err := sftpCall(func() (err error) {
+		file, err = openImage(client, info.Path)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = copyPooled(hash, file)
+	recordSFTPResult(err)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	checksums.put(key, info.Path, sum)
+	return sum, nil
+}
+
+func getImageChecksum(c *gin.Context) {
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	info, _, ok := lookupImage(c, client)
+	if !ok {
+		return
+	}
+
+	readStart := time.Now()
+	sum, err := fileChecksum(client, info)
+	recordStage(c, stageSFTP, readStart)
+	if err != nil {
+		respondSFTPError(c, "Failed to read image file: ", err)
+		return
+	}
+	meta := imageMetadata(info)
+	meta["sha256"] = sum
+	c.JSON(http.StatusOK, meta)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// compareRecord is how an image has fared in /compare.
+type compareRecord struct {
+	Wins   int `json:"wins"`
+	Losses int `json:"losses"`
+}
+
+// compareTallyFile is the on-disk form of the /compare tally.
+type compareTallyFile struct {
+	Version int                       `json:"version"`
+	Images  map[string]*compareRecord `json:"images"`
+}
+
+const compareTallyVersion = 1
+
+// compareTally holds /compare results by image path, so edits to an image
+// keep its record. With COMPARE_TALLY_FILE it is saved after every result
+// and survives restarts; otherwise it lasts until the process exits.
+type compareTally struct {
+	mu     sync.Mutex
+	file   string
+	byPath map[string]*compareRecord
+}
+
+var compareResults = &compareTally{byPath: map[string]*compareRecord{}}
+
+// load reads the tally from file, which need not exist yet, and keeps
+// saving there.
+func (t *compareTally) load(file string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file = file
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f compareTallyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if f.Version != compareTallyVersion {
+		return fmt.Errorf("%s has version %d, want %d", file, f.Version, compareTallyVersion)
+	}
+	if f.Images != nil {
+		t.byPath = f.Images
+	}
+	return nil
+}
+
+func (t *compareTally) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byPath)
+}
+
+func (t *compareTally) of(p string) compareRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r := t.byPath[p]; r != nil {
+		return *r
+	}
+	return compareRecord{}
+}
+
+// record counts a win for winner over loser and saves the tally.
+func (t *compareTally) record(winner, loser string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range []string{winner, loser} {
+		if t.byPath[p] == nil {
+			t.byPath[p] = &compareRecord{}
+		}
+	}
+	t.byPath[winner].Wins++
+	t.byPath[loser].Losses++
+	if t.file == "" {
+		return nil
+	}
+	return writeJSONFile(t.file, compareTallyFile{Version: compareTallyVersion, Images: t.byPath})
+}
+
+type compareStanding struct {
+	path string
+	compareRecord
+}
+
+// standings returns the records of the images include accepts, most wins
+// first, then by win rate.
+func (t *compareTally) standings(include func(string) bool) []compareStanding {
+	t.mu.Lock()
+	var out []compareStanding
+	for p, r := range t.byPath {
+		if include(p) {
+			out = append(out, compareStanding{p, *r})
+		}
+	}
+	t.mu.Unlock()
+	slices.SortFunc(out, func(a, b compareStanding) int {
+		return cmp.Or(
+			cmp.Compare(b.Wins, a.Wins),
+			cmp.Compare(b.winRate(), a.winRate()),
+			cmp.Compare(a.path, b.path),
+		)
+	})
+	return out
+}
+
+func (s compareStanding) winRate() float64 {
+	return float64(s.Wins) / float64(s.Wins+s.Losses)
+}
+
+// getCompare handles GET /compare: two different images picked with the
+// /getRandomImage filters, for a "which is better" game. With
+// ?same_dir=true the second comes from the first one's directory.
+func getCompare(c *gin.Context) {
+	sameDir := false
+	if value := c.Query("same_dir"); value != "" {
+		var err error
+		if sameDir, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "same_dir must be true or false"})
+			return
+		}
+	}
+	sel, ok := parseSelection(c)
+	if !ok {
+		return
+	}
+	first, ok := sel.pick(c)
+	if !ok {
+		return
+	}
+	if sameDir {
+		sel.candidates = []string{imageDirectory(first.Path)}
+	}
+	// A few retries get past picking the first image again; a directory
+	// with one matching image never yields a pair.
+	for range 8 {
+		second, ok := sel.pick(c)
+		if !ok {
+			return
+		}
+		if second.Path == first.Path {
+			continue
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"images":   []gin.H{compareImage(first), compareImage(second)},
+			"same_dir": imageDirectory(first.Path) == imageDirectory(second.Path),
+		})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "No second image matching the request found"})
+}
+
+func compareImage(info ImageInfo) gin.H {
+	id := imageID(info)
+	record := compareResults.of(info.Path)
+	return gin.H{
+		"id":            id,
+		"url":           "/image/" + id,
+		"path":          info.Path,
+		"directory":     imageDirectory(info.Path),
+		"size":          info.Size,
+		"creation_date": formatDate(info.CreationDate),
+		"wins":          record.Wins,
+		"losses":        record.Losses,
+	}
+}
+
+// postCompareResult handles POST /compare/result with a JSON body of
+// {"winner": id, "loser": id}, IDs as /compare returned them.
+func postCompareResult(c *gin.Context) {
+	var body struct {
+		Winner string `json:"winner"`
+		Loser  string `json:"loser"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, 4096))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid result: " + err.Error()})
+		return
+	}
+	var paths [2]string
+	for i, id := range []string{body.Winner, body.Loser} {
+		p, _, err := parseImageID(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Only images in the index can be recorded, so the tally cannot be
+		// filled with made-up paths.
+		if _, indexed := slices.BinarySearch(imageIndex.snapshot(), imageDirectory(p)); !indexed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+			return
+		}
+		if !pathAllowed(c, p) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token does not grant access to this image"})
+			return
+		}
+		paths[i] = p
+	}
+	if paths[0] == paths[1] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "winner and loser must be different images"})
+		return
+	}
+	if err := compareResults.record(paths[0], paths[1]); err != nil {
+		logger.Warn("compare: cannot save tally", "file", compareResults.file, "error", err)
+		recentErrors.record("compare", compareResults.file, err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"winner": gin.H{"path": paths[0], "record": compareResults.of(paths[0])},
+		"loser":  gin.H{"path": paths[1], "record": compareResults.of(paths[1])},
+	})
+}
+
+// getCompareLeaderboard handles GET /compare/leaderboard: the ?limit=
+// images (10 by default) that have won /compare most often, among those
+// still indexed that the caller may see.
+func getCompareLeaderboard(c *gin.Context) {
+	limit, err := parseMinDimension(c, "limit", 10)
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+	indexed := imageIndex.snapshot()
+	standings := compareResults.standings(func(p string) bool {
+		_, found := slices.BinarySearch(indexed, imageDirectory(p))
+		return found && pathAllowed(c, p)
+	})
+	leaders := []gin.H{}
+	for i, s := range standings[:min(limit, len(standings))] {
+		leaders = append(leaders, gin.H{
+			"rank":     i + 1,
+			"path":     s.path,
+			"url":      "/image?path=" + url.QueryEscape(s.path),
+			"wins":     s.Wins,
+			"losses":   s.Losses,
+			"win_rate": s.winRate(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"images": leaders, "ranked": len(standings)})
+}
@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the fully resolved server configuration.
+type config struct {
+	sshUser     string
+	sshPassword string
+	sshHost     string
+	sshPort     string
+
+	sshHostKeyMode string
+	sshHostKeyFile string
+
+	serverHost  string
+	serverPorts []string
+	portFile    string
+
+	unixSocket     string
+	unixSocketMode os.FileMode
+
+	breakerThreshold    int
+	breakerCooldown     time.Duration
+	reconnectMaxBackoff time.Duration
+
+	jwtSecret    string
+	jwksURL      string
+	jwtClockSkew time.Duration
+	jwksRefresh  time.Duration
+
+	adminAPIKeys []string
+
+	shareSecret string
+	shareMaxTTL time.Duration
+
+	corsOrigins     []string
+	corsCredentials bool
+	corsMaxAge      time.Duration
+
+	allowedReferers        []refererPattern
+	allowEmptyReferer      bool
+	hotlinkPlaceholder     string
+	hotlinkPlaceholderData []byte
+	placeholderDir         string
+	errorPlaceholders      errorPlaceholders
+	placeholderImagePath   string
+	fallbackImage          placeholderImage
+	fallbackMode           string
+
+	ipAllow        prefixSet
+	ipDeny         prefixSet
+	trustedProxies prefixSet
+	customHeaders  []customHeader
+
+	diskCacheDir       string
+	diskCacheMaxSize   int64
+	transformCacheSize int64
+	minFreeMemory      int64
+	jpegQuality        int
+	defaultImageMode   string
+	// reencodeJPEGQuality re-encodes plain JPEG responses when set; zero
+	// serves originals as stored.
+	reencodeJPEGQuality int
+	svgSafeMode         string
+	verifyImages        string
+	contentSHA256       bool
+	creationDateSkew    time.Duration
+
+	imageCacheMaxAge         time.Duration
+	randomCacheControl       string
+	jsonCacheMaxAge          time.Duration
+	jsonStaleWhileRevalidate time.Duration
+	globalHistorySize        int
+	errorLogSize             int
+	directoryWeights         map[string]float64
+	recencyBias              time.Duration
+	displayTimezone          *time.Location
+	quietHours               *quietWindow
+	contentTypeOverrides     map[string]string
+	maxInflightRequests      int
+	maxInflightTransforms    int
+	maxConcurrentPerIP       int
+	maxChangeWaiters         int
+	scanEmbeddedXMP          bool
+	scanZips                 bool
+	printTree                bool
+	scanProgressEvery        int
+	webdavListing            bool
+	warmCache                bool
+	warmCachePrefetch        bool
+	randomImagesMaxCount     int
+	strategy                 string
+	randomImagesMaxBytes     int64
+	montageMaxCount          int
+	montageMaxTileSize       int
+	albums                   []album
+	minImageWidth            int
+	minImageHeight           int
+	streamBufferSize         int64
+	streamReadAhead          int
+	copyBufferSize           int64
+	sftpMaxPacket            int64
+	sftpConcurrentReads      bool
+	sshDialTimeout           time.Duration
+	sshHandshakeTimeout      time.Duration
+	sftpOpTimeout            time.Duration
+
+	otlpEndpoint string
+	logFormat    string
+	logLevel     slog.Level
+	serveDemoUI  bool
+	serverHeader bool
+
+	scanRoots []string
+	// nestedScanRoots were configured but dropped because another root
+	// already covers them.
+	nestedScanRoots []string
+	// scanExcludes are name patterns of directories the scanner skips.
+	scanExcludes []string
+
+	// shadowedSecrets are set both inline and as a _FILE; the file is used.
+	shadowedSecrets []string
+
+	scanOnStartup    string
+	indexCacheFile   string
+	compareTallyFile string
+	manifestFile     string
+	manifestMaxAge   time.Duration
+	indexMaxAge      time.Duration
+
+	// dryRun is --check or DRY_RUN: run the preflight checks and exit.
+	dryRun bool
+
+	scanTimeout      time.Duration
+	scanStallTimeout time.Duration
+	scanStallRetries int
+	drainTimeout     time.Duration
+	shutdownTimeout  time.Duration
+	httpTimeouts     httpTimeouts
+	httpTuning       httpTuning
+}
+
+// loadConfig reads the configuration from the environment. Every problem
+// found is reported rather than just the first, so a broken deployment can
+// be fixed in one go.
+func loadConfig() (*config, []string) {
+	l := &configLoader{}
+	cfg := &config{
+		sshUser:     l.required("SSH_USER", "photos"),
+		sshPassword: l.requiredSecret("SSH_PASSWORD", "s3cret"),
+		sshHost:     l.required("SSH_HOST", "192.168.1.10"),
+		sshPort:     l.port("SSH_PORT", "22", 1),
+
+		sshHostKeyMode: l.oneOf("SSH_HOST_KEY_MODE", hostKeyInsecure, hostKeyInsecure, hostKeyTOFU),
+		sshHostKeyFile: getEnv("SSH_HOST_KEY_FILE", ""),
+
+		serverHost:  getEnv("SERVER_HOST", "localhost"),
+		serverPorts: l.ports("SERVER_PORT", "3141"),
+		portFile:    getEnv("PORT_FILE", ""),
+
+		unixSocket:     getEnv("LISTEN_UNIX_SOCKET", ""),
+		unixSocketMode: l.fileMode("LISTEN_UNIX_SOCKET_MODE", 0o660),
+
+		breakerThreshold:    l.intRange("BREAKER_FAILURE_THRESHOLD", 5, 1, 1000),
+		breakerCooldown:     l.duration("BREAKER_COOLDOWN", 30*time.Second),
+		reconnectMaxBackoff: l.duration("RECONNECT_MAX_BACKOFF", time.Minute),
+
+		jwtSecret:    l.secret("JWT_HS256_SECRET"),
+		jwksURL:      l.url("JWT_JWKS_URL", "https://idp.example.com/.well-known/jwks.json"),
+		jwtClockSkew: l.duration("JWT_CLOCK_SKEW", time.Minute),
+		jwksRefresh:  l.duration("JWT_JWKS_REFRESH", 15*time.Minute),
+
+		adminAPIKeys: l.apiKeys("ADMIN_API_KEYS"),
+
+		shareSecret: l.secret("SHARE_SECRET"),
+		shareMaxTTL: l.duration("SHARE_MAX_TTL", 30*24*time.Hour),
+
+		corsOrigins:     l.corsOrigins("CORS_ALLOWED_ORIGINS"),
+		corsCredentials: l.bool("CORS_ALLOW_CREDENTIALS", false),
+		corsMaxAge:      l.duration("CORS_MAX_AGE", 10*time.Minute),
+
+		allowedReferers:      l.refererPatterns("ALLOWED_REFERERS"),
+		allowEmptyReferer:    l.bool("ALLOW_EMPTY_REFERER", true),
+		hotlinkPlaceholder:   getEnv("HOTLINK_PLACEHOLDER", ""),
+		placeholderDir:       getEnv("PLACEHOLDER_DIR", ""),
+		placeholderImagePath: getEnv("PLACEHOLDER_IMAGE_PATH", ""),
+		fallbackMode:         l.oneOf("FALLBACK_MODE", fallbackJSON, fallbackJSON, fallbackImage),
+
+		ipAllow:        l.prefixes("IP_ALLOW_CIDRS"),
+		ipDeny:         l.prefixes("IP_DENY_CIDRS"),
+		trustedProxies: l.prefixes("TRUSTED_PROXIES"),
+		customHeaders:  l.customHeaders("CUSTOM_HEADERS"),
+
+		diskCacheDir:        l.writableDir("DISK_CACHE_DIR"),
+		diskCacheMaxSize:    l.bytes("DISK_CACHE_MAX_SIZE", 1<<30),
+		transformCacheSize:  l.bytes("TRANSFORM_CACHE_SIZE", 64<<20),
+		minFreeMemory:       l.bytes("MIN_FREE_MEMORY", 0),
+		jpegQuality:         l.intRange("JPEG_QUALITY", defaultJPEGQuality, 1, 100),
+		defaultImageMode:    l.oneOf("DEFAULT_IMAGE_MODE", colorOriginal, colorModes...),
+		reencodeJPEGQuality: l.intRange("DEFAULT_JPEG_QUALITY", 0, 1, 100),
+		svgSafeMode:         l.oneOf("SVG_SAFE_MODE", svgModeSanitize, svgModeSanitize, svgModeAttachment, svgModeOff),
+		verifyImages:        verifyOff,
+		contentSHA256:       l.bool("CONTENT_SHA256", false),
+		creationDateSkew:    l.duration("CREATION_DATE_SKEW", 24*time.Hour),
+
+		imageCacheMaxAge:         l.duration("IMAGE_CACHE_MAX_AGE", 365*24*time.Hour),
+		randomCacheControl:       getEnv("RANDOM_CACHE_CONTROL", "no-store"),
+		jsonCacheMaxAge:          l.duration("JSON_CACHE_MAX_AGE", 10*time.Second),
+		jsonStaleWhileRevalidate: l.duration("JSON_STALE_WHILE_REVALIDATE", time.Minute),
+		globalHistorySize:        l.intRange("GLOBAL_HISTORY_SIZE", 0, 0, 1_000_000),
+		errorLogSize:             l.intRange("ERROR_LOG_SIZE", 100, 0, 100_000),
+		directoryWeights:         l.directoryWeights("DIRECTORY_WEIGHTS"),
+		recencyBias:              l.duration("RECENCY_BIAS", 0),
+		displayTimezone:          l.location("DISPLAY_TIMEZONE"),
+		contentTypeOverrides:     l.contentTypeOverrides("CONTENT_TYPE_OVERRIDES"),
+		maxInflightRequests:      l.intRange("MAX_INFLIGHT_REQUESTS", 64, 0, 100_000),
+		maxInflightTransforms:    l.intRange("MAX_INFLIGHT_TRANSFORMS", 8, 0, 10_000),
+		maxConcurrentPerIP:       l.intRange("MAX_CONCURRENT_PER_IP", 4, 0, 10_000),
+		maxChangeWaiters:         l.intRange("MAX_CHANGE_WAITERS", 100, 0, 100_000),
+		scanEmbeddedXMP:          l.bool("SCAN_EMBEDDED_XMP", true),
+		scanZips:                 l.bool("SCAN_ZIPS", false),
+		printTree:                l.bool("SCAN_VERBOSE", false),
+		scanProgressEvery:        l.intRange("SCAN_PROGRESS_EVERY", 1000, 1, 1_000_000),
+		webdavListing:            l.bool("WEBDAV_LISTING", false),
+		warmCache:                l.bool("WARM_CACHE", false),
+		warmCachePrefetch:        l.bool("WARM_CACHE_PREFETCH", false),
+		strategy:                 l.oneOf("STRATEGY", strategyRandom, strategies...),
+		randomImagesMaxCount:     l.intRange("RANDOM_IMAGES_MAX_COUNT", 10, 1, 100),
+		randomImagesMaxBytes:     l.bytes("RANDOM_IMAGES_MAX_BYTES", 32<<20),
+		montageMaxCount:          l.intRange("MONTAGE_MAX_COUNT", 36, 1, 100),
+		montageMaxTileSize:       l.intRange("MONTAGE_MAX_TILE_SIZE", 400, montageMinTileSize, 1024),
+		albums:                   l.albums("ALBUMS"),
+		minImageWidth:            l.intRange("MIN_IMAGE_WIDTH", 0, 0, 100_000),
+		minImageHeight:           l.intRange("MIN_IMAGE_HEIGHT", 0, 0, 100_000),
+		streamBufferSize:         l.bytes("STREAM_BUFFER_SIZE", 0),
+		streamReadAhead:          l.intRange("STREAM_READ_AHEAD", 0, 0, 64),
+		copyBufferSize:           l.bytes("COPY_BUFFER_SIZE", 32*1024),
+		sftpMaxPacket:            l.bytes("SFTP_MAX_PACKET", 32*1024),
+		sftpConcurrentReads:      l.bool("SFTP_CONCURRENT_READS", true),
+		sshDialTimeout:           l.duration("SSH_DIAL_TIMEOUT", 10*time.Second),
+		sshHandshakeTimeout:      l.duration("SSH_HANDSHAKE_TIMEOUT", 10*time.Second),
+		sftpOpTimeout:            l.duration("SFTP_OP_TIMEOUT", 30*time.Second),
+
+		otlpEndpoint: l.url("OTEL_EXPORTER_OTLP_ENDPOINT", "http://tempo:4318"),
+		logFormat:    l.oneOf("LOG_FORMAT", "text", "text", "json"),
+		logLevel:     l.logLevel("LOG_LEVEL"),
+		serveDemoUI:  l.bool("SERVE_DEMO_UI", true),
+		serverHeader: l.bool("SERVER_HEADER", false),
+
+		scanOnStartup:    l.oneOf("SCAN_ON_STARTUP", scanAuto, scanAuto, scanAlways, scanNever),
+		indexCacheFile:   l.writableFile("INDEX_CACHE_FILE", "/var/lib/nas-sftp-api/index.json"),
+		compareTallyFile: l.writableFile("COMPARE_TALLY_FILE", "/var/lib/nas-sftp-api/compare.json"),
+		manifestFile:     l.writableFile("MANIFEST_FILE", "/var/lib/nas-sftp-api/manifest.json"),
+		manifestMaxAge:   l.duration("MANIFEST_MAX_AGE", 0),
+		indexMaxAge:      l.duration("INDEX_MAX_AGE", 24*time.Hour),
+
+		dryRun: l.bool("DRY_RUN", false),
+
+		scanTimeout:      l.duration("SCAN_TIMEOUT", 0),
+		scanStallTimeout: l.duration("SCAN_STALL_TIMEOUT", 0),
+		scanStallRetries: l.intRange("SCAN_STALL_RETRIES", 3, 0, 100),
+		drainTimeout:     l.duration("DRAIN_TIMEOUT", 0),
+		shutdownTimeout:  l.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		httpTimeouts: httpTimeouts{
+			readHeader: l.duration("READ_HEADER_TIMEOUT", 10*time.Second),
+			write:      l.duration("WRITE_TIMEOUT", time.Minute),
+			idle:       l.duration("IDLE_TIMEOUT", 2*time.Minute),
+		},
+		httpTuning: httpTuning{
+			certificate:          l.certificate("TLS_CERT_FILE", "TLS_KEY_FILE"),
+			h2c:                  l.bool("H2C", false),
+			maxHeaderBytes:       int(l.bytes("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)),
+			maxConcurrentStreams: l.intRange("HTTP2_MAX_CONCURRENT_STREAMS", 250, 1, 10_000),
+		},
+	}
+	l.exclusive("LISTEN_UNIX_SOCKET", "SERVER_HOST", "SERVER_PORT", "PORT_FILE")
+	if cfg.httpTuning.certificate != nil && cfg.httpTuning.h2c {
+		l.problem("H2C", "only applies to plaintext listeners; HTTP/2 is already on with TLS_CERT_FILE", "true")
+	}
+	if cfg.corsCredentials && slices.Contains(cfg.corsOrigins, "*") {
+		l.problem("CORS_ALLOW_CREDENTIALS", "needs CORS_ALLOWED_ORIGINS to list specific origins rather than *", "true")
+	}
+	if cfg.hotlinkPlaceholder != "" {
+		cfg.hotlinkPlaceholderData = l.imageFile("HOTLINK_PLACEHOLDER", cfg.hotlinkPlaceholder)
+	}
+	if cfg.placeholderDir != "" {
+		cfg.errorPlaceholders = l.errorPlaceholders("PLACEHOLDER_DIR", cfg.placeholderDir)
+	}
+	cfg.fallbackImage = placeholderImage{data: defaultFallbackImage, contentType: "image/png"}
+	if cfg.placeholderImagePath != "" {
+		cfg.fallbackImage = l.fallbackImage("PLACEHOLDER_IMAGE_PATH", cfg.placeholderImagePath)
+	}
+	if cfg.shareSecret != "" && len(cfg.shareSecret) < 16 {
+		l.problem("SHARE_SECRET", "must be at least 16 characters", "$(openssl rand -hex 32)")
+	}
+	// Share links are minted by token holders, or by admins without JWT;
+	// with neither, anyone could mint one for any image.
+	if cfg.shareSecret != "" && cfg.jwtSecret == "" && cfg.jwksURL == "" && len(cfg.adminAPIKeys) == 0 {
+		l.problem("ADMIN_API_KEYS", "must be set for SHARE_SECRET unless JWT_HS256_SECRET or JWT_JWKS_URL is", "$(openssl rand -hex 16)")
+	}
+	cfg.scanRoots, cfg.nestedScanRoots = l.scanRoots("SCAN_ROOT")
+	cfg.scanExcludes = l.scanExcludes("SCAN_EXCLUDE")
+	cfg.quietHours = l.quietHours("QUIET_HOURS", cfg.displayTimezone)
+	// SANITIZE_SVG predates SVG_SAFE_MODE and still works as a sanitize/off
+	// switch.
+	l.exclusive("SVG_SAFE_MODE", "SANITIZE_SVG")
+	if !l.bool("SANITIZE_SVG", true) {
+		cfg.svgSafeMode = svgModeOff
+	}
+	// IMAGE_CACHE_MB is TRANSFORM_CACHE_SIZE in whole megabytes.
+	l.exclusive("IMAGE_CACHE_MB", "TRANSFORM_CACHE_SIZE")
+	if os.Getenv("IMAGE_CACHE_MB") != "" {
+		cfg.transformCacheSize = int64(l.intRange("IMAGE_CACHE_MB", 64, 0, 1<<20)) << 20
+	}
+	// TRUSTED_PROXY_CIDRS is the original name of TRUSTED_PROXIES.
+	l.exclusive("TRUSTED_PROXIES", "TRUSTED_PROXY_CIDRS")
+	if os.Getenv("TRUSTED_PROXY_CIDRS") != "" {
+		cfg.trustedProxies = l.prefixes("TRUSTED_PROXY_CIDRS")
+	}
+	// API_KEYS_FILE is another name for ADMIN_API_KEYS_FILE.
+	l.exclusive("ADMIN_API_KEYS_FILE", "API_KEYS_FILE")
+	if os.Getenv("API_KEYS_FILE") != "" {
+		cfg.adminAPIKeys = l.apiKeys("API_KEYS")
+	}
+	// VERIFY_IMAGES turns on header checks and VERIFY_FULL upgrades them
+	// to full decodes.
+	if l.bool("VERIFY_IMAGES", false) {
+		cfg.verifyImages = verifyHeader
+	}
+	if l.bool("VERIFY_FULL", false) {
+		cfg.verifyImages = verifyFull
+	}
+	if cfg.sshHostKeyMode == hostKeyTOFU && cfg.sshHostKeyFile == "" {
+		l.problem("SSH_HOST_KEY_MODE", "tofu requires SSH_HOST_KEY_FILE", "insecure")
+	}
+	if cfg.scanOnStartup == scanNever && cfg.indexCacheFile == "" {
+		l.problem("SCAN_ON_STARTUP", "never requires INDEX_CACHE_FILE", "auto")
+	}
+	if cfg.copyBufferSize < 4<<10 || cfg.copyBufferSize > 4<<20 {
+		l.problem("COPY_BUFFER_SIZE", "must be between 4KB and 4MB", "32KB")
+	}
+	if cfg.streamBufferSize > 16<<20 {
+		l.problem("STREAM_BUFFER_SIZE", "must be at most 16MB", "256KB")
+	}
+	// The sftp package cannot receive a packet over 256KB with its
+	// headers, and OpenSSH serves at most 255KB per read.
+	if cfg.sftpMaxPacket < 1024 || cfg.sftpMaxPacket > 255<<10 {
+		l.problem("SFTP_MAX_PACKET", "must be between 1KB and 255KB", "64KB")
+	}
+	cfg.shadowedSecrets = l.shadowed
+	return cfg, l.problems
+}
+
+// summary is a single log line describing cfg with secrets redacted.
+func (cfg *config) summary() string {
+	parts := []string{
+		fmt.Sprintf("nas=%s@%s", cfg.sshUser, net.JoinHostPort(cfg.sshHost, cfg.sshPort)),
+		"password=" + redact(cfg.sshPassword),
+		"host_key=" + cfg.sshHostKeyMode,
+	}
+	if cfg.unixSocket != "" {
+		parts = append(parts, fmt.Sprintf("listen=unix:%s(%04o)", cfg.unixSocket, cfg.unixSocketMode))
+	} else {
+		addrs := make([]string, len(cfg.serverPorts))
+		for i, port := range cfg.serverPorts {
+			addrs[i] = net.JoinHostPort(cfg.serverHost, port)
+		}
+		parts = append(parts, "listen="+strings.Join(addrs, ","))
+	}
+	switch {
+	case cfg.jwtSecret != "" && cfg.jwksURL != "":
+		parts = append(parts, "jwt=hs256+jwks")
+	case cfg.jwtSecret != "":
+		parts = append(parts, "jwt=hs256")
+	case cfg.jwksURL != "":
+		parts = append(parts, "jwt=jwks")
+	}
+	if len(cfg.adminAPIKeys) > 0 {
+		parts = append(parts, fmt.Sprintf("admin_keys=%d", len(cfg.adminAPIKeys)))
+	}
+	if cfg.shareSecret != "" {
+		parts = append(parts, fmt.Sprintf("share_links=key:%s,max_ttl:%s", newShareSigner(cfg.shareSecret, cfg.shareMaxTTL).keyID, cfg.shareMaxTTL))
+	}
+	if !slices.Equal(cfg.corsOrigins, []string{"*"}) {
+		parts = append(parts, fmt.Sprintf("cors_origins=%s credentials=%t", strings.Join(cfg.corsOrigins, ","), cfg.corsCredentials))
+	}
+	if len(cfg.allowedReferers) > 0 {
+		parts = append(parts, fmt.Sprintf("allowed_referers=%d empty_referer=%t", len(cfg.allowedReferers), cfg.allowEmptyReferer))
+		if cfg.hotlinkPlaceholder != "" {
+			parts = append(parts, "hotlink_placeholder="+cfg.hotlinkPlaceholder)
+		}
+	}
+	if cfg.placeholderDir != "" {
+		parts = append(parts, fmt.Sprintf("placeholders=%s(%d)", cfg.placeholderDir, cfg.errorPlaceholders.count()))
+	}
+	if cfg.fallbackMode != fallbackJSON || cfg.placeholderImagePath != "" {
+		image := "default"
+		if cfg.placeholderImagePath != "" {
+			image = cfg.placeholderImagePath
+		}
+		parts = append(parts, fmt.Sprintf("fallback=%s(%s)", cfg.fallbackMode, image))
+	}
+	if len(cfg.trustedProxies) > 0 {
+		parts = append(parts, fmt.Sprintf("trusted_proxies=%d", len(cfg.trustedProxies)))
+	}
+	if len(cfg.ipAllow) > 0 || len(cfg.ipDeny) > 0 {
+		parts = append(parts, fmt.Sprintf("ip_filter=%d allow/%d deny", len(cfg.ipAllow), len(cfg.ipDeny)))
+	}
+	if cfg.diskCacheDir != "" {
+		parts = append(parts, fmt.Sprintf("disk_cache=%s(%s)", cfg.diskCacheDir, formatBytes(cfg.diskCacheMaxSize)))
+	}
+	parts = append(parts,
+		"transform_cache="+formatBytes(cfg.transformCacheSize),
+		fmt.Sprintf("jpeg_quality=%d", cfg.jpegQuality),
+		"svg_safe_mode="+cfg.svgSafeMode,
+		"verify="+cfg.verifyImages,
+	)
+	if cfg.minFreeMemory > 0 {
+		parts = append(parts, "min_free_memory="+formatBytes(cfg.minFreeMemory))
+	}
+	if cfg.contentSHA256 {
+		parts = append(parts, "content_sha256=true")
+	}
+	if cfg.reencodeJPEGQuality > 0 {
+		parts = append(parts, fmt.Sprintf("reencode_jpeg=%d", cfg.reencodeJPEGQuality))
+	}
+	if cfg.defaultImageMode != colorOriginal {
+		parts = append(parts, "image_mode="+cfg.defaultImageMode)
+	}
+	if cfg.minImageWidth > 0 || cfg.minImageHeight > 0 {
+		parts = append(parts, fmt.Sprintf("min_image=%dx%d", cfg.minImageWidth, cfg.minImageHeight))
+	}
+	parts = append(parts, fmt.Sprintf("max_inflight=%d/%d per_ip=%d change_waiters=%d", cfg.maxInflightRequests, cfg.maxInflightTransforms, cfg.maxConcurrentPerIP, cfg.maxChangeWaiters))
+	if len(cfg.contentTypeOverrides) > 0 {
+		parts = append(parts, fmt.Sprintf("content_type_overrides=%d", len(cfg.contentTypeOverrides)))
+	}
+	if cfg.strategy != strategyRandom {
+		parts = append(parts, "strategy="+cfg.strategy)
+	}
+	if len(cfg.albums) > 0 {
+		parts = append(parts, fmt.Sprintf("albums=%d", len(cfg.albums)))
+	}
+	if len(cfg.directoryWeights) > 0 {
+		parts = append(parts, fmt.Sprintf("directory_weights=%d", len(cfg.directoryWeights)))
+	}
+	if cfg.displayTimezone != time.UTC {
+		parts = append(parts, "display_timezone="+cfg.displayTimezone.String())
+	}
+	if q := cfg.quietHours; q != nil {
+		parts = append(parts, fmt.Sprintf("quiet_hours=%02d:%02d-%02d:%02d(%s,%s)", q.start/60, q.start%60, q.end/60, q.end%60, q.loc, q.mode))
+	}
+	if cfg.recencyBias > 0 {
+		parts = append(parts, "recency_half_life="+cfg.recencyBias.String())
+	}
+	if cfg.copyBufferSize != 32*1024 {
+		parts = append(parts, "copy_buffer="+formatBytes(cfg.copyBufferSize))
+	}
+	if cfg.streamBufferSize > 0 || cfg.streamReadAhead > 0 {
+		parts = append(parts, fmt.Sprintf("stream_buffer=%s read_ahead=%d", formatBytes(cfg.streamBufferSize), cfg.streamReadAhead))
+	}
+	if cfg.sftpMaxPacket != 32*1024 || !cfg.sftpConcurrentReads {
+		parts = append(parts, fmt.Sprintf("sftp_max_packet=%s concurrent_reads=%t", formatBytes(cfg.sftpMaxPacket), cfg.sftpConcurrentReads))
+	}
+	if cfg.indexCacheFile != "" {
+		parts = append(parts, fmt.Sprintf("index_cache=%s scan_on_startup=%s max_age=%s", cfg.indexCacheFile, cfg.scanOnStartup, cfg.indexMaxAge))
+	}
+	if cfg.compareTallyFile != "" {
+		parts = append(parts, "compare_tally="+cfg.compareTallyFile)
+	}
+	if cfg.manifestFile != "" {
+		parts = append(parts, "manifest="+cfg.manifestFile)
+	}
+	if cfg.scanTimeout > 0 {
+		parts = append(parts, "scan_timeout="+cfg.scanTimeout.String())
+	}
+	if cfg.scanStallTimeout > 0 {
+		parts = append(parts, fmt.Sprintf("scan_stall_timeout=%s retries=%d", cfg.scanStallTimeout, cfg.scanStallRetries))
+	}
+	if cfg.otlpEndpoint != "" {
+		parts = append(parts, "otlp="+cfg.otlpEndpoint)
+	}
+	if !cfg.scanEmbeddedXMP {
+		parts = append(parts, "embedded_xmp=false")
+	}
+	if !slices.Equal(cfg.scanRoots, []string{"/"}) {
+		parts = append(parts, "scan_roots="+strings.Join(cfg.scanRoots, ","))
+	}
+	if len(cfg.scanExcludes) > 0 {
+		parts = append(parts, "scan_exclude="+strings.Join(cfg.scanExcludes, ","))
+	}
+	if cfg.scanZips {
+		parts = append(parts, "scan_zips=true")
+	}
+	if cfg.printTree {
+		parts = append(parts, "print_tree=true")
+	}
+	if cfg.logLevel != slog.LevelInfo {
+		parts = append(parts, "log_level="+strings.ToLower(cfg.logLevel.String()))
+	}
+	if cfg.webdavListing {
+		parts = append(parts, "webdav=true")
+	}
+	if cfg.warmCache {
+		parts = append(parts, fmt.Sprintf("warm_cache=true prefetch=%t", cfg.warmCachePrefetch))
+	}
+	if cfg.drainTimeout > 0 {
+		parts = append(parts, "drain="+cfg.drainTimeout.String())
+	}
+	parts = append(parts, fmt.Sprintf("ssh_timeouts=dial:%s,handshake:%s,op:%s", cfg.sshDialTimeout, cfg.sshHandshakeTimeout, cfg.sftpOpTimeout))
+	t := cfg.httpTimeouts
+	parts = append(parts, fmt.Sprintf("http_timeouts=header:%s,write:%s,idle:%s", t.readHeader, t.write, t.idle))
+	switch tuning := cfg.httpTuning; {
+	case tuning.certificate != nil:
+		parts = append(parts, fmt.Sprintf("tls=true http2_streams=%d", tuning.maxConcurrentStreams))
+	case tuning.h2c:
+		parts = append(parts, fmt.Sprintf("h2c=true http2_streams=%d", tuning.maxConcurrentStreams))
+	}
+	return "Config: " + strings.Join(parts, " ")
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return "(unset)"
+	}
+	return "***"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// configLoader reads typed values from the environment, collecting a
+// problem for every value that doesn't parse instead of stopping early.
+type configLoader struct {
+	problems []string
+	// shadowed lists secrets set both inline and as a _FILE, where the
+	// file wins.
+	shadowed []string
+}
+
+func (l *configLoader) problem(key, message, example string) {
+	l.problems = append(l.problems, fmt.Sprintf("%s: %s (example: %s=%s)", key, message, key, example))
+}
+
+// exclusive flags every one of others that is set alongside key.
+func (l *configLoader) exclusive(key string, others ...string) {
+	if os.Getenv(key) == "" {
+		return
+	}
+	for _, other := range others {
+		if os.Getenv(other) != "" {
+			l.problems = append(l.problems, fmt.Sprintf("%s: cannot be combined with %s; unset one of them", key, other))
+		}
+	}
+}
+
+func (l *configLoader) required(key, example string) string {
+	value := getEnv(key, "")
+	if value == "" {
+		l.problem(key, "must be set", example)
+	}
+	return value
+}
+
+// secret reads a secret-bearing setting from the file named by key_FILE
+// or, when that is unset, from key itself, so credentials mounted by a
+// secrets manager never have to sit in the environment. The file wins when
+// both are set, as with the usual Docker _FILE convention. Trailing
+// newlines in the file are dropped.
+func (l *configLoader) secret(key string) string {
+	name := getEnv(key+"_FILE", "")
+	if name == "" {
+		return getEnv(key, "")
+	}
+	if getEnv(key, "") != "" {
+		l.shadowed = append(l.shadowed, key)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		l.problem(key+"_FILE", err.Error(), "/run/secrets/"+strings.ToLower(key))
+		return ""
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		l.problem(key+"_FILE", name+" is empty", "/run/secrets/"+strings.ToLower(key))
+	}
+	return value
+}
+
+func (l *configLoader) requiredSecret(key, example string) string {
+	value := l.secret(key)
+	if value == "" && getEnv(key+"_FILE", "") == "" {
+		l.problem(key, "must be set, or "+key+"_FILE", example)
+	}
+	return value
+}
+
+// port accepts a port number from minPort to 65535.
+func (l *configLoader) port(key, defaultValue string, minPort int) string {
+	value := getEnv(key, defaultValue)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minPort || n > 65535 {
+		l.problem(key, fmt.Sprintf("%q is not a port number between %d and 65535", value, minPort), defaultValue)
+	}
+	return value
+}
+
+// ports accepts a comma-separated list of SERVER_PORT style ports. 0 may
+// repeat since each one binds a different free port.
+func (l *configLoader) ports(key, defaultValue string) []string {
+	var ports []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		value = strings.TrimSpace(value)
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 65535 {
+			l.problem(key, fmt.Sprintf("%q is not a port number between 0 and 65535", value), "3141,9090")
+			continue
+		}
+		if n != 0 && slices.Contains(ports, value) {
+			l.problem(key, fmt.Sprintf("port %s is listed twice", value), "3141,9090")
+			continue
+		}
+		ports = append(ports, value)
+	}
+	return ports
+}
+
+func (l *configLoader) intRange(key string, defaultValue, minValue, maxValue int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minValue || n > maxValue {
+		l.problem(key, fmt.Sprintf("%q is not an integer between %d and %d", value, minValue, maxValue), strconv.Itoa(defaultValue))
+		return defaultValue
+	}
+	return n
+}
+
+func (l *configLoader) duration(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		l.problem(key, fmt.Sprintf("%q is not a duration", value), "30s")
+		return defaultValue
+	}
+	return d
+}
+
+func (l *configLoader) bool(key string, defaultValue bool) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.problem(key, fmt.Sprintf("%q is not a boolean", value), strconv.FormatBool(defaultValue))
+		return defaultValue
+	}
+	return b
+}
+
+func (l *configLoader) oneOf(key, defaultValue string, allowed ...string) string {
+	value := getEnv(key, defaultValue)
+	if !slices.Contains(allowed, value) {
+		l.problem(key, fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", ")), allowed[0])
+		return defaultValue
+	}
+	return value
+}
+
+// location loads an IANA zone name such as Europe/Warsaw, defaulting to
+// UTC.
+func (l *configLoader) location(key string) *time.Location {
+	value := getEnv(key, "")
+	if value == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		l.problem(key, fmt.Sprintf("unknown time zone %q", value), "Europe/Warsaw")
+		return time.UTC
+	}
+	return loc
+}
+
+func (l *configLoader) fileMode(key string, defaultValue os.FileMode) os.FileMode {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		l.problem(key, fmt.Sprintf("%q is not an octal permission mode", value), "0660")
+		return defaultValue
+	}
+	return os.FileMode(mode)
+}
+
+func (l *configLoader) bytes(key string, defaultValue int64) int64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := parseByteSize(value)
+	if err != nil {
+		l.problem(key, fmt.Sprintf("%q is not a byte size", value), "256MB")
+		return defaultValue
+	}
+	return n
+}
+
+// scanRoots reads a comma-separated list of absolute directories, keeping
+// only the outermost when they overlap so nothing is indexed twice.
+func (l *configLoader) scanRoots(key string) (roots, nested []string) {
+	var dirs []string
+	for _, field := range strings.Split(getEnv(key, ""), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !path.IsAbs(field) {
+			l.problem(key, fmt.Sprintf("%q is not an absolute path", field), "/volume1/photo,/volume1/homes/me/Photos")
+			continue
+		}
+		dirs = append(dirs, field)
+	}
+	if len(dirs) == 0 {
+		return []string{"/"}, nil
+	}
+	return outermostDirectories(dirs)
+}
+
+// scanExcludes reads a comma-separated list of path.Match patterns.
+func (l *configLoader) scanExcludes(key string) []string {
+	patterns, err := parseScanExcludes(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "@eaDir,#recycle,.*")
+	}
+	return patterns
+}
+
+func (l *configLoader) logLevel(key string) slog.Level {
+	var level slog.Level
+	value := l.oneOf(key, "info", "debug", "info", "warn", "error")
+	level.UnmarshalText([]byte(value))
+	return level
+}
+
+func (l *configLoader) prefixes(key string) prefixSet {
+	set, err := parsePrefixSet(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "192.168.0.0/16,2001:db8::/32")
+	}
+	return set
+}
+
+func (l *configLoader) customHeaders(key string) []customHeader {
+	headers, err := parseCustomHeaders(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "X-Frame-Options:DENY;Cache-Control:no-store")
+	}
+	return headers
+}
+
+// apiKeys reads a comma-separated list of secrets. Short keys are refused
+// since they are compared directly rather than hashed or signed.
+func (l *configLoader) apiKeys(key string) []string {
+	var keys []string
+	for _, k := range strings.FieldsFunc(l.secret(key), func(r rune) bool { return r == ',' || r == '\n' }) {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if len(k) < 16 {
+			l.problem(key, "keys must be at least 16 characters", "$(openssl rand -hex 16)")
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// certificate loads the TLS key pair named by certKey and keyKey, which
+// must be set together.
+func (l *configLoader) certificate(certKey, keyKey string) *tls.Certificate {
+	certFile, keyFile := getEnv(certKey, ""), getEnv(keyKey, "")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		l.problem(certKey, "must be set together with "+keyKey, "/etc/nas-sftp-api/tls.crt")
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		l.problem(certKey, err.Error(), "/etc/nas-sftp-api/tls.crt")
+		return nil
+	}
+	return &cert
+}
+
+func (l *configLoader) corsOrigins(key string) []string {
+	origins, err := parseCORSOrigins(getEnv(key, "*"))
+	if err != nil {
+		l.problem(key, err.Error(), "https://myphotos.example")
+	}
+	return origins
+}
+
+func (l *configLoader) refererPatterns(key string) []refererPattern {
+	patterns, err := parseRefererPatterns(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "https://myphotos.example,https://*.mydomain.net")
+	}
+	return patterns
+}
+
+func (l *configLoader) errorPlaceholders(key, dir string) errorPlaceholders {
+	placeholders, err := loadErrorPlaceholders(dir)
+	if err != nil {
+		l.problem(key, err.Error(), "/etc/nas-sftp-api/placeholders")
+	}
+	return placeholders
+}
+
+// imageFile reads an image the server serves as is, such as a placeholder.
+func (l *configLoader) imageFile(key, name string) []byte {
+	if !isImageFile(name) {
+		l.problem(key, name+" is not an image file", "/etc/nas-sftp-api/placeholder.png")
+		return nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		l.problem(key, err.Error(), "/etc/nas-sftp-api/placeholder.png")
+	}
+	return data
+}
+
+// fallbackImage reads the image served in place of a failed selection,
+// refusing one too large to keep in memory.
+func (l *configLoader) fallbackImage(key, name string) placeholderImage {
+	if info, err := os.Stat(name); err == nil && info.Size() > maxFallbackImageSize {
+		l.problem(key, fmt.Sprintf("%s is %s, more than the %s allowed", name, formatBytes(info.Size()), formatBytes(maxFallbackImageSize)), "/etc/nas-sftp-api/placeholder.png")
+		return placeholderImage{}
+	}
+	return placeholderImage{data: l.imageFile(key, name), contentType: getContentType(name)}
+}
+
+func (l *configLoader) directoryWeights(key string) map[string]float64 {
+	weights, err := parseDirectoryWeights(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "2024-Japan:5,misc:0.2")
+	}
+	return weights
+}
+
+// quietHours reads QUIET_HOURS with its timezone, which defaults to
+// DISPLAY_TIMEZONE, and mode.
+func (l *configLoader) quietHours(key string, defaultLocation *time.Location) *quietWindow {
+	loc := defaultLocation
+	if getEnv(key+"_TIMEZONE", "") != "" {
+		loc = l.location(key + "_TIMEZONE")
+	}
+	mode := l.oneOf(key+"_MODE", quietPlaceholder, quietPlaceholder, quietNoContent)
+	value := getEnv(key, "")
+	if value == "" {
+		return nil
+	}
+	start, end, err := parseQuietHours(value)
+	if err != nil {
+		l.problem(key, err.Error(), "22:00-07:00")
+		return nil
+	}
+	return &quietWindow{start: start, end: end, loc: loc, mode: mode}
+}
+
+func (l *configLoader) contentTypeOverrides(key string) map[string]string {
+	overrides, err := parseContentTypeOverrides(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "jfif:image/jpeg;heic:image/heic")
+	}
+	return overrides
+}
+
+func (l *configLoader) albums(key string) []album {
+	parsed, err := parseAlbums(getEnv(key, ""))
+	if err != nil {
+		l.problem(key, err.Error(), "2019 summer:/photos/2019-07*,/photos/2019-08*;Japan:2024-Japan")
+	}
+	return parsed
+}
+
+func (l *configLoader) url(key, example string) string {
+	value := getEnv(key, "")
+	if value != "" && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+		l.problem(key, fmt.Sprintf("%q is not an http(s) URL", value), example)
+	}
+	return value
+}
+
+// writableDir checks that the directory named by key exists, or could be
+// created, and accepts new files. Nothing is created here: a config that
+// fails validation leaves the filesystem alone, and openDiskCache creates
+// the directory once it has passed.
+func (l *configLoader) writableDir(key string) string {
+	dir := getEnv(key, "")
+	if dir == "" {
+		return ""
+	}
+	if err := checkWritableDir(dir); err != nil {
+		l.problem(key, err.Error(), "/var/cache/nas-sftp-api")
+	}
+	return dir
+}
+
+// writableFile checks that the file named by key can be read and replaced:
+// an existing file must be readable and writable, and its directory must
+// accept the temporary file writeJSONFile renames over it.
+func (l *configLoader) writableFile(key, example string) string {
+	name := getEnv(key, "")
+	if name == "" {
+		return ""
+	}
+	if info, err := os.Stat(name); err == nil {
+		if !info.Mode().IsRegular() {
+			l.problem(key, name+" is not a regular file", example)
+			return name
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			l.problem(key, fmt.Sprintf("file %s is not readable and writable: %v", name, err), example)
+			return name
+		}
+		f.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		l.problem(key, err.Error(), example)
+		return name
+	}
+	if err := checkWritableDir(filepath.Dir(name)); err != nil {
+		l.problem(key, err.Error(), example)
+	}
+	return name
+}
+
+// checkWritableDir reports whether files can be created in dir. A missing
+// dir is judged by its nearest existing parent, where it would be created.
+func checkWritableDir(dir string) error {
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		existing = parent
+	}
+	probe, err := os.CreateTemp(existing, ".probe-*")
+	if err != nil {
+		if existing != dir {
+			return fmt.Errorf("directory %s cannot be created in %s: %v", dir, existing, err)
+		}
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multipliers := []struct {
+		suffix string
+		factor int64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	factor := int64(1)
+	for _, m := range multipliers {
+		if strings.HasSuffix(s, m.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, m.suffix))
+			factor = m.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	// !(n >= 0) also catches NaN; infinity and sizes past int64 overflow.
+	size := n * float64(factor)
+	if err != nil || !(n >= 0) || size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid byte size %q", value)
+	}
+	return int64(size), nil
+}
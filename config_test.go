@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	valid := map[string]int64{
+		"256MB":  256 << 20,
+		"1.5 KB": 1536,
+		"32k":    32 << 10,
+		"4096":   4096,
+	}
+	for value, want := range valid {
+		if got, err := parseByteSize(value); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "-1MB", "NaN", "NaNMB", "Inf", "+InfGB", "8388608TB", "9223372036854775807"} {
+		if got, err := parseByteSize(value); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", value, got)
+		}
+	}
+}
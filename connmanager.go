@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type connState int
+
+const (
+	connConnected connState = iota
+	connReconnecting
+	connDown
+)
+
+func (s connState) String() string {
+	switch s {
+	case connReconnecting:
+		return "reconnecting"
+	case connDown:
+		return "down"
+	default:
+		return "connected"
+	}
+}
+
+var errNASUnavailable = errors.New("NAS connection is being re-established")
+
+const (
+	reconnectMinBackoff = time.Second
+	// After this many failed attempts in a row the connection is reported
+	// as down rather than reconnecting. Attempts continue regardless.
+	reconnectDownAfter = 3
+)
+
+// connManager owns the SSH/SFTP connection to the NAS. When the connection
+// drops it reconnects in the background with exponential backoff; while it
+// does, client returns errNASUnavailable so handlers can fail fast.
+type connManager struct {
+	dial       func() (*ssh.Client, error)
+	options    []sftp.ClientOption
+	maxBackoff time.Duration
+
+	mu             sync.RWMutex
+	conn           *ssh.Client
+	sftpClient     *sftp.Client
+	state          connState
+	failedAttempts int
+	nextAttempt    time.Time
+	lastSuccess    time.Time
+	lastError      string
+	closed         bool
+}
+
+type connStatus struct {
+	State          string     `json:"state"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	FailedAttempts int        `json:"failed_attempts,omitempty"`
+	NextAttempt    *time.Time `json:"next_attempt,omitempty"`
+}
+
+func newConnManager(dial func() (*ssh.Client, error), options []sftp.ClientOption, maxBackoff time.Duration) *connManager {
+	return &connManager{dial: dial, options: options, maxBackoff: maxBackoff}
+}
+
+// connect establishes the initial connection.
+func (m *connManager) connect() error {
+	conn, client, err := m.open()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.install(conn, client)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *connManager) open() (*ssh.Client, *sftp.Client, error) {
+	conn, err := m.dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to NAS: %w", err)
+	}
+	client, err := newReadOnlyClient(conn, m.options...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("creating SFTP client: %w", err)
+	}
+	return conn, client, nil
+}
+
+// install must be called with m.mu held.
+func (m *connManager) install(conn *ssh.Client, client *sftp.Client) {
+	m.conn = conn
+	m.sftpClient = client
+	m.state = connConnected
+	m.failedAttempts = 0
+	m.nextAttempt = time.Time{}
+	m.lastSuccess = time.Now()
+	m.lastError = ""
+	go m.watch(client)
+}
+
+func (m *connManager) watch(client *sftp.Client) {
+	err := client.Wait()
+	m.markLost(client, err)
+}
+
+func (m *connManager) client() (*sftp.Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.state != connConnected {
+		return nil, errNASUnavailable
+	}
+	return m.sftpClient, nil
+}
+
+// retryAfter is the time until the next reconnect attempt.
+func (m *connManager) retryAfter() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.state == connConnected {
+		return 0
+	}
+	return max(time.Until(m.nextAttempt), 0)
+}
+
+// recordResult notes the outcome of an SFTP operation on the current client.
+func (m *connManager) recordResult(err error) {
+	if err == nil || !isNASFailure(err) {
+		m.mu.Lock()
+		m.lastSuccess = time.Now()
+		m.mu.Unlock()
+		return
+	}
+	// A timed-out operation means the NAS or the link to it has stalled;
+	// reconnecting is the only way to get a responsive session back.
+	if isConnectionLost(err) || errors.Is(err, errSFTPTimeout) {
+		m.mu.RLock()
+		client := m.sftpClient
+		m.mu.RUnlock()
+		m.markLost(client, err)
+	}
+}
+
+func (m *connManager) markLost(client *sftp.Client, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || client != m.sftpClient || m.state != connConnected {
+		return
+	}
+
+	fmt.Printf("Lost connection to NAS: %v\n", err)
+	m.state = connReconnecting
+	m.nextAttempt = time.Now()
+	if err != nil {
+		m.lastError = err.Error()
+	}
+	// The SSH connection goes first: closing the SFTP client waits for its
+	// receive loop, which a stalled NAS only releases once the socket is
+	// closed.
+	m.conn.Close()
+	m.sftpClient.Close()
+	go m.reconnectLoop()
+}
+
+func (m *connManager) reconnectLoop() {
+	backoff := reconnectMinBackoff
+	for {
+		m.mu.RLock()
+		wait := time.Until(m.nextAttempt)
+		m.mu.RUnlock()
+		time.Sleep(wait)
+
+		conn, client, err := m.open()
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			if err == nil {
+				client.Close()
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			m.install(conn, client)
+			m.mu.Unlock()
+			fmt.Println("Reconnected to NAS")
+			return
+		}
+
+		m.failedAttempts++
+		m.lastError = err.Error()
+		if m.failedAttempts >= reconnectDownAfter {
+			m.state = connDown
+		}
+		m.nextAttempt = time.Now().Add(backoff)
+		m.mu.Unlock()
+
+		fmt.Printf("Reconnect attempt failed: %v (next attempt in %s)\n", err, backoff)
+		backoff = min(backoff*2, m.maxBackoff)
+	}
+}
+
+func (m *connManager) status() connStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	st := connStatus{State: m.state.String(), LastError: m.lastError, FailedAttempts: m.failedAttempts}
+	if !m.lastSuccess.IsZero() {
+		lastSuccess := m.lastSuccess
+		st.LastSuccess = &lastSuccess
+	}
+	if m.state != connConnected {
+		nextAttempt := m.nextAttempt
+		st.NextAttempt = &nextAttempt
+	}
+	return st
+}
+
+func (m *connManager) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.state == connConnected {
+		m.conn.Close()
+		m.sftpClient.Close()
+	}
+}
+
+// dialSSH is ssh.Dial with the TCP connect bounded by config.Timeout and
+// the SSH handshake by handshakeTimeout. Zero timeouts wait indefinitely.
+func dialSSH(address string, config *ssh.ClientConfig, handshakeTimeout time.Duration) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		if methods, ok := rejectedAuthMethods(err); ok {
+			return nil, &nasAuthError{user: config.User, address: address, methods: methods}
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// nasAuthError is a NAS that answered but rejected the credentials, which
+// retrying will not fix.
+type nasAuthError struct {
+	user    string
+	address string
+	methods []string
+}
+
+func (e *nasAuthError) Error() string {
+	return fmt.Sprintf("the NAS at %s rejected the login for user %q (auth methods tried: %s); check SSH_USER and SSH_PASSWORD or SSH_PASSWORD_FILE",
+		e.address, e.user, strings.Join(e.methods, ", "))
+}
+
+// rejectedAuthMethods recognizes the ssh package's authentication failure,
+// which it only reports as text, and returns the methods it lists.
+func rejectedAuthMethods(err error) ([]string, bool) {
+	msg := err.Error()
+	if !strings.Contains(msg, "unable to authenticate") {
+		return nil, false
+	}
+	_, rest, ok := strings.Cut(msg, "attempted methods [")
+	if !ok {
+		return nil, true
+	}
+	list, _, _ := strings.Cut(rest, "]")
+	return strings.Fields(list), true
+}
+
+// isNASUnreachable reports whether err means the NAS could not be reached
+// at all: a refused or timed-out connection, or a name that does not
+// resolve. These are usually transient, unlike a rejected login.
+func isNASUnreachable(err error) bool {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.As(err, &dnsErr) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsExposedHeaders are the response headers beyond the CORS-safelisted
+// ones that browser scripts may read. Every header the API sets for
+// clients belongs here.
+var corsExposedHeaders = []string{
+	"X-Creation-Date", "X-Image-ID", "X-Image-Number", "X-Image-Path",
+	"X-Image-Width", "X-Image-Height", "X-Image-Count", "X-Rating",
+	"X-Quiet-Hours", "X-Content-SHA256", "X-Walk-Position",
+	"ETag", "Retry-After", "Server-Timing", "Content-Disposition", "Location",
+}
+
+const (
+	corsAllowedMethods = "GET, HEAD, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Type, If-None-Match, X-API-Key"
+)
+
+// corsPolicy answers preflights for every route and marks cross-origin
+// responses as readable (CORS_ALLOWED_ORIGINS). With the default "*" any
+// page may fetch from the API, but without credentials.
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+func (p *corsPolicy) anyOrigin() bool {
+	return slices.Contains(p.origins, "*")
+}
+
+func (p *corsPolicy) middleware() gin.HandlerFunc {
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		if !p.anyOrigin() {
+			h.Add("Vary", "Origin")
+		}
+		allowed := p.anyOrigin() || slices.Contains(p.origins, origin)
+		if allowed {
+			if p.anyOrigin() {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if p.credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			h.Set("Access-Control-Expose-Headers", exposed)
+		}
+
+		// A preflight names the method it is asking about; other OPTIONS
+		// requests, such as WebDAV discovery, go to their route.
+		if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+			c.Next()
+			return
+		}
+		if allowed {
+			h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// parseCORSOrigins parses a comma-separated list of origins, or "*".
+func parseCORSOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimRight(strings.TrimSpace(field), "/")
+		if field == "" {
+			continue
+		}
+		if field != "*" && !strings.HasPrefix(field, "http://") && !strings.HasPrefix(field, "https://") {
+			return nil, fmt.Errorf("invalid origin %q", field)
+		}
+		origins = append(origins, field)
+	}
+	return origins, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	useEmptyIndex(t)
+	nas := fixtureNAS(t)
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *testConfig
+	cfg.corsOrigins = []string{"https://gallery.example"}
+	cfg.corsCredentials = true
+	cfg.corsMaxAge = 5 * time.Minute
+	router, err := newRouter(t.Context(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, target, origin string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Origin", origin)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("creation date readable", func(t *testing.T) {
+		id := base64.RawURLEncoding.EncodeToString([]byte("/photos/2023-Italy/a.png"))
+		rec := serve(http.MethodGet, "/image/"+id, "https://gallery.example")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		h := rec.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != "https://gallery.example" {
+			t.Errorf("Access-Control-Allow-Origin = %q", got)
+		}
+		if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+			t.Errorf("Access-Control-Allow-Credentials = %q", got)
+		}
+		if h.Get("X-Creation-Date") == "" {
+			t.Error("no X-Creation-Date")
+		}
+		if exposed := strings.Split(h.Get("Access-Control-Expose-Headers"), ", "); !slices.Contains(exposed, "X-Creation-Date") {
+			t.Errorf("X-Creation-Date is not exposed: %v", exposed)
+		}
+	})
+
+	t.Run("preflight on any route", func(t *testing.T) {
+		for _, route := range []string{"/image/0", "/albums/trips/random", "/admin/cache/purge", "/no-such-route"} {
+			rec := serve(http.MethodOptions, route, "https://gallery.example",
+				"Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "authorization")
+			h := rec.Header()
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("%s: status %d, want 204", route, rec.Code)
+			}
+			if !strings.Contains(h.Get("Access-Control-Allow-Methods"), "POST") ||
+				!strings.Contains(h.Get("Access-Control-Allow-Headers"), "Authorization") {
+				t.Errorf("%s: allows methods %q and headers %q", route, h.Get("Access-Control-Allow-Methods"), h.Get("Access-Control-Allow-Headers"))
+			}
+			if got := h.Get("Access-Control-Max-Age"); got != "300" {
+				t.Errorf("%s: Access-Control-Max-Age = %q, want 300", route, got)
+			}
+		}
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		rec := serve(http.MethodGet, "/image?path=/photos/2023-Italy/a.png", "https://elsewhere.example")
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Access-Control-Allow-Origin = %q for an origin not listed", got)
+		}
+		if got := rec.Header().Get("Vary"); !strings.Contains(got, "Origin") {
+			t.Errorf("Vary = %q, want Origin", got)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"maps"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	// DISPLAY_TIMEZONE must work on hosts without a zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/pkg/sftp"
+)
+
+// Files copied onto the NAS by some tools end up with an mtime of zero or
+// in the future. Dates before minPlausibleDate or more than
+// creationDateSkew ahead of the clock are treated as bogus: the scanner
+// looks for an EXIF date instead and otherwise the date is clamped.
+var (
+	minPlausibleDate = time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+	creationDateSkew = 24 * time.Hour
+)
+
+// displayLocation is DISPLAY_TIMEZONE: the zone creation dates are
+// reported in, and the one EXIF dates without an offset are assumed to be
+// in.
+var displayLocation = time.UTC
+
+// formatDate formats t for responses.
+func formatDate(t time.Time) string {
+	return t.In(displayLocation).Format(time.RFC3339)
+}
+
+// maxHeaderRead is how much of a file is read looking for EXIF or XMP
+// metadata.
+const maxHeaderRead = 128 * 1024
+
+func plausibleDate(t time.Time) bool {
+	return !t.Before(minPlausibleDate) && !t.After(time.Now().Add(creationDateSkew))
+}
+
+func clampDate(t time.Time) time.Time {
+	if t.Before(minPlausibleDate) {
+		return minPlausibleDate
+	}
+	if now := time.Now(); t.After(now.Add(creationDateSkew)) {
+		return now.UTC()
+	}
+	return t
+}
+
+// dateFixes holds the replacement dates found by the last scan for files
+// whose mtime is bogus, keyed by path.
+type dateFixes struct {
+	mu         sync.RWMutex
+	dates      map[string]time.Time
+	suspicious int
+}
+
+var creationDates = &dateFixes{dates: map[string]time.Time{}}
+
+func (d *dateFixes) replace(dates map[string]time.Time, suspicious int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dates, d.suspicious = dates, suspicious
+}
+
+// replaceSubtree swaps in dates for the images under root.
+func (d *dateFixes) replaceSubtree(root string, dates map[string]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	next := maps.Clone(d.dates)
+	maps.DeleteFunc(next, func(p string, _ time.Time) bool { return underDirectory(p, root) })
+	maps.Copy(next, dates)
+	d.dates, d.suspicious = next, len(next)
+}
+
+func (d *dateFixes) count() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.suspicious
+}
+
+func (d *dateFixes) export() (map[string]time.Time, int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dates, d.suspicious
+}
+
+// creationDate is the date to report for the file at path with the given
+// mtime. Mtimes are plain instants and come back in UTC; replacements from
+// EXIF keep the zone they were recorded in.
+func creationDate(path string, modTime time.Time) time.Time {
+	if plausibleDate(modTime) {
+		return modTime.UTC()
+	}
+	creationDates.mu.RLock()
+	fixed, ok := creationDates.dates[path]
+	creationDates.mu.RUnlock()
+	if ok {
+		return fixed
+	}
+	return clampDate(modTime)
+}
+
+// hasEXIF reports whether files named like path can carry EXIF dates.
+func hasEXIF(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".tif" || ext == ".tiff"
+}
+
+// readHeader returns the first maxHeaderRead bytes of path. Read failures
+// yield nil, which callers treat as a file without metadata.
+func readHeader(ctx context.Context, client *sftp.Client, path string) []byte {
+	if ctx.Err() != nil {
+		return nil
+	}
+	var header []byte
+	sftpCall(func() error {
+		file, err := client.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		header, err = io.ReadAll(io.LimitReader(bufio.NewReader(file), maxHeaderRead))
+		return err
+	})
+	return header
+}
+
+// fixDate works out a replacement for a bogus mtime, preferring the EXIF
+// capture date in header.
+func fixDate(modTime time.Time, header []byte) time.Time {
+	if t, ok := exifDate(header); ok && plausibleDate(t) {
+		return t
+	}
+	return clampDate(modTime)
+}
+
+// exifDate extracts DateTimeOriginal, or failing that DateTime, from the
+// start of a JPEG or TIFF file, together with its zone offset if the
+// camera recorded one.
+func exifDate(data []byte) (time.Time, bool) {
+	tiff, order := exifTIFF(data)
+	if order == nil {
+		return time.Time{}, false
+	}
+
+	const (
+		typeASCII             = 2
+		tagDateTime           = 0x0132
+		tagExifIFD            = 0x8769
+		tagDateTimeOriginal   = 0x9003
+		tagOffsetTime         = 0x9010
+		tagOffsetTimeOriginal = 0x9011
+	)
+
+	// readIFD returns the out-of-line ASCII values in the IFD at offset,
+	// which covers every date and offset tag, and the Exif IFD pointer.
+	readIFD := func(offset uint32) (map[uint16]string, uint32) {
+		values := map[uint16]string{}
+		if int(offset)+2 > len(tiff) {
+			return values, 0
+		}
+		n := int(order.Uint16(tiff[offset:]))
+		var pointer uint32
+		for i := 0; i < n; i++ {
+			entry := int(offset) + 2 + 12*i
+			if entry+12 > len(tiff) {
+				break
+			}
+			tag := order.Uint16(tiff[entry:])
+			count := order.Uint32(tiff[entry+4:])
+			valueOffset := order.Uint32(tiff[entry+8:])
+			switch {
+			case tag == tagExifIFD:
+				pointer = valueOffset
+			case order.Uint16(tiff[entry+2:]) == typeASCII && count > 4 && uint64(valueOffset)+uint64(count) <= uint64(len(tiff)):
+				values[tag] = strings.TrimRight(string(tiff[valueOffset:valueOffset+count]), "\x00 ")
+			}
+		}
+		return values, pointer
+	}
+
+	ifd0, exifIFD := readIFD(order.Uint32(tiff[4:]))
+	value, offset := ifd0[tagDateTime], ""
+	if exifIFD != 0 {
+		exif, _ := readIFD(exifIFD)
+		if original := exif[tagDateTimeOriginal]; original != "" {
+			value, offset = original, exif[tagOffsetTimeOriginal]
+		} else {
+			offset = exif[tagOffsetTime]
+		}
+	}
+	return parseEXIFDate(value, offset)
+}
+
+// exifTIFF finds the TIFF structure holding the EXIF data at the start of
+// a JPEG or TIFF file, returning a nil order if there is none.
+func exifTIFF(data []byte) ([]byte, binary.ByteOrder) {
+	tiff := data
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8 {
+		tiff = nil
+		for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+			marker := data[pos+1]
+			size := int(binary.BigEndian.Uint16(data[pos+2:]))
+			if marker == 0xDA || size < 2 || pos+2+size > len(data) {
+				break
+			}
+			segment := data[pos+4 : pos+2+size]
+			if marker == 0xE1 && strings.HasPrefix(string(segment), "Exif\x00\x00") {
+				tiff = segment[6:]
+				break
+			}
+			pos += 2 + size
+		}
+	}
+	if len(tiff) < 8 {
+		return nil, nil
+	}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		return tiff, binary.LittleEndian
+	case "MM\x00*":
+		return tiff, binary.BigEndian
+	}
+	return nil, nil
+}
+
+// parseEXIFDate parses an EXIF "2006:01:02 15:04:05" value. With an EXIF
+// 2.31 offset such as "+09:00" the instant is exact; otherwise the value is
+// wall-clock time in displayLocation. Wall-clock times that a DST change
+// skips or repeats resolve as time.Date does.
+func parseEXIFDate(value, offset string) (time.Time, bool) {
+	const layout = "2006:01:02 15:04:05"
+	if len(value) < len(layout) {
+		return time.Time{}, false
+	}
+	value = value[:len(layout)]
+	if offset != "" {
+		if t, err := time.Parse(layout+"-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation(layout, value, displayLocation)
+	return t, err == nil
+}
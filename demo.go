@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed static/demo.html
+var demoPage []byte
+
+// serveDemoUI is a fullscreen slideshow over /getRandomImage for checking
+// a deployment from a browser.
+func serveDemoUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", demoPage)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"maps"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// maxDimensionProbes bounds how many images a single request reads headers
+// from while looking for one that passes min_width/min_height.
+const maxDimensionProbes = 10
+
+// Server-wide defaults for min_width and min_height.
+var minImageWidth, minImageHeight int
+
+type imageDimensions struct {
+	width, height int
+}
+
+// dimensionCache remembers the pixel size of images whose headers have
+// been read, keyed by imageCacheKey. Undecodable images are stored as 0x0
+// so they are not read again.
+type dimensionCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]dimensionEntry
+}
+
+type dimensionEntry struct {
+	path string
+	imageDimensions
+}
+
+var dimensions = &dimensionCache{maxEntries: 100_000, entries: map[string]dimensionEntry{}}
+
+func (d *dimensionCache) get(key string) (imageDimensions, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.entries[key]
+	return entry.imageDimensions, ok
+}
+
+func (d *dimensionCache) put(key, path string, dims imageDimensions) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.entries) >= d.maxEntries {
+		// Entries are a few dozen bytes and cheap to rebuild, so there is
+		// no need for anything smarter than starting over.
+		clear(d.entries)
+	}
+	d.entries[key] = dimensionEntry{path, dims}
+}
+
+func (d *dimensionCache) purge() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.entries)
+	clear(d.entries)
+	return n
+}
+
+// purgeMatching drops the entries for images match accepts.
+func (d *dimensionCache) purgeMatching(match func(path string) bool) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.entries)
+	maps.DeleteFunc(d.entries, func(_ string, entry dimensionEntry) bool { return match(entry.path) })
+	return n - len(d.entries)
+}
+
+// readDimensions returns the pixel size of info, decoding only as much of
+// the file as needed to find it. cached reports whether the NAS was
+// skipped.
+func readDimensions(client *sftp.Client, info ImageInfo) (dims imageDimensions, cached bool, err error) {
+	key := imageCacheKey(info)
+	if dims, ok := dimensions.get(key); ok {
+		return dims, true, nil
+	}
+
+	err = sftpCall(func() error {
+		file, err := openImage(client, info.Path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if config, _, err := image.DecodeConfig(bufio.NewReaderSize(file, 16*1024)); err == nil {
+			dims = imageDimensions{config.Width, config.Height}
+		}
+		return nil
+	})
+	if err != nil {
+		return dims, false, err
+	}
+	dimensions.put(key, info.Path, dims)
+	return dims, false, nil
+}
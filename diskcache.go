@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache stores served image bytes under dir so they survive restarts.
+// The modification time of each cache file doubles as its last access time:
+// it is bumped on every hit, which keeps LRU eviction working on filesystems
+// mounted with noatime.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*diskCacheEntry
+	size    int64
+}
+
+type diskCacheEntry struct {
+	size     int64
+	accessed time.Time
+	// path is the image the file holds. Files found at startup learn it
+	// on their first hit.
+	path string
+}
+
+const diskCacheSuffix = ".img"
+
+func openDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return nil, fmt.Errorf("cache directory is not writable: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	d := &diskCache{dir: dir, maxSize: maxSize, entries: map[string]*diskCacheEntry{}}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(name, diskCacheSuffix) {
+			// Leftovers from an interrupted write.
+			if strings.HasPrefix(name, ".tmp-") {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		key := strings.TrimSuffix(name, diskCacheSuffix)
+		d.entries[key] = &diskCacheEntry{size: info.Size(), accessed: info.ModTime()}
+		d.size += info.Size()
+	}
+
+	d.mu.Lock()
+	d.evictLocked()
+	d.mu.Unlock()
+	return d, nil
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+diskCacheSuffix)
+}
+
+func (d *diskCache) get(key, path string) ([]byte, bool) {
+	d.mu.Lock()
+	entry, ok := d.entries[key]
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		d.mu.Lock()
+		if d.entries[key] == entry {
+			delete(d.entries, key)
+			d.size -= entry.size
+		}
+		d.mu.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(d.path(key), now, now)
+	d.mu.Lock()
+	entry.accessed = now
+	entry.path = path
+	d.mu.Unlock()
+	return data, true
+}
+
+func (d *diskCache) put(key, path string, data []byte) {
+	size := int64(len(data))
+	if size > d.maxSize {
+		return
+	}
+
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		fmt.Printf("Disk cache write failed: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Printf("Disk cache write failed: %v\n", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.entries[key]; ok {
+		d.size -= old.size
+	}
+	d.entries[key] = &diskCacheEntry{size: size, accessed: time.Now(), path: path}
+	d.size += size
+	d.evictLocked()
+}
+
+// evictLocked removes the least recently accessed files until the cache
+// fits within maxSize. d.mu must be held.
+func (d *diskCache) evictLocked() {
+	if d.size <= d.maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(d.entries))
+	for key := range d.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return d.entries[keys[i]].accessed.Before(d.entries[keys[j]].accessed)
+	})
+
+	for _, key := range keys {
+		if d.size <= d.maxSize {
+			break
+		}
+		os.Remove(d.path(key))
+		d.size -= d.entries[key].size
+		delete(d.entries, key)
+	}
+}
+
+// purge deletes every cached file and reports what was removed.
+func (d *diskCache) purge() (entries int, bytes int64) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, entry := range d.entries {
+		if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Disk cache purge failed: %v\n", err)
+			continue
+		}
+		entries++
+		bytes += entry.size
+		d.size -= entry.size
+		delete(d.entries, key)
+	}
+	return entries, bytes
+}
+
+// purgeMatching deletes the files of images match accepts and reports what
+// was removed. Files whose image is not known yet are deleted too, since
+// they may hold one of them. A request already reading a file keeps the
+// bytes it opened.
+func (d *diskCache) purgeMatching(match func(path string) bool) (entries int, bytes int64) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, entry := range d.entries {
+		if entry.path != "" && !match(entry.path) {
+			continue
+		}
+		if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Disk cache purge failed: %v\n", err)
+			continue
+		}
+		entries++
+		bytes += entry.size
+		d.size -= entry.size
+		delete(d.entries, key)
+	}
+	return entries, bytes
+}
+
+// imageCacheKey identifies a particular version of an image: editing the
+// file on the NAS changes its size or mtime and therefore its key.
+func imageCacheKey(info ImageInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", info.Path, info.Size, info.CreationDate.UnixNano())))
+	return hex.EncodeToString(sum[:16])
+}
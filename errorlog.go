@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorEntry is one serving or scan failure kept for /debug/errors.
+type errorEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Path   string    `json:"path,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// errorRing keeps the most recent errors, oldest overwritten first.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []errorEntry
+	next    int
+	size    int
+}
+
+// recentErrors is nil when ERROR_LOG_SIZE=0.
+var recentErrors = newErrorRing(100)
+
+func newErrorRing(size int) *errorRing {
+	if size == 0 {
+		return nil
+	}
+	return &errorRing{size: size}
+}
+
+// nasPathKey names the NAS path a request is working on, so errors can be
+// attributed to it.
+const nasPathKey = "nasPath"
+
+func (r *errorRing) record(source, path string, err error) {
+	if r == nil {
+		return
+	}
+	entry := errorEntry{Time: time.Now().UTC(), Source: source, Path: path, Error: err.Error()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % r.size
+}
+
+// snapshot returns the kept errors, newest first.
+func (r *errorRing) snapshot() []errorEntry {
+	out := []errorEntry{}
+	if r == nil {
+		return out
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.entries {
+		out = append(out, r.entries[(r.next+len(r.entries)-1-i)%len(r.entries)])
+	}
+	return out
+}
+
+func (r *errorRing) clear() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.entries)
+	r.entries, r.next = nil, 0
+	return n
+}
+
+// recordRequestError notes a failed request, blaming the path stored under
+// nasPathKey if any.
+func recordRequestError(c *gin.Context, err error) {
+	recentErrors.record(c.Request.Method+" "+c.Request.URL.Path, c.GetString(nasPathKey), err)
+}
+
+func getErrors(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"errors": recentErrors.snapshot()})
+}
+
+func clearErrors(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"cleared": recentErrors.clear()})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http/httpguts"
+)
+
+type customHeader struct {
+	name  string
+	value string
+}
+
+// parseCustomHeaders parses "Name1:Value1;Name2:Value2". Values may contain
+// colons; only the first one separates name from value.
+func parseCustomHeaders(value string) ([]customHeader, error) {
+	var headers []customHeader
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, val, found := strings.Cut(entry, ":")
+		name, val = strings.TrimSpace(name), strings.TrimSpace(val)
+		if !found || name == "" {
+			return nil, fmt.Errorf("entry %q is not in Name:Value form", entry)
+		}
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(val) {
+			return nil, fmt.Errorf("invalid value for header %q", name)
+		}
+		headers = append(headers, customHeader{name: http.CanonicalHeaderKey(name), value: val})
+	}
+	return headers, nil
+}
+
+// customHeadersMiddleware sets the configured headers before the handler
+// runs, so handlers remain free to override them per response.
+func customHeadersMiddleware(headers []customHeader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, h := range headers {
+			c.Header(h.name, h.value)
+		}
+		c.Next()
+	}
+}
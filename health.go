@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getHealth(c *gin.Context) {
+	status := "ok"
+	breakerStatus := breaker.status()
+	connStatus := nasConn.status()
+	if breakerStatus.State != breakerClosed.String() || connStatus.State != connConnected.String() {
+		status = "degraded"
+	}
+
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":     "draining",
+			"breaker":    breakerStatus,
+			"connection": connStatus,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     status,
+		"breaker":    breakerStatus,
+		"connection": connStatus,
+	})
+}
+
+func getStats(c *gin.Context) {
+	directories := imageIndex.len()
+	addrs, _ := listenAddresses.Load().([]string)
+	generation, images := imageIndex.numbering()
+
+	c.JSON(http.StatusOK, gin.H{
+		"listen_addresses":        addrs,
+		"directories_with_images": directories,
+		"images":                  images,
+		"generation":              generation,
+		"suspicious_dates":        creationDates.count(),
+		"connection":              nasConn.status(),
+		"breaker":                 breaker.status(),
+	})
+}
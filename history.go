@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// servedHistory remembers the last size image paths served to any client so
+// selection can avoid showing the same photo twice in a short window.
+type servedHistory struct {
+	mu     sync.Mutex
+	ring   []string
+	next   int
+	counts map[string]int
+}
+
+func newServedHistory(size int) *servedHistory {
+	return &servedHistory{ring: make([]string, 0, size), counts: map[string]int{}}
+}
+
+func (h *servedHistory) contains(path string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[path] > 0
+}
+
+func (h *servedHistory) add(path string) {
+	if h == nil || cap(h.ring) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, path)
+	} else {
+		evicted := h.ring[h.next]
+		if h.counts[evicted]--; h.counts[evicted] <= 0 {
+			delete(h.counts, evicted)
+		}
+		h.ring[h.next] = path
+		h.next = (h.next + 1) % cap(h.ring)
+	}
+	h.counts[path]++
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH_HOST_KEY_MODE values.
+const (
+	hostKeyInsecure = "insecure"
+	hostKeyTOFU     = "tofu"
+)
+
+var errHostKeyChanged = errors.New("NAS host key does not match the pinned key")
+
+// hostKeyPin trusts the NAS host key seen on the first successful
+// connection and requires every later connection to present the same key.
+// The key is kept in file, in authorized_keys format; deleting the file
+// starts over.
+type hostKeyPin struct {
+	file string
+	// dryRun reports the key confirm would pin instead of writing it.
+	dryRun bool
+
+	mu sync.Mutex
+	// seen is the key presented during an unpinned handshake, written out
+	// by confirm once the connection is known to work.
+	seen ssh.PublicKey
+}
+
+// hostKeys is nil unless SSH_HOST_KEY_MODE is tofu.
+var hostKeys *hostKeyPin
+
+func (p *hostKeyPin) pinned() (ssh.PublicKey, error) {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", p.file, err)
+	}
+	return key, nil
+}
+
+// callback is the ssh.HostKeyCallback.
+func (p *hostKeyPin) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seen = nil
+	pinned, err := p.pinned()
+	if errors.Is(err, fs.ErrNotExist) {
+		p.seen = key
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading pinned host key: %w", err)
+	}
+	if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+		fmt.Printf("WARNING: the NAS at %s presented host key %s but %s is pinned in %s. "+
+			"Refusing to connect; if the NAS was reinstalled, reset the pin with DELETE /admin/host-key or by deleting the file.\n",
+			hostname, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(pinned), p.file)
+		return fmt.Errorf("%w: pinned %s, NAS presented %s", errHostKeyChanged, ssh.FingerprintSHA256(pinned), ssh.FingerprintSHA256(key))
+	}
+	return nil
+}
+
+// confirm pins the key seen during the handshake of a connection that has
+// since authenticated.
+func (p *hostKeyPin) confirm() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen == nil {
+		return nil
+	}
+	key := p.seen
+	p.seen = nil
+	if p.dryRun {
+		fmt.Printf("NAS host key %s would be pinned in %s\n", ssh.FingerprintSHA256(key), p.file)
+		return nil
+	}
+	if err := os.WriteFile(p.file, ssh.MarshalAuthorizedKey(key), 0o600); err != nil {
+		return fmt.Errorf("pinning host key: %w", err)
+	}
+	fmt.Printf("Pinned NAS host key %s in %s\n", ssh.FingerprintSHA256(key), p.file)
+	return nil
+}
+
+// reset forgets the pinned key, returning its fingerprint.
+func (p *hostKeyPin) reset() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, err := p.pinned()
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(p.file); err != nil {
+		return "", err
+	}
+	fmt.Printf("Unpinned NAS host key %s; the next connection pins a new one\n", ssh.FingerprintSHA256(key))
+	return ssh.FingerprintSHA256(key), nil
+}
+
+func getHostKey(c *gin.Context) {
+	if hostKeys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "SSH_HOST_KEY_MODE is not tofu"})
+		return
+	}
+	key, err := hostKeys.pinned()
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusOK, gin.H{"mode": hostKeyTOFU, "pinned": false})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mode": hostKeyTOFU, "pinned": true, "type": key.Type(), "fingerprint": ssh.FingerprintSHA256(key)})
+}
+
+// resetHostKey unpins the NAS host key, for after a NAS reinstall.
+func resetHostKey(c *gin.Context) {
+	if hostKeys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "SSH_HOST_KEY_MODE is not tofu"})
+		return
+	}
+	fingerprint, err := hostKeys.reset()
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No host key is pinned"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unpinned": fingerprint})
+}
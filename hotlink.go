@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// refererPattern is one ALLOWED_REFERERS origin. A host starting with
+// "*." matches any subdomain of the rest, but not the rest itself.
+type refererPattern struct {
+	scheme string
+	host   string
+}
+
+// parseRefererPatterns parses a comma-separated list of origins such as
+// "https://myphotos.example,https://*.mydomain.net".
+func parseRefererPatterns(value string) ([]refererPattern, error) {
+	var patterns []refererPattern
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		u, err := url.Parse(field)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid origin %q", field)
+		}
+		host := strings.ToLower(u.Host)
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return nil, fmt.Errorf("invalid origin %q: only a leading *. wildcard is supported", field)
+		}
+		patterns = append(patterns, refererPattern{scheme: u.Scheme, host: host})
+	}
+	return patterns, nil
+}
+
+func (p refererPattern) matches(u *url.URL) bool {
+	if u.Scheme != p.scheme {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == p.host
+}
+
+// hotlinkGuard refuses image bytes to pages on other sites
+// (ALLOWED_REFERERS). Pages served by this instance itself, such as the
+// demo UI, are always allowed.
+type hotlinkGuard struct {
+	allowed    []refererPattern
+	allowEmpty bool
+	// placeholder, when set, is served instead of a 403 so the embedding
+	// page shows a "hotlinking disabled" graphic (HOTLINK_PLACEHOLDER).
+	placeholder     []byte
+	placeholderType string
+}
+
+func (g *hotlinkGuard) permits(r *http.Request) bool {
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return g.allowEmpty
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, p := range g.allowed {
+		if p.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *hotlinkGuard) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The answer depends on the Referer, so shared caches must not
+		// hand one site's response to another.
+		c.Writer.Header().Add("Vary", "Referer")
+		if g.permits(c.Request) {
+			c.Next()
+			return
+		}
+		if g.placeholder == nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Hotlinking is not allowed"})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, g.placeholderType, g.placeholder)
+		c.Abort()
+	}
+}
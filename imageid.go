@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// imageID identifies a particular version of an image in /image/:id URLs:
+// its NAS path, base64url encoded, then a dot and a short hash of its size
+// and mtime. Editing the file changes the ID, which is what lets
+// responses for an ID be cached as immutable. The bare path part is also
+// accepted and always refers to the current version. It is sent with every
+// image as X-Image-ID.
+func imageID(info ImageInfo) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(info.Path)) + "." + imageVersion(info)
+}
+
+var errImageNumberUnknown = errors.New("no image with that number in the current generation")
+
+func imageVersion(info ImageInfo) string {
+	return imageCacheKey(info)[:8]
+}
+
+// parseImageID returns the path and, if the ID has one, the version it
+// names. A plain number is looked up in the current scan generation; base64
+// of an absolute path always starts with "L", so the two never collide.
+func parseImageID(id string) (string, string, error) {
+	if n, err := strconv.Atoi(id); err == nil {
+		p, ok := imageIndex.imageAt(n)
+		if !ok {
+			return "", "", errImageNumberUnknown
+		}
+		// The numbering may come from an imported index or a manifest.
+		if !validImagePath(p) {
+			return "", "", fmt.Errorf("invalid image id %q", id)
+		}
+		return p, "", nil
+	}
+	encoded, version, _ := strings.Cut(id, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(raw) == 0 {
+		return "", "", fmt.Errorf("invalid image id %q", id)
+	}
+	p := string(raw)
+	if !validImagePath(p) {
+		return "", "", fmt.Errorf("invalid image id %q", id)
+	}
+	return p, version, nil
+}
+
+// validImagePath reports whether an image ID may name p: an image in one
+// of the indexed directories.
+func validImagePath(p string) bool {
+	if !path.IsAbs(p) || path.Clean(p) != p || !isImageFile(p) || !underScanRoot(p) {
+		return false
+	}
+	_, indexed := slices.BinarySearch(imageIndex.snapshot(), imageDirectory(p))
+	return indexed
+}
+
+// lookupImage resolves the :id route parameter to the image's current
+// directory entry, reporting whether the ID pins that exact version. An ID
+// for an older version is answered with 410 and the current ID. On failure
+// the error response has already been written.
+func lookupImage(c *gin.Context, client *sftp.Client) (info ImageInfo, pinned bool, ok bool) {
+	p, version, err := parseImageID(c.Param("id"))
+	if errors.Is(err, errImageNumberUnknown) {
+		generation, _ := imageIndex.numbering()
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "generation": generation})
+		return ImageInfo{}, false, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ImageInfo{}, false, false
+	}
+	info, ok = lookupImagePath(c, client, p)
+	if !ok {
+		return ImageInfo{}, false, false
+	}
+	if version != "" && version != imageVersion(info) {
+		c.JSON(http.StatusGone, gin.H{"error": "Image has changed since this ID was issued", "id": imageID(info)})
+		return ImageInfo{}, false, false
+	}
+	return info, version != "", true
+}
+
+// lookupImagePath stats the image at p for the request. On failure the
+// error response has already been written.
+func lookupImagePath(c *gin.Context, client *sftp.Client, p string) (ImageInfo, bool) {
+	c.Set(nasPathKey, p)
+	if !pathAllowed(c, p) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not grant access to this image"})
+		return ImageInfo{}, false
+	}
+
+	var stat os.FileInfo
+	readStart := time.Now()
+	_, span := startSpan(c.Request.Context(), "sftp.stat", pathAttr(p))
+	err := sftpCall(func() (err error) {
+		stat, err = statImage(client, p)
+		return err
+	})
+	endSpan(span, err)
+	recordStage(c, stageSFTP, readStart)
+	if errors.Is(err, os.ErrNotExist) || err == nil && stat.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return ImageInfo{}, false
+	}
+	if err != nil {
+		respondSFTPError(c, "Failed to stat image: ", err)
+		return ImageInfo{}, false
+	}
+	return ImageInfo{Path: p, CreationDate: creationDate(p, stat.ModTime()), Size: stat.Size()}, true
+}
+
+// getImageByPath handles GET /image?path=, serving an image by its NAS
+// path with the same transforms as /image/:id, so ?format=png converts it.
+// Only images in indexed directories can be fetched.
+func getImageByPath(c *gin.Context) {
+	p := c.Query("path")
+	if !path.IsAbs(p) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path must be an absolute path"})
+		return
+	}
+	p = path.Clean(p)
+	if !validImagePath(p) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	opts, err := parseTransformOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	info, ok := lookupImagePath(c, client, p)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	serveImage(c, client, info, opts)
+}
+
+// redirectToImage answers with a 302 to the pinned /image/:id URL of info,
+// keeping the request's transform parameters. The randomness stays in the
+// redirect while the image URL it leads to can be cached as immutable.
+func redirectToImage(c *gin.Context, info ImageInfo) {
+	query := url.Values{}
+	for _, name := range transformParams {
+		if value, ok := c.GetQuery(name); ok {
+			query.Set(name, value)
+		}
+	}
+	location := "/image/" + imageID(info)
+	if len(query) > 0 {
+		location += "?" + query.Encode()
+	}
+	setImageMetadataHeaders(c, info)
+	if dims, ok := dimensions.get(imageCacheKey(info)); ok {
+		c.Header("X-Image-Width", strconv.Itoa(dims.width))
+		c.Header("X-Image-Height", strconv.Itoa(dims.height))
+	}
+	c.Redirect(http.StatusFound, location)
+}
+
+// getImage serves the image named by :id, accepting the same transform
+// parameters as /getRandomImage.
+func getImage(c *gin.Context) {
+	opts, err := parseTransformOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	info, pinned, ok := lookupImage(c, client)
+	if !ok {
+		return
+	}
+	if pinned {
+		c.Header("Cache-Control", imageCacheControl)
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	serveImage(c, client, info, opts)
+}
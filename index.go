@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directoryIndex is the set of directories known to contain images. A scan
+// builds a complete list and swaps it in whole, so entries never double up
+// across rescans and directories deleted from the NAS drop out. The slice
+// is never modified in place; snapshot callers may keep it.
+//
+// Each complete scan also numbers every image it found, in path order, for
+// /image/123 URLs. The numbers hold until the next complete scan, which
+// bumps generation.
+type directoryIndex struct {
+	mu         sync.RWMutex
+	dirs       []string
+	scannedAt  time.Time
+	images     []string
+	files      []indexedFile
+	generation int
+	// lastScan describes the last full scan, complete or not.
+	lastScan scanStats
+	// staleRemoved counts directories dropped since startup, by scans or
+	// on finding them gone.
+	staleRemoved int
+	// changed is closed when generation next changes, waking
+	// /wait-for-change. generationImages keeps the image count of recent
+	// generations for the delta it reports.
+	changed          chan struct{}
+	generationImages map[int]int
+}
+
+// changeHistory is how many generations' image counts are kept.
+const changeHistory = 64
+
+// scanStats are the /metrics figures of a full scan.
+type scanStats struct {
+	duration time.Duration
+	// failed counts the directories that could not be read.
+	failed int
+}
+
+var imageIndex = &directoryIndex{}
+
+// indexedFile is an image as the scan listed it.
+type indexedFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func (x *directoryIndex) snapshot() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.dirs
+}
+
+func (x *directoryIndex) len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.dirs)
+}
+
+// replace installs the directories a full scan found. A scan that did not
+// complete only adds to the index: directories it never reached are kept
+// rather than treated as deleted. A complete one also renumbers the
+// images. Everything changes under one lock, so /metrics never sees a
+// half-swapped index.
+func (x *directoryIndex) replace(dirs []string, files []indexedFile, complete bool, stats scanStats) (added, removed int) {
+	next := normalizeDirectories(dirs)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !complete {
+		next = normalizeDirectories(append(next, x.dirs...))
+	}
+	for _, dir := range next {
+		if _, found := slices.BinarySearch(x.dirs, dir); !found {
+			added++
+		}
+	}
+	removed = len(x.dirs) + added - len(next)
+	x.dirs = next
+	x.staleRemoved += removed
+	x.lastScan = stats
+	if complete {
+		x.scannedAt = time.Now()
+		x.files = sortedFiles(files)
+		x.images = filePaths(x.files)
+		x.generation++
+		x.notifyChanged()
+	}
+	return added, removed
+}
+
+// replaceSubtree installs dirs as the part of the index under root,
+// leaving the rest alone. Like replace, an incomplete scan only adds.
+func (x *directoryIndex) replaceSubtree(root string, dirs []string, complete bool) (added, removed int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	next := slices.Clone(dirs)
+	for _, dir := range x.dirs {
+		if !complete || !underDirectory(dir, root) {
+			next = append(next, dir)
+		}
+	}
+	next = normalizeDirectories(next)
+	for _, dir := range next {
+		if _, found := slices.BinarySearch(x.dirs, dir); !found {
+			added++
+		}
+	}
+	removed = len(x.dirs) + added - len(next)
+	x.dirs = next
+	x.staleRemoved += removed
+	return added, removed
+}
+
+// imageAt returns the path of image number n.
+func (x *directoryIndex) imageAt(n int) (string, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if n < 0 || n >= len(x.images) {
+		return "", false
+	}
+	return x.images[n], true
+}
+
+// imageNumber is the inverse of imageAt.
+func (x *directoryIndex) imageNumber(p string) (int, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return slices.BinarySearch(x.images, p)
+}
+
+// numbering reports the current generation and how many images it numbers.
+func (x *directoryIndex) numbering() (generation, images int) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.generation, len(x.images)
+}
+
+// remove drops dir from the index, for when serving finds it has gone
+// from the NAS since the last scan.
+func (x *directoryIndex) remove(dir string) bool {
+	dir = path.Clean(dir)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i, found := slices.BinarySearch(x.dirs, dir)
+	if !found {
+		return false
+	}
+	x.dirs = slices.Delete(slices.Clone(x.dirs), i, i+1)
+	x.staleRemoved++
+	return true
+}
+
+// writeIndexMetrics appends the index gauges in the Prometheus text
+// format. The age is left out until a scan has completed.
+func writeIndexMetrics(b *strings.Builder) {
+	x := imageIndex
+	x.mu.RLock()
+	dirs, images, scannedAt, last, removed := len(x.dirs), len(x.images), x.scannedAt, x.lastScan, x.staleRemoved
+	x.mu.RUnlock()
+
+	gauge := func(name, help string, value any) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	gauge("index_directories", "Directories with images in the index.", dirs)
+	gauge("index_images", "Images numbered by the last complete scan.", images)
+	if !scannedAt.IsZero() {
+		gauge("index_age_seconds", "Seconds since the last complete scan.", int64(time.Since(scannedAt).Seconds()))
+	}
+	gauge("index_last_scan_duration_seconds", "Duration of the last full scan.", last.duration.Seconds())
+	gauge("index_last_scan_errors", "Directories the last full scan could not read.", last.failed)
+	fmt.Fprintf(b, "# HELP index_stale_removed_total Directories dropped from the index as gone from the NAS.\n# TYPE index_stale_removed_total counter\nindex_stale_removed_total %d\n", removed)
+}
+
+// sortedFiles returns a copy of files in path order.
+func sortedFiles(files []indexedFile) []indexedFile {
+	return slices.SortedFunc(slices.Values(files), func(a, b indexedFile) int { return strings.Compare(a.Path, b.Path) })
+}
+
+func filePaths(files []indexedFile) []string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+// normalizeDirectories returns dirs cleaned, sorted and without duplicates.
+func normalizeDirectories(dirs []string) []string {
+	out := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		out = append(out, path.Clean(dir))
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// indexFileVersion is bumped whenever indexFile changes incompatibly.
+const indexFileVersion = 1
+
+// indexFile is the on-disk form of the directory index.
+// Verification results and file hashes ride along so each file is only
+// checked and hashed once.
+type indexFile struct {
+	Version     int               `json:"version"`
+	ScannedAt   time.Time         `json:"scanned_at"`
+	Directories []string          `json:"directories"`
+	Verified    []string          `json:"verified,omitempty"`
+	Quarantine  []quarantineEntry `json:"quarantine,omitempty"`
+	Checksums   map[string]string `json:"checksums,omitempty"`
+	// CreationDates replaces bogus file mtimes, keyed by path.
+	CreationDates   map[string]time.Time `json:"creation_dates,omitempty"`
+	SuspiciousDates int                  `json:"suspicious_dates,omitempty"`
+	// Tags holds sidecar tags, keyed by path.
+	Tags map[string][]string `json:"tags,omitempty"`
+	// Ratings holds XMP star ratings, keyed by path.
+	Ratings map[string]int `json:"ratings,omitempty"`
+	// Timeline counts images per month taken, keyed by directory.
+	Timeline map[string]map[string]int `json:"timeline,omitempty"`
+	// Images and Generation keep /image/123 numbers stable across
+	// restarts.
+	Images     []string `json:"images,omitempty"`
+	Generation int      `json:"generation,omitempty"`
+	// Files gives the size and mtime of each image, where known.
+	Files []indexedFile `json:"files,omitempty"`
+}
+
+func (x *directoryIndex) export() indexFile {
+	verified, quarantined := verification.export()
+	dates, suspicious := creationDates.export()
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return indexFile{
+		Version:     indexFileVersion,
+		ScannedAt:   x.scannedAt,
+		Directories: x.dirs,
+		Verified:    verified,
+		Quarantine:  quarantined,
+		Checksums:   checksums.export(),
+
+		CreationDates:   dates,
+		SuspiciousDates: suspicious,
+		Tags:            imageTags.export(),
+		Ratings:         imageRatings.export(),
+		Timeline:        imageTimeline.export(),
+		Images:          x.images,
+		Generation:      x.generation,
+		Files:           x.files,
+	}
+}
+
+// restore installs a previously exported index.
+func (x *directoryIndex) restore(f indexFile) {
+	dirs := normalizeDirectories(f.Directories)
+	verification.restore(f.Verified, f.Quarantine)
+	checksums.restore(f.Checksums)
+	if f.CreationDates == nil {
+		f.CreationDates = map[string]time.Time{}
+	}
+	creationDates.replace(f.CreationDates, f.SuspiciousDates)
+	if f.Tags == nil {
+		f.Tags = map[string][]string{}
+	}
+	imageTags.replace(f.Tags)
+	if f.Ratings == nil {
+		f.Ratings = map[string]int{}
+	}
+	imageRatings.replace(f.Ratings)
+	if f.Timeline == nil {
+		f.Timeline = map[string]map[string]int{}
+	}
+	imageTimeline.replace(f.Timeline)
+	images := slices.Clone(f.Images)
+	slices.Sort(images)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.dirs = dirs
+	x.scannedAt = f.ScannedAt
+	// Before any number has been handed out the saved generation stands.
+	// A different numbering replacing one already served moves past both
+	// generations, so a number never names two images in one generation.
+	switch {
+	case x.generation == 0:
+		x.generation = f.Generation
+	case !slices.Equal(images, x.images):
+		x.generation = max(x.generation, f.Generation) + 1
+	}
+	x.images = images
+	x.files = sortedFiles(f.Files)
+	x.notifyChanged()
+}
+
+// notifyChanged records the image count of the current generation and
+// wakes everyone waiting for it to change. x.mu must be held.
+func (x *directoryIndex) notifyChanged() {
+	if x.generationImages == nil {
+		x.generationImages = map[int]int{}
+	}
+	x.generationImages[x.generation] = len(x.images)
+	delete(x.generationImages, x.generation-changeHistory)
+	if x.changed != nil {
+		close(x.changed)
+		x.changed = nil
+	}
+}
+
+// watch returns the current generation, its image count and a channel
+// closed when the generation changes.
+func (x *directoryIndex) watch() (generation, images int, changed <-chan struct{}) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.changed == nil {
+		x.changed = make(chan struct{})
+	}
+	return x.generation, len(x.images), x.changed
+}
+
+// imageCount returns the number of images generation numbered, if it is
+// recent enough to be remembered. Generation 0, before any scan, had none.
+func (x *directoryIndex) imageCount(generation int) (int, bool) {
+	if generation == 0 {
+		return 0, true
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	n, ok := x.generationImages[generation]
+	return n, ok
+}
+
+func readIndexFile(name string) (indexFile, error) {
+	var f indexFile
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	if f.Version != indexFileVersion {
+		return f, fmt.Errorf("%s has version %d, want %d", name, f.Version, indexFileVersion)
+	}
+	return f, nil
+}
+
+func writeIndexFile(name string, f indexFile) error {
+	return writeJSONFile(name, f)
+}
+
+// writeJSONFile replaces name atomically so a crash mid-write never leaves
+// a truncated file behind.
+func writeJSONFile(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useEmptyIndex gives the test a fresh imageIndex.
+func useEmptyIndex(t *testing.T) {
+	t.Helper()
+	old := imageIndex
+	imageIndex = &directoryIndex{}
+	t.Cleanup(func() { imageIndex = old })
+}
+
+// fixtureNAS holds three directories with images and one without.
+func fixtureNAS(t *testing.T) *testNAS {
+	t.Helper()
+	nas := newTestNAS(t, 0)
+	for _, p := range []string{
+		"/photos/2023-Italy/a.png",
+		"/photos/2023-Italy/b.jpg",
+		"/photos/2024-Japan/c.gif",
+		"/photos/2024-Japan/tokyo/d.png",
+		"/misc/readme.txt",
+	} {
+		nas.put(t, p, []byte("not really an image"))
+	}
+	return nas
+}
+
+func TestRescanKeepsIndexStable(t *testing.T) {
+	useEmptyIndex(t)
+	nas := fixtureNAS(t)
+	want := []string{"/photos/2023-Italy", "/photos/2024-Japan", "/photos/2024-Japan/tokyo"}
+
+	for scan := 1; scan <= 2; scan++ {
+		if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+			t.Fatalf("scan %d: %v", scan, err)
+		}
+		if got := imageIndex.snapshot(); !slices.Equal(got, want) {
+			t.Fatalf("after scan %d the index is %q, want %q", scan, got, want)
+		}
+		if _, images := imageIndex.numbering(); images != 4 {
+			t.Fatalf("after scan %d the index numbers %d images, want 4", scan, images)
+		}
+	}
+
+	// A directory emptied on the NAS leaves the index on the next scan.
+	if err := nas.admin.Remove("/photos/2024-Japan/tokyo/d.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := imageIndex.snapshot(); !slices.Equal(got, want[:2]) {
+		t.Errorf("after removing tokyo the index is %q, want %q", got, want[:2])
+	}
+}
+
+func TestExportedIndexPassesImportChecks(t *testing.T) {
+	useEmptyIndex(t)
+	nas := fixtureNAS(t)
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	f := imageIndex.export()
+	if len(f.Files) != 4 || f.Files[0].Size != int64(len("not really an image")) {
+		t.Fatalf("exported files = %+v, want the 4 images with their sizes", f.Files)
+	}
+	if problems := indexFileProblems(f); len(problems) > 0 {
+		t.Fatalf("exported index has problems: %+v", problems)
+	}
+
+	f.Images = append(f.Images, "/misc/readme.jpg", "/photos/../etc/x.jpg")
+	f.Tags = map[string][]string{"/elsewhere/a.png": {"x"}}
+	f.Timeline = map[string]map[string]int{"/misc": {"2024-01": 1}}
+	var got []string
+	for _, p := range indexFileProblems(f) {
+		got = append(got, fmt.Sprint(p.Field, " ", p.Entry, ": ", p.Error))
+	}
+	want := []string{
+		"images 4: image is not in any of the directories",
+		"images 5: path is not clean; use /etc/x.jpg",
+		"tags /elsewhere/a.png: image is not in any of the directories",
+		"timeline /misc: not one of the directories",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("problems =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRestoreNeverReusesGeneration(t *testing.T) {
+	useEmptyIndex(t)
+	saved := indexFile{
+		Directories: []string{"/photos/a"},
+		Images:      []string{"/photos/a/1.jpg", "/photos/a/2.jpg"},
+		Generation:  3,
+	}
+	steps := []struct {
+		name       string
+		images     []string
+		generation int
+	}{
+		{"loading the index cache at startup", saved.Images, 3},
+		{"importing the same numbering", saved.Images, 3},
+		{"importing another numbering", []string{"/photos/a/2.jpg"}, 4},
+	}
+	for _, step := range steps {
+		saved.Images = step.images
+		imageIndex.restore(saved)
+		if generation, _ := imageIndex.numbering(); generation != step.generation {
+			t.Errorf("%s: generation %d, want %d", step.name, generation, step.generation)
+		}
+	}
+	if p, _ := imageIndex.imageAt(0); p != "/photos/a/2.jpg" {
+		t.Errorf("image 0 is %s after the import, want /photos/a/2.jpg", p)
+	}
+}
+
+func TestMetricsAfterScan(t *testing.T) {
+	useEmptyIndex(t)
+	nas := fixtureNAS(t)
+	router, err := newRouter(t.Context(), testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape := func() map[string]string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/metrics: status %d", rec.Code)
+		}
+		values := map[string]string{}
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if name, value, ok := strings.Cut(line, " "); ok && strings.HasPrefix(name, "index_") {
+				values[name] = value
+			}
+		}
+		return values
+	}
+
+	if _, ok := scrape()["index_age_seconds"]; ok {
+		t.Error("index_age_seconds reported before any scan")
+	}
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := nas.admin.Remove("/photos/2024-Japan/tokyo/d.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	got := scrape()
+	for name, want := range map[string]string{
+		"index_directories":         "2",
+		"index_images":              "3",
+		"index_last_scan_errors":    "0",
+		"index_stale_removed_total": "1",
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %q, want %s", name, got[name], want)
+		}
+	}
+	if age, err := strconv.Atoi(got["index_age_seconds"]); err != nil || age > 60 {
+		t.Errorf("index_age_seconds = %q just after a scan", got["index_age_seconds"])
+	}
+	if _, ok := got["index_last_scan_duration_seconds"]; !ok {
+		t.Error("no index_last_scan_duration_seconds")
+	}
+}
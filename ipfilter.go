@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type prefixSet []netip.Prefix
+
+// defaultTrustedProxies is what gin trusts for ClientIP when TRUSTED_PROXIES
+// is unset: loopback and private ranges, where a reverse proxy for a home
+// NAS normally lives. The IP filter does not fall back to it; access control
+// only believes X-Forwarded-For from explicitly configured proxies.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// parsePrefixSet parses a comma-separated list of CIDRs or bare addresses.
+// IPv4-mapped IPv6 prefixes are stored as plain IPv4 so that they match
+// however the peer address happens to be represented.
+func parsePrefixSet(value string) (prefixSet, error) {
+	var set prefixSet
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		var prefix netip.Prefix
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+			}
+			prefix = p
+		} else {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", field, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		set = append(set, prefix.Masked())
+	}
+	return set, nil
+}
+
+func (s prefixSet) strings() []string {
+	out := make([]string, len(s))
+	for i, prefix := range s {
+		out[i] = prefix.String()
+	}
+	return out
+}
+
+func (s prefixSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type ipFilter struct {
+	allow          prefixSet
+	deny           prefixSet
+	trustedProxies prefixSet
+}
+
+// clientAddr returns the address the request originates from. The
+// X-Forwarded-For chain is only consulted when the direct peer is a trusted
+// proxy or a unix socket client, and is walked from the right so a client can't spoof its way past
+// the proxies we trust.
+func (f *ipFilter) clientAddr(r *http.Request) (netip.Addr, bool) {
+	var addr netip.Addr
+	if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		addr = peer.Addr().Unmap()
+		if !f.trustedProxies.contains(addr) {
+			return addr, true
+		}
+	} else if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		// Unix socket peers are local processes, typically a reverse
+		// proxy on the same host, so their forwarding headers are trusted.
+		addr = netip.IPv6Loopback()
+	} else {
+		return netip.Addr{}, false
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !f.trustedProxies.contains(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+func (f *ipFilter) allowed(addr netip.Addr) bool {
+	if f.deny.contains(addr) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.contains(addr)
+}
+
+func (f *ipFilter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, ok := f.clientAddr(c.Request)
+		if !ok || !f.allowed(addr) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		c.Next()
+	}
+}
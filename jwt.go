@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const jwtPrefixesKey = "jwtPrefixes"
+
+// tokenClaims are the claims we care about. A token without a prefixes claim
+// may access every indexed directory.
+type tokenClaims struct {
+	Prefixes []string `json:"prefixes"`
+	jwt.RegisteredClaims
+}
+
+type jwtValidator struct {
+	hmacSecret []byte
+	jwks       *jwksCache
+	parser     *jwt.Parser
+}
+
+func newJWTValidator(hmacSecret, jwksURL string, clockSkew, jwksRefresh time.Duration) *jwtValidator {
+	var methods []string
+	v := &jwtValidator{}
+	if hmacSecret != "" {
+		v.hmacSecret = []byte(hmacSecret)
+		methods = append(methods, "HS256")
+	}
+	if jwksURL != "" {
+		v.jwks = newJWKSCache(jwksURL, jwksRefresh)
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+	v.parser = jwt.NewParser(
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithExpirationRequired(),
+	)
+	return v
+}
+
+func (v *jwtValidator) keyFunc(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return v.hmacSecret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.jwks.key(kid)
+}
+
+func (v *jwtValidator) validate(tokenString string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+	for i, prefix := range claims.Prefixes {
+		claims.Prefixes[i] = path.Clean("/" + prefix)
+	}
+	return claims, nil
+}
+
+func (v *jwtValidator) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions || c.GetBool(sharedLinkKey) {
+			c.Next()
+			return
+		}
+
+		header := c.GetHeader("Authorization")
+		tokenString, found := strings.CutPrefix(header, "Bearer ")
+		if !found || tokenString == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="nas-sftp-api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		claims, err := v.validate(tokenString)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="nas-sftp-api", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+			return
+		}
+
+		if claims.Prefixes != nil {
+			c.Set(jwtPrefixesKey, claims.Prefixes)
+		}
+		c.Next()
+	}
+}
+
+// pathAllowed reports whether the token on the request grants access to p.
+// Requests without a scoped token are unrestricted.
+func pathAllowed(c *gin.Context, p string) bool {
+	value, ok := c.Get(jwtPrefixesKey)
+	if !ok {
+		return true
+	}
+	p = path.Clean("/" + p)
+	for _, prefix := range value.([]string) {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedDirectories narrows dirs to the ones the request may access. The
+// input slice is returned as is when the request is unrestricted.
+func allowedDirectories(c *gin.Context, dirs []string) []string {
+	if _, ok := c.Get(jwtPrefixesKey); !ok {
+		return dirs
+	}
+	var allowed []string
+	for _, dir := range dirs {
+		if pathAllowed(c, dir) {
+			allowed = append(allowed, dir)
+		}
+	}
+	return allowed
+}
+
+// jwksCache keeps the signing keys published at a JWKS URL. Keys are
+// refreshed periodically and, rate limited, whenever a token names a key id
+// we haven't seen yet (the usual symptom of key rotation).
+type jwksCache struct {
+	url             string
+	refreshInterval time.Duration
+	httpClient      *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]any
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+const jwksMinRefreshInterval = 30 * time.Second
+
+func newJWKSCache(url string, refreshInterval time.Duration) *jwksCache {
+	return &jwksCache{
+		url:             url,
+		refreshInterval: refreshInterval,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+		keys:            map[string]any{},
+	}
+}
+
+func (j *jwksCache) key(kid string) (any, error) {
+	j.mu.RLock()
+	key, ok := j.lookup(kid)
+	stale := time.Since(j.fetchedAt) > j.refreshInterval
+	canRetry := time.Since(j.lastAttempt) > jwksMinRefreshInterval
+	j.mu.RUnlock()
+
+	if (ok && !stale) || !canRetry {
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if err := j.refresh(); err != nil {
+		fmt.Printf("Warning: failed to refresh JWKS from %s: %v\n", j.url, err)
+		if ok {
+			return key, nil
+		}
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup must be called with j.mu held. An empty kid matches only when the
+// set contains exactly one key.
+func (j *jwksCache) lookup(kid string) (any, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *jwksCache) refresh() error {
+	j.mu.Lock()
+	j.lastAttempt = time.Now()
+	j.mu.Unlock()
+
+	resp, err := j.httpClient.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding key set: %w", err)
+	}
+
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			fmt.Printf("Warning: skipping JWKS key %q: %v\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("key set contains no usable signing keys")
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.fetchedAt = time.Now()
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *jwksCache) run(ctx context.Context) {
+	if err := j.refresh(); err != nil {
+		fmt.Printf("Warning: failed to fetch JWKS from %s: %v\n", j.url, err)
+	}
+	ticker := time.NewTicker(j.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := j.refresh(); err != nil {
+			fmt.Printf("Warning: failed to refresh JWKS from %s: %v\n", j.url, err)
+		}
+	}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inflightLimiter caps concurrent work and turns away the excess at once
+// instead of queueing it, so a slow NAS shows up as 429s rather than as an
+// ever-growing pile of goroutines. A nil limiter admits everything.
+type inflightLimiter struct {
+	name     string
+	limit    int64
+	current  atomic.Int64
+	rejected atomic.Int64
+}
+
+func newInflightLimiter(name string, limit int) *inflightLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &inflightLimiter{name: name, limit: int64(limit)}
+}
+
+// requestLimiter bounds API requests as a whole (MAX_INFLIGHT_REQUESTS)
+// and transformLimiter the decode/resize/encode work within them
+// (MAX_INFLIGHT_TRANSFORMS). Health, stats, metrics and admin routes are
+// never limited.
+var (
+	requestLimiter   = newInflightLimiter("requests", 64)
+	transformLimiter = newInflightLimiter("transforms", 8)
+)
+
+func (l *inflightLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if l.current.Add(1) > l.limit {
+		l.current.Add(-1)
+		l.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (l *inflightLimiter) release() {
+	if l != nil {
+		l.current.Add(-1)
+	}
+}
+
+// park hands back the slot of a request that is about to wait without
+// doing any work. The returned func takes it back, even over the limit, so
+// the middleware's release stays balanced.
+func (l *inflightLimiter) park() (unpark func()) {
+	if l == nil {
+		return func() {}
+	}
+	l.current.Add(-1)
+	return func() { l.current.Add(1) }
+}
+
+func (l *inflightLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.acquire() {
+			respondOverloaded(c)
+			return
+		}
+		defer l.release()
+		c.Next()
+	}
+}
+
+func respondOverloaded(c *gin.Context) {
+	c.Header("Retry-After", "1")
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Server is busy, try again shortly"})
+}
+
+// writeLimiterMetrics appends the limiters' gauges and counters in the
+// Prometheus text format.
+func writeLimiterMetrics(b *strings.Builder) {
+	limiters := []*inflightLimiter{requestLimiter, transformLimiter}
+	b.WriteString("# HELP inflight_current Work currently admitted by each limiter.\n# TYPE inflight_current gauge\n")
+	for _, l := range limiters {
+		if l != nil {
+			fmt.Fprintf(b, "inflight_current{limiter=%q} %d\n", l.name, l.current.Load())
+		}
+	}
+	b.WriteString("# HELP inflight_limit Configured bound of each limiter.\n# TYPE inflight_limit gauge\n")
+	for _, l := range limiters {
+		if l != nil {
+			fmt.Fprintf(b, "inflight_limit{limiter=%q} %d\n", l.name, l.limit)
+		}
+	}
+	b.WriteString("# HELP inflight_rejected_total Requests turned away with 429 by each limiter.\n# TYPE inflight_rejected_total counter\n")
+	for _, l := range limiters {
+		if l != nil {
+			fmt.Fprintf(b, "inflight_rejected_total{limiter=%q} %d\n", l.name, l.rejected.Load())
+		}
+	}
+}
+
+// clientIdleExpiry is how long a client's counters outlive its last
+// request.
+const clientIdleExpiry = 5 * time.Minute
+
+// clientLimiter caps concurrent image downloads per client address
+// (MAX_CONCURRENT_PER_IP), so one client opening many parallel downloads
+// can't take every slot of requestLimiter. Addresses are resolved like the
+// IP filter's, believing X-Forwarded-For only from TRUSTED_PROXIES.
+type clientLimiter struct {
+	limit    int
+	resolver *ipFilter
+	mu       sync.Mutex
+	clients  map[netip.Addr]*clientState
+	swept    time.Time
+}
+
+// clientState is one address's share of clientLimiter.
+type clientState struct {
+	current  int
+	total    uint64
+	rejected uint64
+	lastSeen time.Time
+}
+
+func newClientLimiter(limit int, trustedProxies prefixSet) *clientLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &clientLimiter{limit: limit, resolver: &ipFilter{trustedProxies: trustedProxies}, clients: map[netip.Addr]*clientState{}}
+}
+
+func (l *clientLimiter) acquire(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > clientIdleExpiry {
+		for a, s := range l.clients {
+			if s.current == 0 && now.Sub(s.lastSeen) > clientIdleExpiry {
+				delete(l.clients, a)
+			}
+		}
+		l.swept = now
+	}
+	s, ok := l.clients[addr]
+	if !ok {
+		s = &clientState{}
+		l.clients[addr] = s
+	}
+	s.lastSeen = now
+	if s.current >= l.limit {
+		s.rejected++
+		return false
+	}
+	s.current++
+	s.total++
+	return true
+}
+
+func (l *clientLimiter) release(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.clients[addr]; ok {
+		s.current--
+	}
+}
+
+func (l *clientLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, ok := l.resolver.clientAddr(c.Request)
+		if !ok {
+			c.Next()
+			return
+		}
+		if !l.acquire(addr) {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("At most %d concurrent downloads per client", l.limit)})
+			return
+		}
+		defer l.release(addr)
+		c.Next()
+	}
+}
+
+// topClients lists up to n clients, busiest first.
+func (l *clientLimiter) topClients(n int) []gin.H {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addrs := slices.Collect(maps.Keys(l.clients))
+	slices.SortFunc(addrs, func(a, b netip.Addr) int {
+		sa, sb := l.clients[a], l.clients[b]
+		return cmp.Or(cmp.Compare(sb.current, sa.current), cmp.Compare(sb.total, sa.total), a.Compare(b))
+	})
+	top := []gin.H{}
+	for _, addr := range addrs[:min(n, len(addrs))] {
+		s := l.clients[addr]
+		top = append(top, gin.H{"addr": addr.String(), "current": s.current, "total": s.total, "rejected": s.rejected, "last_seen": s.lastSeen})
+	}
+	return top
+}
+
+// getTopClients handles GET /admin/clients.
+func getTopClients(l *clientLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, err := parseMinDimension(c, "limit", 20)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if l == nil {
+			c.JSON(http.StatusOK, gin.H{"limit_per_ip": 0, "clients": []gin.H{}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"limit_per_ip": l.limit, "clients": l.topClients(n)})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// imageSorts orders a directory listing by ?sort=. Ties fall back to the
+// path so the order is stable across requests.
+var imageSorts = map[string]func(a, b ImageInfo) int{
+	"name": func(a, b ImageInfo) int { return strings.Compare(a.Path, b.Path) },
+	"date": func(a, b ImageInfo) int { return a.CreationDate.Compare(b.CreationDate) },
+	"size": func(a, b ImageInfo) int { return cmp.Compare(a.Size, b.Size) },
+}
+
+// listImages handles GET /images?dir=, listing the images of one indexed
+// directory ordered by ?sort=name|date|size and ?order=asc|desc.
+func listImages(c *gin.Context) {
+	sortBy := c.DefaultQuery("sort", "name")
+	compare, ok := imageSorts[sortBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be name, date or size"})
+		return
+	}
+	order := c.DefaultQuery("order", "asc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+	dir := c.Query("dir")
+	if !path.IsAbs(dir) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dir must be an absolute path"})
+		return
+	}
+	dir = path.Clean(dir)
+	c.Set(nasPathKey, dir)
+	if !pathAllowed(c, dir) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not grant access to this directory"})
+		return
+	}
+	if _, found := slices.BinarySearch(imageIndex.snapshot(), dir); !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No indexed directory " + dir})
+		return
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+
+	entries, err := readDirContext(c.Request.Context(), client, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		imageIndex.remove(dir)
+		c.JSON(http.StatusNotFound, gin.H{"error": "No indexed directory " + dir})
+		return
+	}
+	if err != nil {
+		respondSFTPError(c, "Failed to read directory: ", err)
+		return
+	}
+	var infos []ImageInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !isImageFile(entry.Name()) {
+			continue
+		}
+		p := joinImagePath(dir, entry.Name())
+		infos = append(infos, ImageInfo{Path: p, CreationDate: creationDate(p, entry.ModTime()), Size: entry.Size()})
+	}
+	slices.SortFunc(infos, func(a, b ImageInfo) int {
+		n := cmp.Or(compare(a, b), strings.Compare(a.Path, b.Path))
+		if order == "desc" {
+			return -n
+		}
+		return n
+	})
+
+	images := make([]gin.H, len(infos))
+	for i, info := range infos {
+		images[i] = imageMetadata(info)
+	}
+	c.JSON(http.StatusOK, gin.H{"dir": dir, "sort": sortBy, "order": order, "images": images})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var logger = newLogger("text", slog.LevelInfo)
+
+// levelSummary is the level of scan summaries. They read as INFO but are
+// still logged at LOG_LEVEL=warn (--quiet), which promises them.
+const levelSummary = slog.LevelWarn + 1
+
+// logSummary logs a scan summary at levelSummary.
+func logSummary(msg string, args ...any) {
+	logger.Log(context.Background(), levelSummary, msg, args...)
+}
+
+func newLogger(format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelSummary {
+				a.Value = slog.StringValue(slog.LevelInfo.String())
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
+}
+
+const (
+	stageSFTP = iota
+	stageEncode
+	stageWrite
+
+	// Phases break the SFTP work of an image request down further and
+	// overlap the stages above: selection includes its ReadDir calls,
+	// transfer is the read of the file after opening it.
+	phaseSelect
+	phaseReadDir
+	phaseOpen
+	phaseFirstByte
+	phaseTransfer
+	numStages
+)
+
+var phaseNames = map[int]string{
+	phaseSelect:    "select",
+	phaseReadDir:   "readdir",
+	phaseOpen:      "open",
+	phaseFirstByte: "first_byte",
+	phaseTransfer:  "transfer",
+}
+
+// stageTimings accumulates where a request spent its time. It lives in the
+// request context so any handler or helper can add to it.
+type stageTimings [numStages]time.Duration
+
+type stageTimingsKey struct{}
+
+// recordStage adds the time since start to stage and any phases.
+func recordStage(c *gin.Context, stage int, start time.Time, phases ...int) {
+	recordTiming(c.Request.Context(), start, append(phases, stage)...)
+}
+
+// recordTiming is recordStage for code that only has the request context.
+func recordTiming(ctx context.Context, start time.Time, stages ...int) {
+	elapsed := time.Since(start)
+	if timings, ok := ctx.Value(stageTimingsKey{}).(*stageTimings); ok {
+		for _, stage := range stages {
+			timings[stage] += elapsed
+		}
+	}
+}
+
+// accessLog replaces gin's logger with one structured line per request,
+// including the per-stage breakdown recorded by the handlers.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		timings := &stageTimings{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), stageTimingsKey{}, timings))
+
+		c.Next()
+
+		total := time.Since(start)
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.observe(total, methodLabel(c.Request.Method), route, strconv.Itoa(c.Writer.Status()))
+		var phases []slog.Attr
+		for phase := phaseSelect; phase < numStages; phase++ {
+			if timings[phase] > 0 {
+				phaseDuration.observe(timings[phase], phaseNames[phase])
+				phases = append(phases, slog.Float64(phaseNames[phase]+"_ms", milliseconds(timings[phase])))
+			}
+		}
+		if len(phases) > 0 {
+			logger.LogAttrs(c.Request.Context(), slog.LevelDebug, "timing",
+				append([]slog.Attr{slog.String("path", c.Request.URL.Path)}, phases...)...)
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("query", c.Request.URL.RawQuery),
+			slog.Int("status", c.Writer.Status()),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Float64("duration_ms", milliseconds(total)),
+		}
+		if timings[stageSFTP] > 0 {
+			attrs = append(attrs, slog.Float64("sftp_ms", milliseconds(timings[stageSFTP])))
+		}
+		if timings[stageEncode] > 0 {
+			attrs = append(attrs, slog.Float64("encode_ms", milliseconds(timings[stageEncode])))
+		}
+		if timings[stageWrite] > 0 {
+			attrs = append(attrs, slog.Float64("write_ms", milliseconds(timings[stageWrite])))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		logger.LogAttrs(c.Request.Context(), slog.LevelInfo, "request", attrs...)
+	}
+}
+
+// serverTiming adds a Server-Timing header with the stages and phases
+// recorded so far to ?debug_timing=true requests from admins, for browser
+// dev tools. Anything after the response headers, such as a streamed
+// transfer, happens too late to be included.
+func serverTiming(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("debug_timing") == "true" && validAdminKey(c, keys) {
+			c.Writer = &serverTimingWriter{ResponseWriter: c.Writer, c: c, start: time.Now()}
+		}
+		c.Next()
+	}
+}
+
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	c     *gin.Context
+	start time.Time
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	var metrics []string
+	if timings, ok := w.c.Request.Context().Value(stageTimingsKey{}).(*stageTimings); ok {
+		for stage, name := range []string{"sftp", "encode", "write"} {
+			if timings[stage] > 0 {
+				metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, milliseconds(timings[stage])))
+			}
+		}
+		for phase := phaseSelect; phase < numStages; phase++ {
+			if timings[phase] > 0 {
+				metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phaseNames[phase], milliseconds(timings[phase])))
+			}
+		}
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", milliseconds(time.Since(w.start))))
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
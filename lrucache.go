@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// lruEntryOverhead approximates the memory an entry takes besides its key,
+// data and content type: the list element, map slot and slice headers.
+const lruEntryOverhead = 128
+
+// lruCache is an in-memory cache bounded by the total size of its entries.
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+
+	// minFree is the available system memory below which nothing new is
+	// cached and old entries are dropped instead (MIN_FREE_MEMORY).
+	minFree int64
+	// pressureSkips counts inserts refused because memory was tight.
+	pressureSkips uint64
+}
+
+type lruEntry struct {
+	key string
+	// path is the image the entry was made from, for purgeMatching.
+	path        string
+	data        []byte
+	contentType string
+}
+
+// cost is what the entry counts for against maxBytes.
+func (e *lruEntry) cost() int64 {
+	return int64(len(e.key)+len(e.path)+len(e.data)+len(e.contentType)) + lruEntryOverhead
+}
+
+func newLRUCache(maxBytes, minFree int64) *lruCache {
+	return &lruCache{maxBytes: maxBytes, minFree: minFree, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lruCache) get(key string) ([]byte, string, bool) {
+	if l == nil {
+		return nil, "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, "", false
+	}
+	l.order.MoveToFront(elem)
+	entry := elem.Value.(*lruEntry)
+	return entry.data, entry.contentType, true
+}
+
+func (l *lruCache) put(key, path string, data []byte, contentType string) {
+	if l == nil {
+		return
+	}
+	entry := &lruEntry{key: key, path: path, data: data, contentType: contentType}
+	if entry.cost() > l.maxBytes {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.items[key]; ok {
+		l.size -= elem.Value.(*lruEntry).cost()
+		l.order.Remove(elem)
+		delete(l.items, key)
+	}
+	if l.minFree > 0 {
+		if available, ok := availableMemory(); ok && available < l.minFree {
+			// Give back at least the shortfall, and more than the entry
+			// would have taken, so a tight system sheds cache quickly.
+			l.pressureSkips++
+			l.evict(l.size - max(l.minFree-available, entry.cost()))
+			return
+		}
+	}
+	l.items[key] = l.order.PushFront(entry)
+	l.size += entry.cost()
+	l.evict(l.maxBytes)
+}
+
+// evict drops the least recently used entries until at most limit bytes
+// are cached.
+func (l *lruCache) evict(limit int64) {
+	for l.size > limit && l.order.Len() > 0 {
+		oldest := l.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		l.order.Remove(oldest)
+		delete(l.items, entry.key)
+		l.size -= entry.cost()
+	}
+}
+
+// purge empties the cache and reports what it held.
+func (l *lruCache) purge() (entries int, bytes int64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, bytes = len(l.items), l.size
+	l.order.Init()
+	clear(l.items)
+	l.size = 0
+	return entries, bytes
+}
+
+// purgeMatching drops the entries made from images match accepts and
+// reports what they held. Readers that already got an entry keep their
+// copy of its bytes.
+func (l *lruCache) purgeMatching(match func(path string) bool) (entries int, bytes int64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for elem := l.order.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*lruEntry); match(entry.path) {
+			l.order.Remove(elem)
+			delete(l.items, entry.key)
+			l.size -= entry.cost()
+			entries++
+			bytes += entry.cost()
+		}
+		elem = next
+	}
+	return entries, bytes
+}
+
+// writeCacheMetrics appends the transform cache's gauges in the Prometheus
+// text format, for tuning IMAGE_CACHE_MB and MIN_FREE_MEMORY.
+func writeCacheMetrics(b *strings.Builder) {
+	if available, ok := availableMemory(); ok {
+		fmt.Fprintf(b, "# HELP memory_available_bytes System memory available as seen by the cache.\n# TYPE memory_available_bytes gauge\nmemory_available_bytes %d\n", available)
+	}
+	l := transformCache
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(b, "# HELP image_cache_bytes Bytes held by the in-memory image cache.\n# TYPE image_cache_bytes gauge\nimage_cache_bytes %d\n", l.size)
+	fmt.Fprintf(b, "# HELP image_cache_limit_bytes Configured ceiling of the in-memory image cache.\n# TYPE image_cache_limit_bytes gauge\nimage_cache_limit_bytes %d\n", l.maxBytes)
+	fmt.Fprintf(b, "# HELP image_cache_entries Images held by the in-memory image cache.\n# TYPE image_cache_entries gauge\nimage_cache_entries %d\n", len(l.items))
+	fmt.Fprintf(b, "# HELP image_cache_pressure_skips_total Images not cached because available memory was below MIN_FREE_MEMORY.\n# TYPE image_cache_pressure_skips_total counter\nimage_cache_pressure_skips_total %d\n", l.pressureSkips)
+}
@@ -1,38 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
 	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
 )
 
 var (
-	directoriesWithImages []string
-	directoriesMutex      sync.RWMutex
-	sftpClient            *sftp.Client
-	clientMutex           sync.RWMutex
+	nasConn        *connManager
+	breaker        *circuitBreaker
+	imageDiskCache *diskCache
+	svgSafeMode    = svgModeSanitize
+	globalHistory  *servedHistory
+	transformCache *lruCache
 )
 
+// maxSelectionAttempts bounds how many directories getRandomImage tries
+// before settling for a recently served image or giving up on the filters.
+const maxSelectionAttempts = 5
+
 type ImageInfo struct {
 	Path         string    `json:"path"`
 	CreationDate time.Time `json:"creation_date"`
+	Size         int64     `json:"size"`
 }
 
+var imageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp", ".tiff", ".tif", ".svg"}
+
 func isImageFile(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
-	imageExts := []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp", ".tiff", ".tif", ".svg"}
 	for _, imgExt := range imageExts {
 		if ext == imgExt {
 			return true
@@ -41,8 +66,41 @@ func isImageFile(filename string) bool {
 	return false
 }
 
+// contentTypeOverrides maps extensions from CONTENT_TYPE_OVERRIDES to
+// their MIME types. They take precedence over the built-in mapping, and
+// their extensions count as images.
+var contentTypeOverrides map[string]string
+
+// parseContentTypeOverrides parses "jfif:image/jpeg;heic:image/heic" into
+// dotted, lower-case extensions. Only image types are accepted, so a
+// stray mapping cannot get the server to hand out HTML or scripts.
+func parseContentTypeOverrides(value string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ext, contentType, ok := strings.Cut(field, ":")
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		contentType = strings.TrimSpace(contentType)
+		if !ok || ext == "" || strings.ContainsAny(ext, "./") {
+			return nil, fmt.Errorf("invalid entry %q, want ext:type/subtype", field)
+		}
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.HasPrefix(mediaType, "image/") || len(mediaType) == len("image/") {
+			return nil, fmt.Errorf("%q for %s is not an image MIME type", contentType, ext)
+		}
+		overrides["."+ext] = contentType
+	}
+	return overrides, nil
+}
+
 func getContentType(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
+	if contentType, ok := contentTypeOverrides[ext]; ok {
+		return contentType
+	}
 	switch ext {
 	case ".jpg", ".jpeg":
 		return "image/jpeg"
@@ -64,178 +122,1005 @@ func getContentType(filename string) string {
 }
 
 func getRandomImage(c *gin.Context) {
-	directoriesMutex.RLock()
-	if len(directoriesWithImages) == 0 {
-		directoriesMutex.RUnlock()
+	indexed := imageIndex.snapshot()
+	if len(indexed) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "No directories with images found"})
 		return
 	}
-	directoriesMutex.RUnlock()
+	candidates := allowedDirectories(c, indexed)
+	if len(candidates) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not grant access to any directory with images"})
+		return
+	}
+	serveRandomImage(c, candidates)
+}
 
-	directoriesMutex.RLock()
-	randomDir := directoriesWithImages[rand.Intn(len(directoriesWithImages))]
-	directoriesMutex.RUnlock()
+// serveRandomImage serves a random image from candidates, narrowed by the
+// request's selection filters.
+func serveRandomImage(c *gin.Context, candidates []string) {
+	if serveQuietHours(c) {
+		return
+	}
+	opts, err := parseTransformOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := parseSelectionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	strategy, err := parseStrategy(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	redirect := false
+	if value := c.Query("redirect"); value != "" {
+		if redirect, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "redirect must be true or false"})
+			return
+		}
+	}
 
-	clientMutex.RLock()
-	client := sftpClient
-	clientMutex.RUnlock()
+	allowed := candidates
+	candidates = filter.directories(candidates)
+	if len(candidates) == 0 {
+		if filter.period != "" {
+			respondEmptyPeriod(c, filter.period, allowed)
+			return
+		}
+		if filter.tag != "" || filter.minRating > 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No images matching " + filter.String() + " found"})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No indexed directories match %q", filter.match)})
+		return
+	}
 
-	entries, err := client.ReadDir(randomDir)
+	client, err := nasConn.client()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read directory: " + err.Error()})
+		respondSFTPError(c, "", err)
 		return
 	}
 
-	var images []ImageInfo
-	for _, entry := range entries {
-		if !entry.IsDir() && isImageFile(entry.Name()) {
-			fullPath := filepath.Join(randomDir, entry.Name())
-			images = append(images, ImageInfo{
-				Path:         fullPath,
-				CreationDate: entry.ModTime(),
-			})
+	var randomImage ImageInfo
+	for attempt := 1; ; attempt++ {
+		var ok bool
+		selectStart := time.Now()
+		_, span := startSpan(c.Request.Context(), "select_image", attribute.Int("index.candidates", len(candidates)))
+		randomImage, ok = selectImage(c, client, candidates, filter, strategy)
+		span.End()
+		recordTiming(c.Request.Context(), selectStart, phaseSelect)
+		if !ok {
+			return
+		}
+		c.Set(nasPathKey, randomImage.Path)
+		readStart := time.Now()
+		ok, err = verifyImage(c.Request.Context(), client, randomImage)
+		recordStage(c, stageSFTP, readStart)
+		if err != nil {
+			respondSFTPError(c, "Failed to verify image: ", err)
+			return
+		}
+		if ok {
+			break
+		}
+		if attempt == maxVerifyAttempts {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No intact images found"})
+			return
 		}
 	}
 
-	if len(images) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "No images found in selected directory"})
+	if c.Request.Method == http.MethodGet {
+		globalHistory.add(randomImage.Path)
+	}
+	if redirect {
+		redirectToImage(c, randomImage)
 		return
 	}
+	serveImage(c, client, randomImage, opts)
+}
 
-	randomImage := images[rand.Intn(len(images))]
+// serveImage writes info to the client, applying opts if any were given.
+// HEAD requests without a transform are answered from the directory entry
+// alone.
+func serveImage(c *gin.Context, client *sftp.Client, info ImageInfo, opts transformOptions) {
+	c.Set(nasPathKey, info.Path)
+	contentType := getContentType(info.Path)
+	isSVG := contentType == "image/svg+xml"
+	if isSVG {
+		c.Header("Content-Security-Policy", "sandbox")
+		c.Header("X-Content-Type-Options", "nosniff")
+	}
 
-	file, err := client.Open(randomImage.Path)
+	transform := opts.appliesTo(contentType)
+	sanitize := isSVG && svgSafeMode == svgModeSanitize
+	if isSVG && svgSafeMode == svgModeAttachment {
+		contentType = "text/plain; charset=utf-8"
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(info.Path)))
+	}
+	needsBody := transform || sanitize
+	if c.Request.Method == http.MethodHead && !needsBody {
+		setImageHeaders(c, info, contentType, info.Size, opts)
+		if sum, ok := checksums.get(imageCacheKey(info)); ok && contentSHA256Enabled {
+			c.Header("X-Content-SHA256", sum)
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+	if !needsBody && imageDiskCache == nil {
+		streamImage(c, client, info, contentType, opts)
+		return
+	}
+
+	if transform {
+		transformKey := imageCacheKey(info) + "|" + opts.String()
+		_, span := startSpan(c.Request.Context(), "cache.transform", pathAttr(info.Path))
+		data, cachedType, ok := transformCache.get(transformKey)
+		span.SetAttributes(cacheAttr(ok))
+		span.End()
+		if !ok {
+			var err error
+			data, cachedType, err = transformShared(c.Request.Context(), client, info, contentType, opts, transformKey)
+			var failed *transformError
+			switch {
+			case errors.Is(err, errOverloaded):
+				respondOverloaded(c)
+				return
+			case errors.As(err, &failed):
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transform image: " + failed.Error()})
+				return
+			case err != nil:
+				respondSFTPError(c, "Failed to read image file: ", err)
+				return
+			}
+		}
+		writeImage(c, info, cachedType, data, opts)
+		return
+	}
+
+	readStart := time.Now()
+	imageData, err := readImage(c.Request.Context(), client, info)
+	recordStage(c, stageSFTP, readStart)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open image file: " + err.Error()})
+		respondSFTPError(c, "Failed to read image file: ", err)
 		return
 	}
+
+	if sanitize {
+		encodeStart := time.Now()
+		_, span := startSpan(c.Request.Context(), "sanitize_svg", attribute.Int("bytes", len(imageData)))
+		clean, err := sanitizeSVG(imageData)
+		endSpan(span, err)
+		if err != nil {
+			logger.Warn("serving malformed SVG as attachment", "path", info.Path, "error", err)
+			contentType = "application/octet-stream"
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(info.Path)))
+		} else {
+			imageData = clean
+		}
+		recordStage(c, stageEncode, encodeStart)
+	}
+
+	writeImage(c, info, contentType, imageData, opts)
+}
+
+func writeImage(c *gin.Context, info ImageInfo, contentType string, data []byte, opts transformOptions) {
+	setImageHeaders(c, info, contentType, int64(len(data)), opts)
+	if contentSHA256Enabled {
+		sum := sha256.Sum256(data)
+		c.Header("X-Content-SHA256", hex.EncodeToString(sum[:]))
+	}
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	writeStart := time.Now()
+	c.Data(http.StatusOK, contentType, data)
+	recordStage(c, stageWrite, writeStart)
+}
+
+// readImage returns the bytes of info, from the disk cache when enabled.
+// The read is abandoned when ctx is done.
+func readImage(ctx context.Context, client *sftp.Client, info ImageInfo) ([]byte, error) {
+	var key string
+	if imageDiskCache != nil {
+		key = imageCacheKey(info)
+		_, span := startSpan(ctx, "cache.disk", pathAttr(info.Path))
+		data, ok := imageDiskCache.get(key, info.Path)
+		span.SetAttributes(cacheAttr(ok))
+		span.End()
+		if ok {
+			return data, nil
+		}
+	}
+
+	openStart := time.Now()
+	_, span := startSpan(ctx, "sftp.open", pathAttr(info.Path))
+	var file io.ReadCloser
+	err := sftpCall(func() (err error) {
+		file, err = openImage(client, info.Path)
+		return err
+	})
+	endSpan(span, err)
+	recordTiming(ctx, openStart, phaseOpen)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
+	defer context.AfterFunc(ctx, func() { file.Close() })()
 
-	imageData, err := io.ReadAll(file)
+	transferStart := time.Now()
+	_, span = startSpan(ctx, "sftp.read", pathAttr(info.Path))
+	var buf bytes.Buffer
+	buf.Grow(int(info.Size))
+	// Outside sftpCall: a large file may take longer than SFTP_OP_TIMEOUT.
+	_, err, _ = writeFile(ctx, file, &buf, info.Size, transferStart)
+	recordSFTPResult(err)
+	data := buf.Bytes()
+	span.SetAttributes(attribute.Int("bytes", len(data)))
+	endSpan(span, err)
+	recordTiming(ctx, transferStart, phaseTransfer)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image file: " + err.Error()})
-		return
+		return nil, err
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type")
+	if imageDiskCache != nil {
+		imageDiskCache.put(key, info.Path, data)
+	}
+	return data, nil
+}
+
+// imageETag derives a strong validator from the path, size and modification
+// time, so HEAD can answer without reading the file. Transformed variants
+// get their own tag.
+func imageETag(info ImageInfo, variant string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d|%s", info.Path, info.Size, info.CreationDate.UnixNano(), variant)))
+	return fmt.Sprintf("\"%x\"", sum[:10])
+}
 
-	contentType := getContentType(randomImage.Path)
+func setImageHeaders(c *gin.Context, info ImageInfo, contentType string, size int64, opts transformOptions) {
 	c.Header("Content-Type", contentType)
-	c.Header("X-Creation-Date", randomImage.CreationDate.Format(time.RFC3339))
-	c.Data(http.StatusOK, contentType, imageData)
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Header("ETag", imageETag(info, opts.String()))
+	setImageMetadataHeaders(c, info)
+}
+
+// setImageMetadataHeaders describes info in X- headers.
+func setImageMetadataHeaders(c *gin.Context, info ImageInfo) {
+	c.Header("X-Creation-Date", formatDate(info.CreationDate))
+	c.Header("X-Image-ID", imageID(info))
+	if n, ok := imageIndex.imageNumber(info.Path); ok {
+		c.Header("X-Image-Number", strconv.Itoa(n))
+	}
+	if rating, ok := imageRatings.of(info.Path); ok {
+		c.Header("X-Rating", strconv.Itoa(rating))
+	}
+}
+
+// statusClientClosedRequest is nginx's status for requests the client
+// abandoned before a response was written.
+const statusClientClosedRequest = 499
+
+func respondSFTPError(c *gin.Context, message string, err error) {
+	if isContextError(err) && c.Request.Context().Err() != nil {
+		// Nobody is listening; just note it in the access log.
+		c.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+	recordRequestError(c, err)
+	status := mapSFTPError(err)
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		c.Header("Retry-After", strconv.Itoa(int(breaker.retryAfter().Seconds())+1))
+		message = ""
+	case status == http.StatusServiceUnavailable:
+		c.Header("Retry-After", strconv.Itoa(int(nasConn.retryAfter().Seconds())+1))
+		if errors.Is(err, errNASUnavailable) {
+			message = ""
+		}
+	}
+	c.JSON(status, gin.H{"error": message + err.Error()})
+}
+
+// mapSFTPError picks the HTTP status for an error from working with the
+// NAS: 503 while it cannot be reached, 504 when it stops answering, and
+// 404 or 403 for what SFTP reports about the file itself.
+func mapSFTPError(err error) int {
+	var status *sftp.StatusError
+	hasStatus := errors.As(err, &status)
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNASUnavailable), errors.Is(err, errCircuitOpen), isConnectionLost(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errSFTPTimeout), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.Is(err, fs.ErrNotExist), hasStatus && status.FxCode() == sftp.ErrSSHFxNoSuchFile:
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission), hasStatus && status.FxCode() == sftp.ErrSSHFxPermissionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
 }
 
-func handleOptions(c *gin.Context) {
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type")
-	c.Status(http.StatusOK)
+// readDirContext is client.ReadDir that gives up when ctx is done. The sftp
+// package has no cancellation of its own, so an abandoned call finishes in
+// the background.
+func readDirContext(ctx context.Context, client *sftp.Client, dir string) ([]os.FileInfo, error) {
+	type result struct {
+		entries []os.FileInfo
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		entries, err := readImageDir(client, dir)
+		done <- result{entries, err}
+	}()
+
+	var timeout <-chan time.Time
+	if sftpOpTimeout > 0 {
+		timer := time.NewTimer(sftpOpTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-done:
+		return r.entries, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		err := fmt.Errorf("reading %s: %w after %s", dir, errSFTPTimeout, sftpOpTimeout)
+		recordSFTPResult(err)
+		return nil, err
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// scanResult collects what a scan finds.
+type scanResult struct {
+	// dirs holds every directory that directly contains images.
+	dirs []string
+	// dates holds replacement creation dates for files with bogus mtimes.
+	dates      map[string]time.Time
+	suspicious int
+	// tags holds sidecar tags by image path.
+	tags map[string][]string
+	// ratings holds XMP star ratings by image path.
+	ratings map[string]int
+	// months counts images by the month they were taken, per directory.
+	months map[string]map[string]int
+	// images lists every image found.
+	images []indexedFile
+	// visited counts the directories walked, which the stall watchdog
+	// takes as progress.
+	visited atomic.Int64
+	// failed counts the directories that could not be read.
+	failed int
+}
+
+func newScanResult() *scanResult {
+	return &scanResult{dates: map[string]time.Time{}, tags: map[string][]string{}, ratings: map[string]int{}, months: map[string]map[string]int{}}
+}
+
+func (r *scanResult) merge(o *scanResult) {
+	r.dirs = append(r.dirs, o.dirs...)
+	r.images = append(r.images, o.images...)
+	r.suspicious += o.suspicious
+	maps.Copy(r.dates, o.dates)
+	maps.Copy(r.tags, o.tags)
+	maps.Copy(r.ratings, o.ratings)
+	maps.Copy(r.months, o.months)
+}
+
+// countMonth records an image in dir taken at t.
+func (r *scanResult) countMonth(dir string, t time.Time) {
+	if r.months[dir] == nil {
+		r.months[dir] = map[string]int{}
+	}
+	r.months[dir][monthOf(t)]++
+}
+
+// pendingDir is a directory the scan has yet to visit.
+type pendingDir struct {
+	Path  string `json:"path"`
+	Depth int    `json:"depth"`
+}
+
+// walkDirectories visits pending directories depth first until none are
+// left or ctx is done, logging progress as it goes. Directories are only
+// taken off pending once their results are in, so whatever is left when
+// walkDirectories returns early is exactly what remains to be done.
+func walkDirectories(ctx context.Context, client *sftp.Client, pending *[]pendingDir, result *scanResult) error {
+	start := time.Now()
+	lastProgress, visited := start, 0
+	for len(*pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next := (*pending)[len(*pending)-1]
+		subdirs, err := scanDirectory(ctx, client, next.Path, strings.Repeat("  ", next.Depth), result)
+		if isContextError(err) {
+			return err
+		}
+		*pending = (*pending)[:len(*pending)-1]
+		if err != nil {
+			result.failed++
+			if next.Depth == 0 {
+				return err
+			}
+		}
+		visited++
+		result.visited.Add(1)
+		if visited%scanProgressEvery == 0 || time.Since(lastProgress) >= scanProgressInterval {
+			logScanProgress(visited, len(result.dirs), time.Since(start))
+			lastProgress = time.Now()
+		}
+		if err != nil {
+			logger.Warn("scan: cannot read directory", "path", next.Path, "error", err)
+			recentErrors.record("scan", next.Path, err)
+			continue
+		}
+		for i := len(subdirs) - 1; i >= 0; i-- {
+			*pending = append(*pending, pendingDir{Path: subdirs[i], Depth: next.Depth + 1})
+		}
+	}
+	return nil
 }
 
-func listFoldersRecursively(client *sftp.Client, rootPath string, indent string) error {
-	entries, err := client.ReadDir(rootPath)
+// scanDirectory records what dir itself holds in result and returns its
+// subdirectories. Nothing is recorded if ctx ends first, so the directory
+// can be scanned again from scratch.
+func scanDirectory(ctx context.Context, client *sftp.Client, dir string, indent string, result *scanResult) ([]string, error) {
+	entries, err := readDirContext(ctx, client, dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	found := newScanResult()
 	hasImages := false
 	for _, entry := range entries {
 		if !entry.IsDir() && isImageFile(entry.Name()) {
 			hasImages = true
-			break
+			fullPath := filepath.Join(dir, entry.Name())
+			found.images = append(found.images, indexedFile{Path: fullPath, Size: entry.Size(), ModTime: entry.ModTime()})
+			bogusDate := !plausibleDate(entry.ModTime())
+			var header []byte
+			if scanEmbeddedXMP || bogusDate && hasEXIF(fullPath) {
+				header = readHeader(ctx, client, fullPath)
+			}
+			taken := entry.ModTime()
+			if bogusDate {
+				found.suspicious++
+				taken = fixDate(entry.ModTime(), header)
+				found.dates[fullPath] = taken
+			}
+			found.countMonth(dir, taken)
+			if rating, ok := xmpRating(header); ok {
+				found.ratings[fullPath] = rating
+			}
 		}
 	}
 
+	var lines []string
 	if hasImages {
-		directoriesMutex.Lock()
-		directoriesWithImages = append(directoriesWithImages, rootPath)
-		directoriesMutex.Unlock()
-		fmt.Printf("%s%s/ (contains images)\n", indent, filepath.Base(rootPath))
+		collectTags(ctx, client, dir, entries, found.tags)
+		collectRatingSidecars(ctx, client, dir, entries, found.ratings)
+		found.dirs = append(found.dirs, dir)
+		lines = append(lines, fmt.Sprintf("%s%s/ (contains images)", indent, filepath.Base(dir)))
 	} else {
-		fmt.Printf("%s%s/\n", indent, filepath.Base(rootPath))
+		lines = append(lines, fmt.Sprintf("%s%s/", indent, filepath.Base(dir)))
 	}
 
+	var subdirs []string
 	for _, entry := range entries {
-		if entry.IsDir() {
-			fullPath := filepath.Join(rootPath, entry.Name())
-			err := listFoldersRecursively(client, fullPath, indent+"  ")
+		fullPath := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			if !excludedDirectory(entry.Name()) {
+				subdirs = append(subdirs, fullPath)
+			}
+		case scanZips && isZipFile(entry.Name()):
+			images, err := scanZip(ctx, client, fullPath, found)
+			if isContextError(err) {
+				return nil, err
+			}
 			if err != nil {
-				fmt.Printf("Error reading %s: %v\n", fullPath, err)
+				logger.Warn("scan: cannot read archive", "path", fullPath, "error", err)
+				recentErrors.record("scan", fullPath, err)
+			} else if images > 0 {
+				lines = append(lines, fmt.Sprintf("%s  %s (zip, %d images)", indent, entry.Name(), images))
 			}
 		}
 	}
-	return nil
+
+	// Header and sidecar reads give up quietly when ctx ends, so only a
+	// live ctx means found is complete.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result.merge(found)
+	logger.Debug("scanned directory", "path", dir, "images", len(found.images), "subdirectories", len(subdirs))
+	if printTree {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	}
+	return subdirs, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "scan" {
+		os.Exit(scanCommand(os.Args[2:]))
+	}
+	quiet := flag.Bool("quiet", false, "log only warnings, errors and scan summaries (LOG_LEVEL=warn)")
+	printTreeFlag := flag.Bool("print-tree", false, "print the directory tree to stdout while scanning (SCAN_VERBOSE=true)")
+	check := flag.Bool("check", false, "check the configuration, NAS access, scan roots and listen address, then exit (DRY_RUN=true)")
+	flag.Parse()
+
+	cfg, problems := loadEnvConfig()
+	if *check || cfg.dryRun {
+		cfg.dryRun = true
+		os.Exit(preflight(cfg, problems))
+	}
+	exitIfInvalid(problems)
+	if *quiet {
+		cfg.logLevel = slog.LevelWarn
+	}
+	if *printTreeFlag {
+		cfg.printTree = true
+	}
+	fmt.Println(buildVersion())
+	fmt.Println(cfg.summary())
+
+	if err := run(cfg); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit statuses, so a supervisor can tell a configuration it should not
+// keep restarting from a NAS that is only briefly away.
+const (
+	exitFailure        = 1
+	exitInvalidConfig  = 2
+	exitNASAuth        = 3
+	exitNASUnreachable = 4
+)
+
+func exitCode(err error) int {
+	var authErr *nasAuthError
+	switch {
+	case errors.As(err, &authErr):
+		return exitNASAuth
+	case isNASUnreachable(err):
+		return exitNASUnreachable
+	}
+	return exitFailure
+}
+
+// loadEnvConfig reads .env and then the configuration from the
+// environment.
+func loadEnvConfig() (*config, []string) {
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println("Warning: Error loading .env file:", err)
 		fmt.Println("Continuing with system environment variables...")
 	}
+	return loadConfig()
+}
 
-	sshUser := getEnv("SSH_USER", "")
-	sshPassword := getEnv("SSH_PASSWORD", "")
-	sshHost := getEnv("SSH_HOST", "")
-	sshPort := getEnv("SSH_PORT", "22")
-	serverHost := getEnv("SERVER_HOST", "localhost")
-	serverPort := getEnv("SERVER_PORT", "3141")
+// mustLoadConfig is loadEnvConfig for entry points that cannot go on with
+// an invalid configuration.
+func mustLoadConfig() *config {
+	cfg, problems := loadEnvConfig()
+	exitIfInvalid(problems)
+	return cfg
+}
 
-	if sshUser == "" || sshPassword == "" || sshHost == "" {
-		panic("Missing required environment variables: SSH_USER, SSH_PASSWORD, and SSH_HOST must be set")
+func exitIfInvalid(problems []string) {
+	if len(problems) == 0 {
+		return
 	}
+	fmt.Println("Invalid configuration:")
+	for _, problem := range problems {
+		fmt.Println("  - " + problem)
+	}
+	os.Exit(exitInvalidConfig)
+}
 
-	config := &ssh.ClientConfig{
-		User: sshUser,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(sshPassword),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// run wires the server together from cfg and blocks until it shuts down.
+// Resources are acquired in order (listener, NAS connection, index, HTTP
+// server) and released in reverse, so a listener that cannot bind fails
+// before the NAS is scanned and the SFTP client outlives every request.
+func run(cfg *config) error {
+	logger = newLogger(cfg.logFormat, cfg.logLevel)
+	if cfg.otlpEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdownTracing(ctx)
+		}()
 	}
 
-	address := fmt.Sprintf("%s:%s", sshHost, sshPort)
-	conn, err := ssh.Dial("tcp", address, config)
-	if err != nil {
-		panic("Failed to connect to NAS: " + err.Error())
+	applyConfig(cfg)
+
+	// Validation only checked these could be created.
+	for _, name := range []string{cfg.indexCacheFile, cfg.compareTallyFile, cfg.manifestFile} {
+		if name == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+	}
+	if cfg.diskCacheDir != "" {
+		var err error
+		imageDiskCache, err = openDiskCache(cfg.diskCacheDir, cfg.diskCacheMaxSize)
+		if err != nil {
+			return fmt.Errorf("opening disk cache %s: %w", cfg.diskCacheDir, err)
+		}
+		fmt.Printf("Disk cache enabled at %s (%s cached)\n", cfg.diskCacheDir, formatBytes(imageDiskCache.size))
+	}
+	if cfg.compareTallyFile != "" {
+		if err := compareResults.load(cfg.compareTallyFile); err != nil {
+			return fmt.Errorf("loading compare tally: %w", err)
+		}
+		fmt.Printf("Compare tally at %s (%d images ranked)\n", cfg.compareTallyFile, compareResults.len())
 	}
-	defer conn.Close()
 
-	client, err := sftp.NewClient(conn)
+	listeners, err := openListeners(cfg)
 	if err != nil {
-		panic("Failed to create SFTP client: " + err.Error())
+		return fmt.Errorf("listening: %w", err)
 	}
-	defer client.Close()
+	defer closeListeners(listeners)
 
-	clientMutex.Lock()
-	sftpClient = client
-	clientMutex.Unlock()
+	if err := connectNAS(cfg); err != nil {
+		return err
+	}
+	defer nasConn.close()
+
+	client, err := nasConn.client()
+	if err != nil {
+		return fmt.Errorf("creating SFTP client: %w", err)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	err = listFoldersRecursively(client, "/", "")
+	// A manifest stands in for the startup scan unless one is forced.
+	usedManifest := cfg.scanOnStartup != scanAlways && loadManifest(cfg.manifestFile, cfg.manifestMaxAge)
+	if !usedManifest && loadIndexCache(cfg.scanOnStartup, cfg.indexMaxAge) {
+		signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		scanIndex(signalCtx, client, cfg.scanTimeout)
+		interrupted := signalCtx.Err() != nil
+		stopSignals()
+		if interrupted {
+			fmt.Println("Shutdown requested during scan, exiting")
+			return nil
+		}
+	}
+
+	fmt.Printf("Serving %d directories with images\n", imageIndex.len())
+
+	// Background work tied to the server, such as JWKS refreshes, stops
+	// once serve returns.
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	if verifyMode != verifyOff || contentSHA256Enabled {
+		// Keep verification results and hashes gathered while serving.
+		defer saveIndexCache()
+	}
+
+	router, err := newRouter(serverCtx, cfg)
 	if err != nil {
-		fmt.Printf("Error listing folders: %v\n", err)
+		return err
+	}
+	fmt.Printf("Server listening on %s\n", strings.Join(listenAddresses.Load().([]string), ", "))
+	if cfg.warmCache {
+		go warmCache(serverCtx, cfg.warmCachePrefetch)
 	}
+	err = serve(router, listeners, cfg.httpTimeouts, cfg.httpTuning, cfg.drainTimeout, cfg.shutdownTimeout)
+	// Stop a rescan that is still running and let it write its checkpoint.
+	stopServer()
+	backgroundScans.Wait()
+	return err
+}
 
-	directoriesMutex.RLock()
-	fmt.Printf("Found %d directories with images\n", len(directoriesWithImages))
-	directoriesMutex.RUnlock()
+// applyConfig sets the package state that the scanner and the handlers
+// read from cfg.
+func applyConfig(cfg *config) {
+	defaultJPEGQuality = cfg.jpegQuality
+	defaultColorMode = cfg.defaultImageMode
+	reencodeJPEGQuality = cfg.reencodeJPEGQuality
+	svgSafeMode = cfg.svgSafeMode
+	indexCacheFile = cfg.indexCacheFile
+	scanCheckpointMaxAge = cfg.indexMaxAge
+	verifyMode = cfg.verifyImages
+	creationDateSkew = cfg.creationDateSkew
+	selectionStrategy = cfg.strategy
+	randomImagesMaxCount, randomImagesMaxBytes = cfg.randomImagesMaxCount, cfg.randomImagesMaxBytes
+	montageMaxCount, montageMaxTileSize = cfg.montageMaxCount, cfg.montageMaxTileSize
+	maxChangeWaiters, maxChangeWait = int64(cfg.maxChangeWaiters), changeWaitLimit(cfg.httpTimeouts.write)
+	// With JWT auth on, responses depend on the token and must not be
+	// shared between users by a CDN.
+	visibility := "public"
+	if cfg.jwtSecret != "" || cfg.jwksURL != "" {
+		visibility = "private"
+	}
+	imageCacheControl = fmt.Sprintf("%s, max-age=%d, immutable", visibility, int(cfg.imageCacheMaxAge.Seconds()))
+	randomCacheControl = cfg.randomCacheControl
+	jsonCacheControl = fmt.Sprintf("%s, max-age=%d, stale-while-revalidate=%d",
+		visibility, int(cfg.jsonCacheMaxAge.Seconds()), int(cfg.jsonStaleWhileRevalidate.Seconds()))
+	contentSHA256Enabled = cfg.contentSHA256
+	directoryWeights = cfg.directoryWeights
+	recencyHalfLife = cfg.recencyBias
+	displayLocation = cfg.displayTimezone
+	quietHours = cfg.quietHours
+	requestLimiter = newInflightLimiter("requests", cfg.maxInflightRequests)
+	transformLimiter = newInflightLimiter("transforms", cfg.maxInflightTransforms)
+	contentTypeOverrides = cfg.contentTypeOverrides
+	for ext := range contentTypeOverrides {
+		if !slices.Contains(imageExts, ext) {
+			imageExts = append(imageExts, ext)
+		}
+	}
+	scanEmbeddedXMP = cfg.scanEmbeddedXMP
+	scanZips = cfg.scanZips
+	scanRoots = cfg.scanRoots
+	scanExcludes = cfg.scanExcludes
+	for _, key := range cfg.shadowedSecrets {
+		fmt.Printf("Warning: both %s and %s_FILE are set; using %s_FILE\n", key, key, key)
+	}
+	for _, root := range cfg.nestedScanRoots {
+		fmt.Printf("Warning: SCAN_ROOT %s is listed twice or lies inside another root; ignoring it so nothing is indexed twice\n", root)
+	}
+	printTree = cfg.printTree
+	scanProgressEvery = cfg.scanProgressEvery
+	scanStallTimeout, scanStallRetries = cfg.scanStallTimeout, cfg.scanStallRetries
+	albums = cfg.albums
+	minImageWidth, minImageHeight = cfg.minImageWidth, cfg.minImageHeight
+	streamBufferSize = int(cfg.streamBufferSize)
+	streamReadAhead = cfg.streamReadAhead
+	copyBufferSize = int(cfg.copyBufferSize)
+	sftpOpTimeout = cfg.sftpOpTimeout
+	breaker = newCircuitBreaker(cfg.breakerThreshold, cfg.breakerCooldown)
 
-	router := gin.Default()
+	recentErrors = newErrorRing(cfg.errorLogSize)
+	if cfg.globalHistorySize > 0 {
+		globalHistory = newServedHistory(cfg.globalHistorySize)
+	}
 
-	router.GET("/getRandomImage", getRandomImage)
-	router.OPTIONS("/getRandomImage", handleOptions)
+	if cfg.transformCacheSize > 0 {
+		transformCache = newLRUCache(cfg.transformCacheSize, cfg.minFreeMemory)
+		if _, ok := availableMemory(); cfg.minFreeMemory > 0 && !ok {
+			fmt.Printf("Warning: MIN_FREE_MEMORY is set but %s cannot be read; only the cache size limit applies\n", memInfoFile)
+		}
+	}
+}
 
-	serverAddress := fmt.Sprintf("%s:%s", serverHost, serverPort)
-	fmt.Printf("Server starting on %s\n", serverAddress)
-	router.Run(serverAddress)
+// connectNAS sets up nasConn and makes the first connection. The caller
+// closes it.
+func connectNAS(cfg *config) error {
+	config := &ssh.ClientConfig{
+		User: cfg.sshUser,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(cfg.sshPassword),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         cfg.sshDialTimeout,
+	}
+	if cfg.sshHostKeyMode == hostKeyTOFU {
+		hostKeys = &hostKeyPin{file: cfg.sshHostKeyFile, dryRun: cfg.dryRun}
+		config.HostKeyCallback = hostKeys.callback
+	} else {
+		fmt.Println("WARNING: SSH_HOST_KEY_MODE=insecure accepts any NAS host key, so a man in the middle would go unnoticed. Set SSH_HOST_KEY_MODE=tofu to pin it.")
+	}
+
+	address := net.JoinHostPort(cfg.sshHost, cfg.sshPort)
+	// Packets above 32KB are not guaranteed by the protocol; SFTP_MAX_PACKET
+	// is the operator's assertion that their NAS accepts them.
+	sftpOptions := []sftp.ClientOption{
+		sftp.MaxPacketUnchecked(int(cfg.sftpMaxPacket)),
+		sftp.UseConcurrentReads(cfg.sftpConcurrentReads),
+	}
+	nasConn = newConnManager(func() (*ssh.Client, error) {
+		conn, err := dialSSH(address, config, cfg.sshHandshakeTimeout)
+		if err == nil && hostKeys != nil {
+			if err = hostKeys.confirm(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, err
+	}, sftpOptions, cfg.reconnectMaxBackoff)
+	err := nasConn.connect()
+	if isNASUnreachable(err) {
+		return fmt.Errorf("%w; check SSH_HOST and SSH_PORT and that the NAS accepts SSH connections", err)
+	}
+	return err
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// openListeners binds the configured unix socket or every TCP port.
+func openListeners(cfg *config) ([]net.Listener, error) {
+	if cfg.unixSocket != "" {
+		listener, err := listenUnix(cfg.unixSocket, cfg.unixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		listenAddresses.Store([]string{"unix:" + cfg.unixSocket})
+		return []net.Listener{listener}, nil
+	}
+
+	var listeners []net.Listener
+	var addrs []string
+	for _, port := range cfg.serverPorts {
+		listener, err := listen(cfg.serverHost, port)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		addrs = append(addrs, listener.Addr().String())
+	}
+	listenAddresses.Store(addrs)
+	if cfg.portFile != "" {
+		if err := writePortFile(cfg.portFile, listeners); err != nil {
+			fmt.Printf("Warning: failed to write PORT_FILE: %v\n", err)
+		}
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// newRouter builds the HTTP handler for cfg. Goroutines it starts exit
+// when ctx is cancelled.
+func newRouter(ctx context.Context, cfg *config) (*gin.Engine, error) {
+	router := gin.New()
+	trusted := defaultTrustedProxies
+	if len(cfg.trustedProxies) > 0 {
+		trusted = cfg.trustedProxies.strings()
+	}
+	if err := router.SetTrustedProxies(trusted); err != nil {
+		return nil, fmt.Errorf("setting trusted proxies: %w", err)
+	}
+	if len(cfg.ipAllow) > 0 || len(cfg.ipDeny) > 0 {
+		filter := &ipFilter{allow: cfg.ipAllow, deny: cfg.ipDeny, trustedProxies: cfg.trustedProxies}
+		router.Use(filter.middleware())
+	}
+	if cfg.serverHeader {
+		router.Use(serverHeader())
+	}
+	if len(cfg.customHeaders) > 0 {
+		router.Use(customHeadersMiddleware(cfg.customHeaders))
+	}
+	router.Use(accessLog(), gin.Recovery())
+	cors := &corsPolicy{origins: cfg.corsOrigins, credentials: cfg.corsCredentials, maxAge: cfg.corsMaxAge}
+	router.Use(cors.middleware())
+	if tracingMiddleware != nil {
+		router.Use(tracingMiddleware)
+	}
+	if len(cfg.adminAPIKeys) > 0 {
+		router.Use(serverTiming(cfg.adminAPIKeys))
+	}
+
+	api := router.Group("/")
+	if requestLimiter != nil {
+		api.Use(requestLimiter.middleware())
+	}
+	var signer *shareSigner
+	if cfg.shareSecret != "" {
+		signer = newShareSigner(cfg.shareSecret, cfg.shareMaxTTL)
+		api.Use(signer.middleware())
+	}
+	if cfg.jwtSecret != "" || cfg.jwksURL != "" {
+		validator := newJWTValidator(cfg.jwtSecret, cfg.jwksURL, cfg.jwtClockSkew, cfg.jwksRefresh)
+		if validator.jwks != nil {
+			go validator.jwks.run(ctx)
+		}
+		api.Use(varyAuthorization, validator.middleware())
+	}
+	noStore := cacheControl("no-store")
+	jsonCache := cacheControl(jsonCacheControl)
+	// hotlink guards the routes that serve image bytes.
+	hotlink := func(c *gin.Context) { c.Next() }
+	if len(cfg.allowedReferers) > 0 {
+		guard := &hotlinkGuard{allowed: cfg.allowedReferers, allowEmpty: cfg.allowEmptyReferer}
+		if cfg.hotlinkPlaceholderData != nil {
+			guard.placeholder, guard.placeholderType = cfg.hotlinkPlaceholderData, getContentType(cfg.hotlinkPlaceholder)
+		}
+		hotlink = guard.middleware()
+	}
+	// placeholders stand in for errors on the routes that serve image
+	// bytes, ahead of the guards so their refusals are covered too.
+	placeholders := func(c *gin.Context) { c.Next() }
+	if cfg.errorPlaceholders != nil {
+		placeholders = cfg.errorPlaceholders.middleware()
+	}
+	// fallback answers the selection routes' failures with an image.
+	fallback := fallbackMiddleware(cfg.fallbackImage, cfg.fallbackMode)
+	// perClient bounds concurrent downloads from one address.
+	clients := newClientLimiter(cfg.maxConcurrentPerIP, cfg.trustedProxies)
+	perClient := func(c *gin.Context) { c.Next() }
+	if clients != nil {
+		perClient = clients.middleware()
+	}
+
+	api.GET("/getRandomImage", placeholders, fallback, hotlink, perClient, cacheControl(randomCacheControl), getRandomImage)
+	api.HEAD("/getRandomImage", placeholders, fallback, hotlink, perClient, cacheControl(randomCacheControl), getRandomImage)
+	api.GET("/getRandomImages", hotlink, perClient, noStore, getRandomImages)
+	api.GET("/montage", placeholders, hotlink, perClient, noStore, getMontage)
+	api.GET("/image", placeholders, hotlink, perClient, noStore, getImageByPath)
+	api.HEAD("/image", placeholders, hotlink, perClient, noStore, getImageByPath)
+	api.GET("/image/:id", placeholders, hotlink, perClient, noStore, getImage)
+	api.HEAD("/image/:id", placeholders, hotlink, perClient, noStore, getImage)
+	api.GET("/image/:id/checksum", jsonCache, getImageChecksum)
+	switch {
+	case signer == nil:
+	case cfg.jwtSecret != "" || cfg.jwksURL != "":
+		api.GET("/image/:id/share", noStore, signer.share)
+	default:
+		// Without JWT only admins may mint links.
+		api.GET("/image/:id/share", noStore, adminAuth(cfg.adminAPIKeys), signer.share)
+	}
+	api.GET("/wait-for-change", noStore, waitForChange)
+	api.GET("/timeline", jsonCache, getTimeline)
+	api.GET("/compare", noStore, getCompare)
+	api.POST("/compare/result", noStore, postCompareResult)
+	api.GET("/compare/leaderboard", noStore, getCompareLeaderboard)
+	api.GET("/tags", jsonCache, listTags)
+	api.GET("/tree", jsonCache, getTree)
+	api.GET("/images", jsonCache, listImages)
+	if cfg.webdavListing {
+		api.Handle("PROPFIND", davPrefix+"/*path", noStore, propfind)
+		api.GET(davPrefix+"/*path", placeholders, hotlink, perClient, noStore, getDAVFile)
+		api.HEAD(davPrefix+"/*path", placeholders, hotlink, perClient, noStore, getDAVFile)
+		api.OPTIONS(davPrefix+"/*path", davOptions)
+	}
+	api.GET("/albums", jsonCache, listAlbums)
+	api.GET("/albums/:name/images", jsonCache, listAlbumImages)
+	api.GET("/albums/:name/random", placeholders, fallback, hotlink, perClient, cacheControl(randomCacheControl), getAlbumRandomImage)
+	router.GET("/healthz", noStore, getHealth)
+	router.GET("/version", noStore, getVersion)
+	router.GET("/stats", jsonCache, getStats)
+	router.GET("/metrics", noStore, getMetrics)
+	if cfg.serveDemoUI {
+		router.GET("/", serveDemoUI)
+	}
+
+	if len(cfg.adminAPIKeys) > 0 {
+		admin := router.Group("/admin", noStore, adminAuth(cfg.adminAPIKeys))
+		admin.POST("/flush-cache", flushCache)
+		admin.POST("/cache/purge", purgeCache)
+		admin.POST("/rescan", rescan(ctx, cfg.scanTimeout))
+		admin.DELETE("/rescan", cancelRescan)
+		admin.GET("/rescan", getScanStatus)
+		admin.GET("/index/export", exportIndex)
+		admin.POST("/index/import", importIndex)
+		admin.POST("/dump-manifest", dumpManifest(cfg.manifestFile))
+		admin.GET("/host-key", getHostKey)
+		admin.DELETE("/host-key", resetHostKey)
+		admin.GET("/clients", getTopClients(clients))
+		admin.GET("/config", getConfig(cfg))
+		admin.GET("/quarantine", getQuarantine)
+		admin.DELETE("/quarantine", clearQuarantine)
+
+		debug := router.Group("/debug", noStore, adminAuth(cfg.adminAPIKeys))
+		debug.GET("/errors", getErrors)
+		debug.DELETE("/errors", clearErrors)
 	}
-	return defaultValue
+	return router, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// testConfig is the default configuration, which TestMain applies.
+var testConfig *config
+
+// TestMain runs the tests under the default configuration: what run
+// applies for a server given only the required settings.
+func TestMain(m *testing.M) {
+	for key, value := range map[string]string{
+		"SSH_USER":     "photos",
+		"SSH_PASSWORD": "s3cret",
+		"SSH_HOST":     "nas.invalid",
+	} {
+		os.Setenv(key, value)
+	}
+	cfg, problems := loadConfig()
+	if len(problems) > 0 {
+		fmt.Println("Invalid test configuration:", problems)
+		os.Exit(exitInvalidConfig)
+	}
+	applyConfig(cfg)
+	testConfig = cfg
+	os.Exit(m.Run())
+}
+
+// timeoutError is a net.Error that timed out, as a stalled socket reports.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestMapSFTPError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no such file", &sftp.StatusError{Code: uint32(sftp.ErrSSHFxNoSuchFile)}, http.StatusNotFound},
+		{"permission denied", &sftp.StatusError{Code: uint32(sftp.ErrSSHFxPermissionDenied)}, http.StatusForbidden},
+		{"not exist", fmt.Errorf("open: %w", fs.ErrNotExist), http.StatusNotFound},
+		{"other status", &sftp.StatusError{Code: uint32(sftp.ErrSSHFxFailure)}, http.StatusInternalServerError},
+		{"reconnecting", errNASUnavailable, http.StatusServiceUnavailable},
+		{"circuit open", errCircuitOpen, http.StatusServiceUnavailable},
+		{"operation timeout", fmt.Errorf("reading /photos: %w after 10s", errSFTPTimeout), http.StatusGatewayTimeout},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, http.StatusGatewayTimeout},
+		{"connection lost", sftp.ErrSSHFxConnectionLost, http.StatusServiceUnavailable},
+		{"connection closed", fmt.Errorf("read: %w", net.ErrClosed), http.StatusServiceUnavailable},
+		{"eof", io.EOF, http.StatusServiceUnavailable},
+		{"short read", fmt.Errorf("read 1 of 2 bytes: %w", errShortRead), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := mapSFTPError(tt.err); got != tt.want {
+			t.Errorf("%s: mapSFTPError(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
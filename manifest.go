@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// manifestVersion is bumped whenever manifest changes incompatibly.
+const manifestVersion = 1
+
+// manifest describes the library as a list of directories and their
+// images. Unlike the index cache it is owned by the operator: the server
+// reads it at startup in place of a scan (MANIFEST_FILE) and only writes it
+// when asked to through /admin/dump-manifest, so it can be kept under
+// version control or generated elsewhere.
+type manifest struct {
+	Version     int       `json:"version"`
+	Generation  int       `json:"generation,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Roots are the scan roots the manifest was made for; a manifest for
+	// other roots is ignored. Empty means "/".
+	Roots       []string            `json:"roots,omitempty"`
+	Directories []manifestDirectory `json:"directories"`
+}
+
+type manifestDirectory struct {
+	Path   string          `json:"path"`
+	Images []manifestImage `json:"images"`
+}
+
+// manifestImage describes one image. Only Name is required.
+type manifestImage struct {
+	Name         string     `json:"name"`
+	Size         int64      `json:"size,omitempty"`
+	ModTime      *time.Time `json:"mod_time,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Width        int        `json:"width,omitempty"`
+	Height       int        `json:"height,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Rating       *int       `json:"rating,omitempty"`
+}
+
+var errManifestStale = errors.New("manifest is stale")
+
+func readManifest(name string, maxAge time.Duration) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	if m.Version != manifestVersion {
+		return m, fmt.Errorf("%s has version %d, want %d", name, m.Version, manifestVersion)
+	}
+	roots := normalizeDirectories(m.Roots)
+	if len(roots) == 0 {
+		roots = []string{"/"}
+	}
+	if !slices.Equal(roots, normalizeDirectories(scanRoots)) {
+		return m, fmt.Errorf("%w: made for roots %v, scanning %v", errManifestStale, roots, scanRoots)
+	}
+	if age := time.Since(m.GeneratedAt); maxAge > 0 && age > maxAge {
+		return m, fmt.Errorf("%w: generated %s ago (MANIFEST_MAX_AGE=%s)", errManifestStale, age.Round(time.Second), maxAge)
+	}
+	for _, dir := range m.Directories {
+		if !path.IsAbs(dir.Path) {
+			return m, fmt.Errorf("%s: directory %q is not absolute", name, dir.Path)
+		}
+		for _, img := range dir.Images {
+			// Images inside an archive may sit in its subdirectories.
+			valid := path.Base(img.Name) == img.Name
+			if isZipDirectory(dir.Path) {
+				valid = fs.ValidPath(img.Name)
+			}
+			if img.Name == "" || !valid {
+				return m, fmt.Errorf("%s: %q in %s is not a file name", name, img.Name, dir.Path)
+			}
+			if img.Rating != nil && (*img.Rating < minRating || *img.Rating > maxRating) {
+				return m, fmt.Errorf("%s: %s/%s has rating %d, want %d to %d", name, dir.Path, img.Name, *img.Rating, minRating, maxRating)
+			}
+		}
+	}
+	return m, nil
+}
+
+// indexFile converts m to the form the index cache uses, so it can be
+// installed with restore. Creation dates are only kept where the mtime
+// cannot be trusted, as after a scan.
+func (m manifest) indexFile() indexFile {
+	f := indexFile{
+		Version:       indexFileVersion,
+		ScannedAt:     m.GeneratedAt,
+		CreationDates: map[string]time.Time{},
+		Tags:          map[string][]string{},
+		Ratings:       map[string]int{},
+		Timeline:      map[string]map[string]int{},
+		Generation:    max(m.Generation, 1),
+	}
+	for _, dir := range m.Directories {
+		if len(dir.Images) > 0 {
+			f.Directories = append(f.Directories, path.Clean(dir.Path))
+		}
+		for _, img := range dir.Images {
+			p := joinImagePath(dir.Path, img.Name)
+			f.Images = append(f.Images, p)
+			if img.Size > 0 && img.ModTime != nil {
+				f.Files = append(f.Files, indexedFile{Path: p, Size: img.Size, ModTime: *img.ModTime})
+			}
+			if img.CreationDate != nil && (img.ModTime == nil || !plausibleDate(*img.ModTime)) {
+				f.CreationDates[p] = *img.CreationDate
+				f.SuspiciousDates++
+			}
+			for _, tag := range img.Tags {
+				if tag, ok := normalizeTag(tag); ok {
+					f.Tags[p] = append(f.Tags[p], tag)
+				}
+			}
+			if img.Rating != nil {
+				f.Ratings[p] = *img.Rating
+			}
+			if taken, ok := img.taken(); ok {
+				dir := path.Clean(dir.Path)
+				if f.Timeline[dir] == nil {
+					f.Timeline[dir] = map[string]int{}
+				}
+				f.Timeline[dir][monthOf(taken)]++
+			}
+		}
+	}
+	return f
+}
+
+// taken is the creation date a scan would have found for img, if the
+// manifest gives enough to tell.
+func (img manifestImage) taken() (time.Time, bool) {
+	switch {
+	case img.ModTime != nil && plausibleDate(*img.ModTime):
+		return *img.ModTime, true
+	case img.CreationDate != nil:
+		return *img.CreationDate, true
+	case img.ModTime != nil:
+		return clampDate(*img.ModTime), true
+	}
+	return time.Time{}, false
+}
+
+// loadManifest installs the manifest at name as the index. It reports
+// false, after saying why, when there is none or it cannot be used, and
+// startup carries on as if MANIFEST_FILE were unset.
+func loadManifest(name string, maxAge time.Duration) bool {
+	if name == "" {
+		return false
+	}
+	m, err := readManifest(name, maxAge)
+	if err != nil {
+		fmt.Printf("Not using manifest (%v)\n", err)
+		return false
+	}
+	imageIndex.restore(m.indexFile())
+
+	// Dimensions are keyed by size and date, so they can only be
+	// preloaded for images whose manifest entry has both.
+	for _, dir := range m.Directories {
+		for _, img := range dir.Images {
+			if img.Width <= 0 || img.Height <= 0 || img.Size <= 0 || img.ModTime == nil {
+				continue
+			}
+			p := joinImagePath(dir.Path, img.Name)
+			info := ImageInfo{Path: p, Size: img.Size, CreationDate: creationDate(p, *img.ModTime)}
+			dimensions.put(imageCacheKey(info), p, imageDimensions{width: img.Width, height: img.Height})
+		}
+	}
+	fmt.Printf("Loaded manifest %s: %d directories with images, generated %s ago\n",
+		name, imageIndex.len(), time.Since(m.GeneratedAt).Round(time.Second))
+	return true
+}
+
+// buildManifest describes the indexed directories as they are on the NAS
+// now. Sizes and dates come from listing each directory; dimensions are
+// included where already known rather than read.
+func buildManifest(ctx context.Context, client *sftp.Client) (manifest, error) {
+	generation, _ := imageIndex.numbering()
+	m := manifest{
+		Version:     manifestVersion,
+		Generation:  generation,
+		GeneratedAt: time.Now().UTC(),
+		Roots:       scanRoots,
+		Directories: []manifestDirectory{},
+	}
+	for _, dir := range imageIndex.snapshot() {
+		entries, err := readDirContext(ctx, client, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return m, fmt.Errorf("listing %s: %w", dir, err)
+		}
+		d := manifestDirectory{Path: dir}
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(entry.Name()) {
+				continue
+			}
+			p := joinImagePath(dir, entry.Name())
+			modTime := entry.ModTime().UTC()
+			created := creationDate(p, modTime)
+			img := manifestImage{
+				Name:         entry.Name(),
+				Size:         entry.Size(),
+				ModTime:      &modTime,
+				CreationDate: &created,
+				Tags:         imageTags.of(p),
+			}
+			info := ImageInfo{Path: p, Size: entry.Size(), CreationDate: created}
+			if dims, ok := dimensions.get(imageCacheKey(info)); ok {
+				img.Width, img.Height = dims.width, dims.height
+			}
+			if rating, ok := imageRatings.of(p); ok {
+				img.Rating = &rating
+			}
+			d.Images = append(d.Images, img)
+		}
+		if len(d.Images) > 0 {
+			m.Directories = append(m.Directories, d)
+		}
+	}
+	return m, nil
+}
+
+// dumpManifest writes the live index to manifestFile, to be loaded in
+// place of the next startup scan. Without a MANIFEST_FILE the manifest is
+// returned instead.
+func dumpManifest(manifestFile string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := nasConn.client()
+		if err != nil {
+			respondSFTPError(c, "", err)
+			return
+		}
+		m, err := buildManifest(c.Request.Context(), client)
+		if err != nil {
+			respondSFTPError(c, "Failed to build manifest: ", err)
+			return
+		}
+		if manifestFile == "" {
+			c.Header("Content-Disposition", `attachment; filename="manifest.json"`)
+			c.IndentedJSON(http.StatusOK, m)
+			return
+		}
+		if err := writeJSONFile(manifestFile, m); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write manifest: " + err.Error()})
+			return
+		}
+		images := 0
+		for _, dir := range m.Directories {
+			images += len(dir.Images)
+		}
+		fmt.Printf("Manifest written to %s: %d directories, %d images\n", manifestFile, len(m.Directories), images)
+		c.JSON(http.StatusOK, gin.H{
+			"file":         manifestFile,
+			"generation":   m.Generation,
+			"generated_at": m.GeneratedAt,
+			"directories":  len(m.Directories),
+			"images":       images,
+		})
+	}
+}
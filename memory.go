@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memInfoFile is where the kernel reports available memory. Elsewhere
+// than Linux it does not exist and MIN_FREE_MEMORY has no effect.
+const memInfoFile = "/proc/meminfo"
+
+// memoryProbeInterval bounds how often memInfoFile is read, since the
+// cache asks on every insert.
+const memoryProbeInterval = time.Second
+
+var memoryProbe struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	available int64
+	ok        bool
+}
+
+// availableMemory reports the system's MemAvailable in bytes, or false
+// if it cannot be read.
+func availableMemory() (int64, bool) {
+	memoryProbe.mu.Lock()
+	defer memoryProbe.mu.Unlock()
+	if time.Since(memoryProbe.checkedAt) < memoryProbeInterval {
+		return memoryProbe.available, memoryProbe.ok
+	}
+	memoryProbe.checkedAt = time.Now()
+	memoryProbe.available, memoryProbe.ok = readMemAvailable()
+	return memoryProbe.available, memoryProbe.ok
+}
+
+func readMemAvailable() (int64, bool) {
+	f, err := os.Open(memInfoFile)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "MemAvailable:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		return kb << 10, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyBuckets are upper bounds in seconds, from cache hits to slow NAS
+// transfers of large originals.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram is a Prometheus-style cumulative histogram.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a family of histograms told apart by label values.
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogram{}}
+}
+
+// observe records d for the series with the given label values.
+func (v *histogramVec) observe(d time.Duration, values ...string) {
+	key := strings.Join(values, "\x00")
+	seconds := d.Seconds()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		v.series[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write appends v in the Prometheus text format.
+func (v *histogramVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		h := v.series[key]
+		var labels []string
+		for i, value := range strings.Split(key, "\x00") {
+			labels = append(labels, fmt.Sprintf("%s=%q", v.labels[i], value))
+		}
+		prefix := strings.Join(labels, ",")
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", v.name, prefix, bound, h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", v.name, prefix, h.count)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", v.name, prefix, h.sum)
+		fmt.Fprintf(b, "%s_count{%s} %d\n", v.name, prefix, h.count)
+	}
+}
+
+var (
+	requestDuration = newHistogramVec("http_request_duration_seconds",
+		"Time to serve a request, by route.", "method", "route", "status")
+	phaseDuration = newHistogramVec("sftp_phase_duration_seconds",
+		"Time spent per phase of serving an image.", "phase")
+)
+
+// methodLabel bounds the method label: a client can send any method, and
+// each one would otherwise add a series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+func getMetrics(c *gin.Context) {
+	var b strings.Builder
+	requestDuration.write(&b)
+	phaseDuration.write(&b)
+	writeLimiterMetrics(&b)
+	writeCacheMetrics(&b)
+	writeTransformMetrics(&b)
+	writeIndexMetrics(&b)
+	writeChangeWaiterMetrics(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// Bounds for /montage (MONTAGE_MAX_COUNT and MONTAGE_MAX_TILE_SIZE). Tiles
+// are drawn one at a time, so a montage holds the canvas and one decoded
+// image in memory.
+var (
+	montageMaxCount    = 36
+	montageMaxTileSize = 400
+)
+
+const montageMinTileSize = 16
+
+var montageBackground = color.Gray{Y: 0x20}
+
+// getMontage serves a contact sheet: ?count= images picked as by
+// /getRandomImages, cropped to ?size= pixel squares and laid out ?cols= to
+// a row, as ?format=jpeg or png. Images that cannot be decoded, such as
+// SVGs, leave their tile blank.
+func getMontage(c *gin.Context) {
+	if serveQuietHours(c) {
+		return
+	}
+	count, err := parseMinDimension(c, "count", 9)
+	if err != nil || count < 1 || count > montageMaxCount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", montageMaxCount)})
+		return
+	}
+	size, err := parseMinDimension(c, "size", 200)
+	if err != nil || size < montageMinTileSize || size > montageMaxTileSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between %d and %d", montageMinTileSize, montageMaxTileSize)})
+		return
+	}
+	cols, err := parseMinDimension(c, "cols", int(math.Ceil(math.Sqrt(float64(count)))))
+	if err != nil || cols < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cols must be a positive integer"})
+		return
+	}
+	cols = min(cols, count)
+	if rows := (count + cols - 1) / cols; cols*size > maxTransformDimension || rows*size > maxTransformDimension {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("montage would exceed %dpx on a side", maxTransformDimension)})
+		return
+	}
+	format := c.DefaultQuery("format", "jpeg")
+	if format != "jpeg" && format != "png" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jpeg or png"})
+		return
+	}
+	client, picked, ok := pickDistinctImages(c, count)
+	if !ok {
+		return
+	}
+	if !transformLimiter.acquire() {
+		respondOverloaded(c)
+		return
+	}
+	defer transformLimiter.release()
+
+	// Fewer images than asked for shrink the grid rather than leave a
+	// blank row.
+	cols = min(cols, len(picked))
+	rows := (len(picked) + cols - 1) / cols
+	canvas := image.NewRGBA(image.Rect(0, 0, cols*size, rows*size))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{C: montageBackground}, image.Point{}, draw.Src)
+	for i, info := range picked {
+		c.Set(nasPathKey, info.Path)
+		data, err := readImage(c.Request.Context(), client, info)
+		if err != nil {
+			respondSFTPError(c, "Failed to load image: ", err)
+			return
+		}
+		tile, err := montageTile(data, size)
+		if err != nil {
+			logger.Debug("montage: leaving tile blank", "path", info.Path, "error", err)
+			continue
+		}
+		at := image.Pt(i%cols*size, i/cols*size)
+		draw.Draw(canvas, image.Rectangle{Min: at, Max: at.Add(image.Pt(size, size))}, tile, tile.Bounds().Min, draw.Over)
+	}
+
+	out, err := encodeImage(canvas, format, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("X-Image-Count", strconv.Itoa(len(picked)))
+	c.Data(http.StatusOK, outputFormats[format], out)
+}
+
+// montageTile decodes an image the right way up and crops it to a
+// size x size square.
+func montageTile(data []byte, size int) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	img = reorient(img, exifOrientation(data))
+	return resizeImage(img, transformOptions{width: size, height: size, fit: "cover", upscale: true}), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// Bounds for /getRandomImages (RANDOM_IMAGES_MAX_COUNT and
+// RANDOM_IMAGES_MAX_BYTES). The byte cap applies to multipart bodies.
+var (
+	randomImagesMaxCount       = 10
+	randomImagesMaxBytes int64 = 32 << 20
+)
+
+// getRandomImages picks ?count= distinct random images with the same
+// filters as /getRandomImage. By default it lists them as JSON for the
+// client to fetch from /image/:id; with ?multipart=true the images
+// themselves come back in one multipart/mixed body, stopping early rather
+// than going over RANDOM_IMAGES_MAX_BYTES.
+func getRandomImages(c *gin.Context) {
+	if serveQuietHours(c) {
+		return
+	}
+	count, err := parseMinDimension(c, "count", 1)
+	if err != nil || count < 1 || count > randomImagesMaxCount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", randomImagesMaxCount)})
+		return
+	}
+	asMultipart := false
+	if value := c.Query("multipart"); value != "" {
+		if asMultipart, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "multipart must be true or false"})
+			return
+		}
+	}
+	opts, err := parseTransformOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client, picked, ok := pickDistinctImages(c, count)
+	if !ok {
+		return
+	}
+
+	if !asMultipart {
+		images := make([]gin.H, len(picked))
+		for i, info := range picked {
+			id := imageID(info)
+			images[i] = gin.H{"id": id, "url": "/image/" + id, "path": info.Path, "size": info.Size, "creation_date": formatDate(info.CreationDate)}
+		}
+		c.JSON(http.StatusOK, gin.H{"images": images})
+		return
+	}
+	writeMultipartImages(c, client, picked, opts)
+}
+
+// pickDistinctImages picks up to count distinct images with the selection
+// filters and strategy of the request. Small libraries may not have count
+// of them, so it gives up on duplicates after a few extra picks. On
+// failure the error response has already been written.
+func pickDistinctImages(c *gin.Context, count int) (*sftp.Client, []ImageInfo, bool) {
+	sel, ok := parseSelection(c)
+	if !ok {
+		return nil, nil, false
+	}
+	var picked []ImageInfo
+	seen := map[string]bool{}
+	for attempt := 0; attempt < 2*count && len(picked) < count; attempt++ {
+		info, ok := sel.pick(c)
+		if !ok {
+			return nil, nil, false
+		}
+		if seen[info.Path] {
+			continue
+		}
+		seen[info.Path] = true
+		picked = append(picked, info)
+		globalHistory.add(info.Path)
+	}
+	return sel.client, picked, true
+}
+
+// selection is what a request picks images from: the directories it may
+// see that pass its filters, and how to choose among them.
+type selection struct {
+	client     *sftp.Client
+	candidates []string
+	filter     selectionFilter
+	strategy   string
+}
+
+// parseSelection reads the selection filters and strategy of the request
+// and narrows the index to the candidate directories. On failure the
+// error response has already been written.
+func parseSelection(c *gin.Context) (selection, bool) {
+	filter, err := parseSelectionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return selection{}, false
+	}
+	strategy, err := parseStrategy(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return selection{}, false
+	}
+	indexed := imageIndex.snapshot()
+	if len(indexed) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No directories with images found"})
+		return selection{}, false
+	}
+	allowed := allowedDirectories(c, indexed)
+	candidates := filter.directories(allowed)
+	if len(candidates) == 0 && filter.period != "" {
+		respondEmptyPeriod(c, filter.period, allowed)
+		return selection{}, false
+	}
+	if len(candidates) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No indexed directories match the request"})
+		return selection{}, false
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return selection{}, false
+	}
+	return selection{client: client, candidates: candidates, filter: filter, strategy: strategy}, true
+}
+
+func (s selection) pick(c *gin.Context) (ImageInfo, bool) {
+	return selectImage(c, s.client, s.candidates, s.filter, s.strategy)
+}
+
+// writeMultipartImages renders every image before writing anything, so a
+// failure can still be answered with a plain error.
+func writeMultipartImages(c *gin.Context, client *sftp.Client, images []ImageInfo, opts transformOptions) {
+	type part struct {
+		info        ImageInfo
+		data        []byte
+		contentType string
+	}
+	var parts []part
+	var total int64
+	for _, info := range images {
+		data, contentType, err := renderImage(c.Request.Context(), client, info, opts)
+		if errors.Is(err, errOverloaded) {
+			respondOverloaded(c)
+			return
+		}
+		if err != nil {
+			respondSFTPError(c, "Failed to load image: ", err)
+			return
+		}
+		if len(parts) > 0 && total+int64(len(data)) > randomImagesMaxBytes {
+			break
+		}
+		total += int64(len(data))
+		parts = append(parts, part{info, data, contentType})
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType)
+		header.Set("Content-Length", strconv.Itoa(len(p.data)))
+		header.Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", path.Base(p.info.Path)))
+		header.Set("X-Image-Path", p.info.Path)
+		header.Set("X-Image-ID", imageID(p.info))
+		header.Set("X-Creation-Date", formatDate(p.info.CreationDate))
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pw.Write(p.data)
+	}
+	w.Close()
+	c.Header("X-Image-Count", strconv.Itoa(len(parts)))
+	c.Data(http.StatusOK, "multipart/mixed; boundary="+w.Boundary(), body.Bytes())
+}
+
+var errOverloaded = errors.New("too many transforms in flight")
+
+// renderImage returns the bytes serveImage would send for info, without
+// the streaming shortcut.
+func renderImage(ctx context.Context, client *sftp.Client, info ImageInfo, opts transformOptions) ([]byte, string, error) {
+	contentType := getContentType(info.Path)
+	if opts.appliesTo(contentType) {
+		transformKey := imageCacheKey(info) + "|" + opts.String()
+		if data, cachedType, ok := transformCache.get(transformKey); ok {
+			return data, cachedType, nil
+		}
+		data, contentType, err := transformShared(ctx, client, info, contentType, opts, transformKey)
+		var failed *transformError
+		if errors.As(err, &failed) {
+			return nil, "", fmt.Errorf("transforming %s: %w", info.Path, failed.err)
+		}
+		return data, contentType, err
+	}
+	data, err := readImage(ctx, client, info)
+	if err != nil {
+		return nil, "", err
+	}
+	if contentType == "image/svg+xml" {
+		switch svgSafeMode {
+		case svgModeAttachment:
+			return data, "text/plain; charset=utf-8", nil
+		case svgModeSanitize:
+			clean, err := sanitizeSVG(data)
+			if err != nil {
+				return data, "application/octet-stream", nil
+			}
+			data = clean
+		}
+	}
+	return data, contentType, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testNAS is an SSH server on loopback serving an in-memory SFTP tree,
+// standing in for the NAS in tests and benchmarks. While it runs, nasConn
+// is connected to it the way run connects to the real one.
+type testNAS struct {
+	files   sftp.Handlers
+	latency time.Duration
+	address string
+	config  *ssh.ServerConfig
+
+	// client is the read-only client the server code gets from nasConn;
+	// admin may write, for setting up fixtures.
+	client *sftp.Client
+	admin  *sftp.Client
+}
+
+// maxTestRead is the most the test NAS returns for one read, the same as
+// OpenSSH's sftp-server; reads asking for more come back short.
+const maxTestRead = 255 * 1024
+
+var testHostKey = sync.OnceValue(func() ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return signer
+})
+
+// newTestNAS starts a NAS whose every SFTP response is delayed by latency,
+// like one at the far end of a slow link; requests still pipeline.
+func newTestNAS(tb testing.TB, latency time.Duration, opts ...sftp.ClientOption) *testNAS {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nas := &testNAS{
+		files:   sftp.InMemHandler(),
+		latency: latency,
+		address: listener.Addr().String(),
+		config:  &ssh.ServerConfig{NoClientAuth: true},
+	}
+	nas.config.AddHostKey(testHostKey())
+	go nas.accept(listener)
+
+	adminConn, err := nas.dial()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if nas.admin, err = sftp.NewClient(adminConn); err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := nasConn
+	nasConn = newConnManager(nas.dial, opts, time.Second)
+	if err := nasConn.connect(); err != nil {
+		tb.Fatal(err)
+	}
+	nas.client, _ = nasConn.client()
+
+	tb.Cleanup(func() {
+		nasConn.close()
+		nasConn = previous
+		nas.admin.Close()
+		adminConn.Close()
+		listener.Close()
+	})
+	return nas
+}
+
+func (n *testNAS) dial() (*ssh.Client, error) {
+	return dialSSH(n.address, &ssh.ClientConfig{User: "photos", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, 0)
+}
+
+func (n *testNAS) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go n.serve(conn)
+	}
+}
+
+func (n *testNAS) serve(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, n.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go n.session(channel, requests)
+	}
+}
+
+// session starts an SFTP server when the client asks for the subsystem.
+func (n *testNAS) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		var subsystem struct{ Name string }
+		isSFTP := req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+		req.Reply(isSFTP, nil)
+		if !isSFTP {
+			continue
+		}
+		var responses io.WriteCloser = channel
+		if n.latency > 0 {
+			responses = newDelayLine(channel, n.latency)
+		}
+		server := sftp.NewRequestServer(struct {
+			io.Reader
+			io.WriteCloser
+		}{channel, responses}, n.files, sftp.WithRSMaxTxPacket(maxTestRead))
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// put stores data at p, creating its directories.
+func (n *testNAS) put(tb testing.TB, p string, data []byte) {
+	tb.Helper()
+	if err := n.admin.MkdirAll(path.Dir(p)); err != nil {
+		tb.Fatal(err)
+	}
+	f, err := n.admin.Create(p)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// delayLine passes writes on to w after latency, in order, without making
+// the writer wait for them.
+type delayLine struct {
+	w       io.WriteCloser
+	latency time.Duration
+	queue   chan delayedWrite
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+func newDelayLine(w io.WriteCloser, latency time.Duration) *delayLine {
+	d := &delayLine{w: w, latency: latency, queue: make(chan delayedWrite, 4096)}
+	go func() {
+		defer w.Close()
+		for write := range d.queue {
+			time.Sleep(time.Until(write.due))
+			if _, err := w.Write(write.data); err != nil {
+				for range d.queue {
+				}
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *delayLine) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+	d.queue <- delayedWrite{due: time.Now().Add(d.latency), data: append([]byte(nil), p...)}
+	return len(p), nil
+}
+
+func (d *delayLine) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// maxPipelineSteps bounds the work a single ?pipeline= can ask for.
+const maxPipelineSteps = 16
+
+// pipelineStep is one image operation of a ?pipeline=. orientation is the
+// source's EXIF orientation, for the orient step.
+type pipelineStep struct {
+	name  string
+	arg   string
+	apply func(img image.Image, orientation int) image.Image
+}
+
+func (s pipelineStep) String() string {
+	if s.arg == "" {
+		return s.name
+	}
+	return s.name + ":" + s.arg
+}
+
+// pipelineSteps lists the supported steps for error messages.
+const pipelineSteps = "orient, rotate:90|180|270, resize:W or resize:WxH, cover:WxH, grayscale, dither, quality:N, format:jpeg|png|gif"
+
+// pipelineConflicts are the transform parameters a ?pipeline= replaces.
+var pipelineConflicts = []string{"w", "h", "fit", "mode", "color", "gravity", "upscale", "format", "quality", "q"}
+
+// parsePipelineOptions reads the transform options of a request with a
+// ?pipeline=. The pipeline is the whole transform, so DEFAULT_IMAGE_MODE
+// does not apply and the one-off parameters are refused.
+func parsePipelineOptions(c *gin.Context, value string) (transformOptions, error) {
+	var opts transformOptions
+	for _, name := range pipelineConflicts {
+		if c.Query(name) != "" {
+			return opts, fmt.Errorf("pipeline cannot be combined with %s", name)
+		}
+	}
+	opts.quality = defaultJPEGQuality
+	if reencodeJPEGQuality > 0 {
+		opts.quality, opts.reencode = reencodeJPEGQuality, true
+	}
+	steps, err := parsePipeline(value, &opts)
+	if err != nil {
+		return opts, err
+	}
+	opts.pipeline = steps
+	switch frame := c.Query("frame"); frame {
+	case "":
+	case "first":
+		opts.firstFrame = true
+	default:
+		return opts, fmt.Errorf("unsupported frame %q (supported: first)", frame)
+	}
+	return opts, nil
+}
+
+// parsePipeline parses a ?pipeline= such as "orient,resize:1920,grayscale".
+// Steps that change the image are returned in order; quality and format
+// set how the result is encoded and go into opts.
+func parsePipeline(value string, opts *transformOptions) ([]pipelineStep, error) {
+	var steps []pipelineStep
+	fields := strings.Split(value, ",")
+	if len(fields) > maxPipelineSteps {
+		return nil, fmt.Errorf("pipeline has %d steps, at most %d are allowed", len(fields), maxPipelineSteps)
+	}
+	dither, encoding := false, false
+	for _, field := range fields {
+		name, arg, _ := strings.Cut(strings.TrimSpace(field), ":")
+		step := pipelineStep{name: strings.ToLower(name), arg: arg}
+		switch step.name {
+		case "orient":
+			step.apply = reorient
+		case "rotate":
+			orientation, ok := map[string]int{"90": 6, "180": 3, "270": 8}[arg]
+			if !ok {
+				return nil, fmt.Errorf("pipeline step %q: rotate takes 90, 180 or 270", field)
+			}
+			step.apply = func(img image.Image, _ int) image.Image { return reorient(img, orientation) }
+		case "resize", "cover":
+			geometry, err := parsePipelineSize(step.name, arg)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline step %q: %w", field, err)
+			}
+			step.apply = func(img image.Image, _ int) image.Image { return resizeImage(img, geometry) }
+		case colorGrayscale, colorDither:
+			mode := step.name
+			dither = dither || mode == colorDither
+			step.apply = func(img image.Image, _ int) image.Image { return convertColor(img, mode) }
+		case "quality":
+			q, err := strconv.Atoi(arg)
+			if err != nil || q < 1 || q > 100 {
+				return nil, fmt.Errorf("pipeline step %q: quality must be an integer between 1 and 100", field)
+			}
+			opts.quality, opts.reencode, encoding = q, true, true
+			continue
+		case "format":
+			format := strings.ToLower(arg)
+			if format == "jpg" {
+				format = "jpeg"
+			}
+			if _, ok := outputFormats[format]; !ok {
+				return nil, fmt.Errorf("pipeline step %q: unsupported format (supported: jpeg, png, gif)", field)
+			}
+			opts.format, encoding = format, true
+			continue
+		default:
+			return nil, fmt.Errorf("unknown pipeline step %q (supported: %s)", field, pipelineSteps)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 && !encoding {
+		return nil, fmt.Errorf("pipeline is empty")
+	}
+	if dither && opts.format == "" {
+		// As with color=dither, JPEG artefacts would smear the pattern.
+		opts.format = "png"
+	}
+	return steps, nil
+}
+
+// parsePipelineSize reads the W or WxH argument of resize and cover. resize
+// fits within the size and cover fills it, cropping around the centre;
+// neither enlarges the image.
+func parsePipelineSize(name, arg string) (transformOptions, error) {
+	geometry := transformOptions{fit: "contain", gravity: "center"}
+	width, height, ok := parseFitSize(arg)
+	if !ok && name == "resize" {
+		var err error
+		width, err = strconv.Atoi(arg)
+		ok = err == nil
+	}
+	if !ok {
+		if name == "cover" {
+			return geometry, fmt.Errorf("takes WIDTHxHEIGHT")
+		}
+		return geometry, fmt.Errorf("takes WIDTH or WIDTHxHEIGHT")
+	}
+	if width < 0 || height < 0 || width > maxTransformDimension || height > maxTransformDimension || width == 0 && height == 0 {
+		return geometry, fmt.Errorf("dimensions must be between 1 and %d", maxTransformDimension)
+	}
+	if name == "cover" {
+		if width == 0 || height == 0 {
+			return geometry, fmt.Errorf("takes WIDTHxHEIGHT")
+		}
+		geometry.fit = "cover"
+	}
+	geometry.width, geometry.height = width, height
+	return geometry, nil
+}
+
+// applyPipeline runs steps over img in order.
+func applyPipeline(img image.Image, steps []pipelineStep, orientation int) image.Image {
+	for _, step := range steps {
+		img = step.apply(img, orientation)
+	}
+	return img
+}
+
+// exifOrientation reads the EXIF orientation of a JPEG or TIFF file, 1
+// (upright) when there is none.
+func exifOrientation(data []byte) int {
+	const (
+		typeShort      = 3
+		tagOrientation = 0x0112
+	)
+	tiff, order := exifTIFF(data)
+	if order == nil {
+		return 1
+	}
+	offset := uint64(order.Uint32(tiff[4:]))
+	if offset+2 > uint64(len(tiff)) {
+		return 1
+	}
+	n := uint64(order.Uint16(tiff[offset:]))
+	for i := range n {
+		entry := offset + 2 + 12*i
+		if entry+12 > uint64(len(tiff)) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == tagOrientation && order.Uint16(tiff[entry+2:]) == typeShort {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// reorient turns img as EXIF orientation o says it should be displayed: 3,
+// 6 and 8 are rotations by 180, 90 and 270 degrees clockwise, and 2, 4, 5
+// and 7 their mirror images.
+func reorient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	scratch := getScratch(4 * w * h)
+	defer putScratch(scratch)
+	src := &image.RGBA{Pix: *scratch, Stride: 4 * w, Rect: image.Rect(0, 0, w, h)}
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dstW, dstH := w, h
+	if o >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := range dstH {
+		for x := range dstW {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
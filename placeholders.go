@@ -0,0 +1,208 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type placeholderImage struct {
+	data        []byte
+	contentType string
+}
+
+// defaultFallbackImage is served by the fallback when
+// PLACEHOLDER_IMAGE_PATH is not set.
+//
+//go:embed static/placeholder.png
+var defaultFallbackImage []byte
+
+// maxFallbackImageSize bounds PLACEHOLDER_IMAGE_PATH, which is held in
+// memory and may be sent on every request while the NAS is away.
+const maxFallbackImageSize = 2 << 20
+
+// Fallback modes (FALLBACK_MODE, or ?fallback= per request).
+const (
+	fallbackJSON  = "json"
+	fallbackImage = "image"
+)
+
+// errorPlaceholders are images served in place of error responses from
+// the image routes (PLACEHOLDER_DIR), keyed by status code. Key 0 holds
+// the images that stand in for a 404 or a 5xx without a set of its own.
+type errorPlaceholders map[int][]placeholderImage
+
+// loadErrorPlaceholders reads dir, where a subdirectory named after a
+// status code (404, 503, ...) holds the images for that status and images
+// directly in dir are the default set.
+func loadErrorPlaceholders(dir string) (errorPlaceholders, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	placeholders := errorPlaceholders{}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			if isImageFile(entry.Name()) {
+				if err := placeholders.add(0, name); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		status, err := strconv.Atoi(entry.Name())
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("%s: subdirectories must be named after a 4xx or 5xx status code", name)
+		}
+		files, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !file.IsDir() && isImageFile(file.Name()) {
+				if err := placeholders.add(status, filepath.Join(name, file.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(placeholders) == 0 {
+		return nil, fmt.Errorf("no images in %s", dir)
+	}
+	return placeholders, nil
+}
+
+func (p errorPlaceholders) add(status int, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	p[status] = append(p[status], placeholderImage{data: data, contentType: getContentType(name)})
+	return nil
+}
+
+func (p errorPlaceholders) count() int {
+	n := 0
+	for _, set := range p {
+		n += len(set)
+	}
+	return n
+}
+
+// pick returns a random placeholder for status, if there is one.
+func (p errorPlaceholders) pick(status int) (placeholderImage, bool) {
+	set := p[status]
+	if len(set) == 0 && (status == http.StatusNotFound || status >= 500) {
+		set = p[0]
+	}
+	if len(set) == 0 {
+		return placeholderImage{}, false
+	}
+	return set[rand.Intn(len(set))], true
+}
+
+// wantsImage reports whether an Accept header asks for an image, as an
+// <img> tag or a photo frame does, rather than leaving the type open.
+func wantsImage(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaRange, _, _ = strings.Cut(mediaRange, ";")
+		if strings.HasPrefix(strings.TrimSpace(mediaRange), "image/") {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware swaps the body of an error response for a placeholder when
+// the client wants an image, keeping the status code.
+func (p errorPlaceholders) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept")
+		if !wantsImage(c.GetHeader("Accept")) {
+			c.Next()
+			return
+		}
+		c.Writer = &placeholderWriter{ResponseWriter: c.Writer, placeholders: p}
+		c.Next()
+	}
+}
+
+// fallbackMiddleware answers a failed selection (nothing indexed, nothing
+// matching the filters, the NAS unavailable) with image and a 200, so a
+// photo frame shows something rather than a broken image until its next
+// rotation. It applies with ?fallback=image or under FALLBACK_MODE=image,
+// and never to a client that asks for JSON. X-Fallback marks it.
+func fallbackMiddleware(image placeholderImage, mode string) gin.HandlerFunc {
+	placeholders := errorPlaceholders{0: {image}}
+	return func(c *gin.Context) {
+		requested := c.DefaultQuery("fallback", mode)
+		if requested != fallbackImage && requested != fallbackJSON {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "fallback must be image or json"})
+			return
+		}
+		accept := c.GetHeader("Accept")
+		if requested == fallbackJSON || strings.Contains(accept, "application/json") && !wantsImage(accept) {
+			c.Next()
+			return
+		}
+		c.Writer = &placeholderWriter{ResponseWriter: c.Writer, placeholders: placeholders, fallback: true}
+		c.Next()
+	}
+}
+
+// placeholderWriter writes a placeholder as soon as an error status is set
+// and drops the error body that follows. A fallback placeholder is sent
+// with 200 instead of the error status.
+type placeholderWriter struct {
+	gin.ResponseWriter
+	placeholders errorPlaceholders
+	fallback     bool
+	replaced     bool
+}
+
+func (w *placeholderWriter) WriteHeader(code int) {
+	if w.replaced || w.Written() {
+		return
+	}
+	placeholder, ok := w.placeholders.pick(code)
+	if !ok {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.replaced = true
+	h := w.Header()
+	for _, name := range []string{"ETag", "Last-Modified", "Content-Disposition"} {
+		h.Del(name)
+	}
+	h.Set("Content-Type", placeholder.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(placeholder.data)))
+	h.Set("Cache-Control", "no-store")
+	if w.fallback {
+		h.Set("X-Fallback", "true")
+		code = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(code)
+	w.ResponseWriter.Write(placeholder.data)
+}
+
+func (w *placeholderWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *placeholderWriter) WriteString(s string) (int, error) {
+	if w.replaced {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
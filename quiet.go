@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QUIET_HOURS_MODE values.
+const (
+	quietPlaceholder = "placeholder"
+	quietNoContent   = "no-content"
+)
+
+// quietWindow is a daily span of wall-clock time, such as 22:00-07:00,
+// during which random images are not served. Start and end are minutes
+// after midnight; a window with end before start wraps past midnight.
+type quietWindow struct {
+	start, end int
+	loc        *time.Location
+	mode       string
+}
+
+// quietHours is nil when QUIET_HOURS is unset.
+var quietHours *quietWindow
+
+func parseQuietHours(value string) (start, end int, err error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not in HH:MM-HH:MM form", value)
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("%q is an empty window", value)
+	}
+	return start, end, nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 22:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls in the window and, if so, how long
+// until it ends. Wall-clock times are used, so the window follows DST
+// changes in its zone.
+func (q *quietWindow) active(now time.Time) (bool, time.Duration) {
+	local := now.In(q.loc)
+	minute := local.Hour()*60 + local.Minute()
+	var inside bool
+	if q.start < q.end {
+		inside = minute >= q.start && minute < q.end
+	} else {
+		inside = minute >= q.start || minute < q.end
+	}
+	if !inside {
+		return false, 0
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), q.end/60, q.end%60, 0, 0, q.loc)
+	if !end.After(local) {
+		end = time.Date(local.Year(), local.Month(), local.Day()+1, q.end/60, q.end%60, 0, 0, q.loc)
+	}
+	return true, end.Sub(now)
+}
+
+// quietPlaceholderPNG is a single black pixel; frames scale it to fill
+// the screen.
+var quietPlaceholderPNG = func() []byte {
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}()
+
+// serveQuietHours answers a random image request during quiet hours
+// without touching the NAS, and reports whether it did.
+func serveQuietHours(c *gin.Context) bool {
+	if quietHours == nil {
+		return false
+	}
+	active, remaining := quietHours.active(time.Now())
+	if !active {
+		return false
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+	c.Header("X-Quiet-Hours", "true")
+	if quietHours.mode == quietNoContent {
+		c.Status(http.StatusNoContent)
+		return true
+	}
+	c.Data(http.StatusOK, "image/png", quietPlaceholderPNG)
+	return true
+}
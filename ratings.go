@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// Star ratings come from xmp:Rating, either in an XMP packet embedded near
+// the start of the image or in a Lightroom-style sidecar named after the
+// image ("a.xmp" or "a.jpg.xmp"). A sidecar wins over the embedded value.
+// Unrated images count as 0; Lightroom marks rejects as -1.
+const (
+	xmpSuffix = ".xmp"
+	minRating = -1
+	maxRating = 5
+)
+
+// scanEmbeddedXMP enables reading each image's header during scans to find
+// embedded ratings. Sidecars are read regardless.
+var scanEmbeddedXMP = true
+
+// xmpRatingPattern matches both the attribute and the element form.
+var xmpRatingPattern = regexp.MustCompile(`xmp:Rating(?:="|>)\s*(-?\d+)`)
+
+// xmpRating finds xmp:Rating in data, which may be a whole sidecar or the
+// start of an image file.
+func xmpRating(data []byte) (int, bool) {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return 0, false
+	}
+	m := xmpRatingPattern.FindSubmatch(data[start:])
+	if m == nil {
+		return 0, false
+	}
+	rating, err := strconv.Atoi(string(m[1]))
+	if err != nil || rating < minRating || rating > maxRating {
+		return 0, false
+	}
+	return rating, true
+}
+
+// ratingStore holds the ratings found by the last complete scan, keyed by
+// image path. Unrated images are absent.
+type ratingStore struct {
+	mu     sync.RWMutex
+	byPath map[string]int
+}
+
+var imageRatings = &ratingStore{byPath: map[string]int{}}
+
+func (r *ratingStore) replace(byPath map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byPath = byPath
+}
+
+// replaceSubtree swaps in ratings for the images under root.
+func (r *ratingStore) replaceSubtree(root string, byPath map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := maps.Clone(r.byPath)
+	maps.DeleteFunc(next, func(p string, _ int) bool { return underDirectory(p, root) })
+	maps.Copy(next, byPath)
+	r.byPath = next
+}
+
+func (r *ratingStore) export() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byPath
+}
+
+func (r *ratingStore) of(p string) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rating, ok := r.byPath[p]
+	return rating, ok
+}
+
+// directories returns the set of directories holding an image rated
+// least or higher.
+func (r *ratingStore) directories(least int) map[string]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dirs := map[string]bool{}
+	for p, rating := range r.byPath {
+		if rating >= least {
+			dirs[path.Dir(p)] = true
+		}
+	}
+	return dirs
+}
+
+// collectRatingSidecars reads the .xmp sidecars among the entries of dir
+// into ratings, overriding embedded values. Unreadable sidecars are
+// reported and skipped.
+func collectRatingSidecars(ctx context.Context, client *sftp.Client, dir string, entries []os.FileInfo, ratings map[string]int) {
+	sidecars := map[string]int{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(name), xmpSuffix) || ctx.Err() != nil {
+			continue
+		}
+		sidecarPath := filepath.Join(dir, name)
+		if entry.Size() > maxSidecarSize {
+			fmt.Printf("Skipping XMP sidecar %s: larger than %d bytes\n", sidecarPath, maxSidecarSize)
+			continue
+		}
+		var data []byte
+		err := sftpCall(func() error {
+			file, err := client.Open(sidecarPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			data, err = io.ReadAll(io.LimitReader(file, maxSidecarSize))
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Skipping XMP sidecar %s: %v\n", sidecarPath, err)
+			continue
+		}
+		if rating, ok := xmpRating(data); ok {
+			sidecars[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = rating
+		}
+	}
+	if len(sidecars) == 0 {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isImageFile(name) {
+			continue
+		}
+		lower := strings.ToLower(name)
+		rating, ok := sidecars[lower]
+		if !ok {
+			rating, ok = sidecars[strings.TrimSuffix(lower, filepath.Ext(lower))]
+		}
+		if ok {
+			ratings[filepath.Join(dir, name)] = rating
+		}
+	}
+}
+
+// parseMinRating reads ?min_rating=; 0 means no rating filter.
+func parseMinRating(c *gin.Context) (int, error) {
+	value := c.Query("min_rating")
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > maxRating {
+		return 0, fmt.Errorf("min_rating must be an integer between 0 and %d", maxRating)
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The server never changes anything on the NAS: it only lists
+// directories, stats files and opens them for reading. readOnlyPipe holds
+// it to that below the sftp package, on the requests themselves, so no
+// code path can get a write through by mistake.
+
+// SFTP request types (draft-ietf-secsh-filexfer-02) the server may send.
+// Everything else, such as WRITE, REMOVE, RENAME, MKDIR or SETSTAT, is
+// refused.
+var readOnlyRequests = map[byte]string{
+	1:  "INIT",
+	3:  "OPEN",
+	4:  "CLOSE",
+	5:  "READ",
+	7:  "LSTAT",
+	8:  "FSTAT",
+	11: "OPENDIR",
+	12: "READDIR",
+	16: "REALPATH",
+	17: "STAT",
+	19: "READLINK",
+}
+
+const (
+	sftpOpen = 3
+	// sftpOpenRead is SSH_FXF_READ, the only open flag allowed.
+	sftpOpenRead = 0x1
+)
+
+var errNASWriteRefused = errors.New("refused to send a write request to the NAS; this server is read-only")
+
+// readOnlyPipe is the client's side of the SFTP channel. The sftp package
+// writes each request header in one call and a WRITE's data in a second,
+// so every call that starts a request can be judged on its own, and a
+// refused one is never followed by its data.
+type readOnlyPipe struct {
+	io.WriteCloser
+}
+
+func (p readOnlyPipe) Write(b []byte) (int, error) {
+	if err := checkReadOnly(b); err != nil {
+		logger.Error("blocked a write to the NAS", "error", err)
+		recentErrors.record("sftp", "", err)
+		return 0, err
+	}
+	return p.WriteCloser.Write(b)
+}
+
+// checkReadOnly vets the request starting at b: its type must be a read,
+// and an OPEN must ask for reading only.
+func checkReadOnly(b []byte) error {
+	if len(b) < 5 {
+		return fmt.Errorf("%w: short request", errNASWriteRefused)
+	}
+	kind := b[4]
+	if _, ok := readOnlyRequests[kind]; !ok {
+		return fmt.Errorf("%w: request type %d", errNASWriteRefused, kind)
+	}
+	if kind != sftpOpen {
+		return nil
+	}
+	// OPEN is id, filename, pflags, attrs.
+	if len(b) < 13 {
+		return fmt.Errorf("%w: short OPEN request", errNASWriteRefused)
+	}
+	nameEnd := 13 + int(binary.BigEndian.Uint32(b[9:13]))
+	if nameEnd < 13 || len(b) < nameEnd+4 {
+		return fmt.Errorf("%w: short OPEN request", errNASWriteRefused)
+	}
+	if flags := binary.BigEndian.Uint32(b[nameEnd:]); flags != sftpOpenRead {
+		return fmt.Errorf("%w: OPEN %s with flags %#x", errNASWriteRefused, b[13:nameEnd], flags)
+	}
+	return nil
+}
+
+// newReadOnlyClient is sftp.NewClient with every request going through
+// readOnlyPipe.
+func newReadOnlyClient(conn *ssh.Client, options ...sftp.ClientOption) (*sftp.Client, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+	client, err := sftp.NewClientPipe(stdout, readOnlyPipe{stdin}, options...)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+// sftpRequest builds the header of an SFTP request: length, type, id and
+// then fields, each a string or a uint32.
+func sftpRequest(kind byte, fields ...any) []byte {
+	body := binary.BigEndian.AppendUint32([]byte{kind}, 7)
+	for _, field := range fields {
+		switch field := field.(type) {
+		case string:
+			body = binary.BigEndian.AppendUint32(body, uint32(len(field)))
+			body = append(body, field...)
+		case uint32:
+			body = binary.BigEndian.AppendUint32(body, field)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	const (
+		write   = 0x2
+		creat   = 0x8
+		trunc   = 0x10
+		noAttrs = uint32(0)
+	)
+	tests := []struct {
+		name    string
+		request []byte
+		allowed bool
+	}{
+		{"OPEN for reading", sftpRequest(3, "/photos/a.jpg", uint32(sftpOpenRead), noAttrs), true},
+		{"READ", sftpRequest(5, "handle", uint32(0), uint32(0), uint32(32768)), true},
+		{"STAT", sftpRequest(17, "/photos"), true},
+		{"READDIR", sftpRequest(12, "handle"), true},
+		{"CLOSE", sftpRequest(4, "handle"), true},
+		{"OPEN for writing", sftpRequest(3, "/photos/a.jpg", uint32(write|creat|trunc), noAttrs), false},
+		{"OPEN for reading and writing", sftpRequest(3, "/photos/a.jpg", uint32(sftpOpenRead|write), noAttrs), false},
+		{"OPEN without flags", sftpRequest(3, "/photos/a.jpg"), false},
+		{"OPEN with a name longer than the request", sftpRequest(3, "/photos/a.jpg")[:15], false},
+		{"WRITE", sftpRequest(6, "handle", uint32(0), uint32(0), "data"), false},
+		{"SETSTAT", sftpRequest(9, "/photos/a.jpg", uint32(0x4), uint32(0o777)), false},
+		{"FSETSTAT", sftpRequest(10, "handle", noAttrs), false},
+		{"REMOVE", sftpRequest(13, "/photos/a.jpg"), false},
+		{"MKDIR", sftpRequest(14, "/photos/new", noAttrs), false},
+		{"RENAME", sftpRequest(18, "/photos/a.jpg", "/photos/b.jpg"), false},
+		{"short header", []byte{0, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		err := checkReadOnly(tt.request)
+		switch {
+		case tt.allowed && err != nil:
+			t.Errorf("%s: refused: %v", tt.name, err)
+		case !tt.allowed && !errors.Is(err, errNASWriteRefused):
+			t.Errorf("%s: got %v, want errNASWriteRefused", tt.name, err)
+		}
+	}
+}
+
+func TestReadOnlyClientRefusesWrites(t *testing.T) {
+	nas := newTestNAS(t, 0)
+	nas.put(t, "/photos/a.jpg", []byte("original"))
+
+	if _, err := nas.client.Create("/photos/new.jpg"); !errors.Is(err, errNASWriteRefused) {
+		t.Errorf("Create: %v, want errNASWriteRefused", err)
+	}
+	if _, err := nas.admin.Stat("/photos/new.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the refused Create reached the NAS: Stat = %v", err)
+	}
+	if err := nas.client.Remove("/photos/a.jpg"); !errors.Is(err, errNASWriteRefused) {
+		t.Errorf("Remove: %v, want errNASWriteRefused", err)
+	}
+	if _, err := nas.admin.Stat("/photos/a.jpg"); err != nil {
+		t.Errorf("the refused Remove reached the NAS: %v", err)
+	}
+}
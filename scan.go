@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// SCAN_ON_STARTUP values.
+const (
+	scanAuto   = "auto"
+	scanAlways = "always"
+	scanNever  = "never"
+)
+
+// scanRoots are the NAS directories the scanner walks. Every indexed
+// directory lies under one of them.
+var scanRoots = []string{"/"}
+
+// scanExcludes are path.Match patterns for directory names the scanner
+// does not descend into (SCAN_EXCLUDE), such as Synology's @eaDir.
+var scanExcludes []string
+
+func excludedDirectory(name string) bool {
+	return slices.ContainsFunc(scanExcludes, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+func parseScanExcludes(value string) ([]string, error) {
+	var patterns []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, err := path.Match(field, ""); err != nil || strings.Contains(field, "/") {
+			return nil, fmt.Errorf("invalid directory name pattern %q", field)
+		}
+		patterns = append(patterns, field)
+	}
+	return patterns, nil
+}
+
+// indexCacheFile is where completed scans are persisted; empty disables
+// the index cache.
+var indexCacheFile string
+
+// printTree prints the directory tree to stdout as scans walk it
+// (--print-tree or SCAN_VERBOSE). Otherwise each directory is only logged
+// at debug level, and the tree can be had from /tree.
+var printTree bool
+
+// Scans log a progress line every scanProgressEvery directories
+// (SCAN_PROGRESS_EVERY), and at least every scanProgressInterval.
+var scanProgressEvery = 1000
+
+const scanProgressInterval = 10 * time.Second
+
+// logScanProgress logs a line such as "scanned 4,200 dirs, 612 with
+// images, 3.1k dirs/min".
+func logScanProgress(visited, withImages int, elapsed time.Duration) {
+	rate := float64(visited) / max(elapsed.Minutes(), 1e-9)
+	rateText := fmt.Sprintf("%.0f", rate)
+	if rate >= 1000 {
+		rateText = fmt.Sprintf("%.1fk", rate/1000)
+	}
+	logger.Info(fmt.Sprintf("scanned %s dirs, %s with images, %s dirs/min", formatCount(visited), formatCount(withImages), rateText),
+		"directories", visited, "with_images", withImages, "dirs_per_minute", int(rate))
+}
+
+// formatCount writes n with thousands separators.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// scanning is set while a scan is running so /admin/rescan requests don't
+// pile up behind one another.
+var scanning atomic.Bool
+
+var errScanInProgress = errors.New("a scan is already running")
+
+// A full scan that finishes no directory for scanStallTimeout
+// (SCAN_STALL_TIMEOUT) is aborted and restarted where it stopped, on a
+// fresh connection, up to scanStallRetries (SCAN_STALL_RETRIES) times.
+var (
+	scanStallTimeout time.Duration
+	scanStallRetries = 3
+)
+
+var errScanStalled = errors.New("scan stalled")
+
+// Background scans started by /admin/rescan. run waits for them on
+// shutdown so a cancelled scan gets to write its checkpoint.
+var (
+	backgroundScans sync.WaitGroup
+	scanCancel      struct {
+		sync.Mutex
+		cancel context.CancelFunc
+	}
+)
+
+// scanCheckpointMaxAge is how old a checkpoint may be and still be
+// resumed; anything older has probably changed on the NAS since.
+var scanCheckpointMaxAge time.Duration
+
+// scanCheckpoint is the state of a scan that was stopped early: the
+// directories it had yet to visit and what it had found in the others.
+// The next scan picks up from it instead of starting over. It is kept in
+// memory and, with an index cache, next to it on disk.
+type scanCheckpoint struct {
+	Version     int                       `json:"version"`
+	Roots       []string                  `json:"roots"`
+	StartedAt   time.Time                 `json:"started_at"`
+	SavedAt     time.Time                 `json:"saved_at"`
+	Pending     []pendingDir              `json:"pending"`
+	Directories []string                  `json:"directories,omitempty"`
+	Images      []indexedFile             `json:"images,omitempty"`
+	Dates       map[string]time.Time      `json:"dates,omitempty"`
+	Suspicious  int                       `json:"suspicious,omitempty"`
+	Tags        map[string][]string       `json:"tags,omitempty"`
+	Ratings     map[string]int            `json:"ratings,omitempty"`
+	Timeline    map[string]map[string]int `json:"timeline,omitempty"`
+}
+
+var lastCheckpoint *scanCheckpoint
+
+func scanCheckpointFile() string {
+	if indexCacheFile == "" {
+		return ""
+	}
+	return indexCacheFile + ".checkpoint"
+}
+
+// loadCheckpoint returns the checkpoint to resume from, if there is a
+// usable one.
+func loadCheckpoint() *scanCheckpoint {
+	cp := lastCheckpoint
+	if name := scanCheckpointFile(); cp == nil && name != "" {
+		data, err := os.ReadFile(name)
+		if err == nil {
+			cp = &scanCheckpoint{}
+			if err = json.Unmarshal(data, cp); err != nil {
+				fmt.Printf("Ignoring scan checkpoint %s: %v\n", name, err)
+				cp = nil
+			}
+		}
+	}
+	switch {
+	case cp == nil:
+		return nil
+	case cp.Version != indexFileVersion || !slices.Equal(cp.Roots, scanRoots):
+		fmt.Println("Ignoring scan checkpoint made for other scan roots")
+		return nil
+	case scanCheckpointMaxAge > 0 && time.Since(cp.SavedAt) > scanCheckpointMaxAge:
+		fmt.Printf("Ignoring scan checkpoint from %s ago\n", time.Since(cp.SavedAt).Round(time.Second))
+		return nil
+	}
+	return cp
+}
+
+func saveCheckpoint(cp *scanCheckpoint) {
+	lastCheckpoint = cp
+	if name := scanCheckpointFile(); name != "" {
+		if err := writeJSONFile(name, cp); err != nil {
+			fmt.Printf("Warning: failed to write scan checkpoint: %v\n", err)
+		}
+	}
+}
+
+func clearCheckpoint() {
+	lastCheckpoint = nil
+	if name := scanCheckpointFile(); name != "" {
+		os.Remove(name)
+	}
+}
+
+// cancelScan stops the running scan, if any, at the next directory.
+func cancelScan() bool {
+	scanCancel.Lock()
+	defer scanCancel.Unlock()
+	if scanCancel.cancel == nil {
+		return false
+	}
+	scanCancel.cancel()
+	return true
+}
+
+// scanIndex walks the NAS and installs the result as the directory index.
+// A complete scan is also written to the index cache. A scan stopped by
+// ctx or the timeout leaves a checkpoint that the next scan resumes from.
+func scanIndex(ctx context.Context, client *sftp.Client, timeout time.Duration) error {
+	if !scanning.CompareAndSwap(false, true) {
+		return errScanInProgress
+	}
+	defer scanning.Store(false)
+	subtreeScans.Lock()
+	subtrees := len(subtreeScans.running)
+	subtreeScans.Unlock()
+	if subtrees > 0 {
+		return errSubtreeScanRunning
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	scanCancel.Lock()
+	scanCancel.cancel = cancel
+	scanCancel.Unlock()
+	defer func() {
+		scanCancel.Lock()
+		scanCancel.cancel = nil
+		scanCancel.Unlock()
+	}()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	startedAt := start
+	result := newScanResult()
+	var pending []pendingDir
+	if cp := loadCheckpoint(); cp != nil {
+		startedAt = cp.StartedAt
+		pending = cp.Pending
+		result.dirs, result.images = cp.Directories, cp.Images
+		result.suspicious = cp.Suspicious
+		maps.Copy(result.dates, cp.Dates)
+		maps.Copy(result.tags, cp.Tags)
+		maps.Copy(result.ratings, cp.Ratings)
+		maps.Copy(result.months, cp.Timeline)
+		logger.Info("resuming scan from checkpoint", "pending", len(pending), "with_images", len(result.dirs))
+	} else {
+		pending = rootsPending()
+	}
+	err := walkWithWatchdog(ctx, client, &pending, result)
+
+	stats := scanStats{duration: time.Since(start), failed: result.failed}
+	added, removed := imageIndex.replace(result.dirs, result.images, err == nil, stats)
+	if err == nil {
+		creationDates.replace(result.dates, result.suspicious)
+		imageTags.replace(result.tags)
+		imageRatings.replace(result.ratings)
+		imageTimeline.replace(result.months)
+	}
+	if isContextError(err) {
+		saveCheckpoint(&scanCheckpoint{
+			Version:     indexFileVersion,
+			Roots:       scanRoots,
+			StartedAt:   startedAt,
+			SavedAt:     time.Now(),
+			Pending:     pending,
+			Directories: result.dirs,
+			Images:      result.images,
+			Dates:       result.dates,
+			Suspicious:  result.suspicious,
+			Tags:        result.tags,
+			Ratings:     result.ratings,
+			Timeline:    result.months,
+		})
+		logger.Warn("scan stopped early; serving the directories indexed so far, the next scan resumes from here", "reason", err, "pending", len(pending))
+	} else {
+		clearCheckpoint()
+	}
+	if err != nil && !isContextError(err) {
+		logger.Error("scan failed", "error", err)
+		recentErrors.record("scan", "", err)
+	}
+	logSummary("scan finished", "duration", time.Since(start).Round(time.Millisecond), "with_images", imageIndex.len(),
+		"added", added, "removed", removed, "suspicious_dates", result.suspicious)
+
+	if err == nil {
+		saveIndexCache()
+	}
+	return err
+}
+
+// rootsPending is the stack a fresh scan starts from, so that the roots
+// are walked in order.
+func rootsPending() []pendingDir {
+	var pending []pendingDir
+	for i := len(scanRoots) - 1; i >= 0; i-- {
+		pending = append(pending, pendingDir{Path: scanRoots[i]})
+	}
+	return pending
+}
+
+// walkWithWatchdog is walkDirectories restarted whenever it stalls. Once
+// the restarts run out the error wraps both errScanStalled and
+// context.Canceled, so the scan stops early and leaves a checkpoint.
+func walkWithWatchdog(ctx context.Context, client *sftp.Client, pending *[]pendingDir, result *scanResult) error {
+	if scanStallTimeout <= 0 {
+		return walkDirectories(ctx, client, pending, result)
+	}
+	for restarts := 0; ; restarts++ {
+		err := walkWatched(ctx, client, pending, result)
+		if !errors.Is(err, errScanStalled) {
+			return err
+		}
+		stuck := ""
+		if len(*pending) > 0 {
+			stuck = (*pending)[len(*pending)-1].Path
+		}
+		if restarts == scanStallRetries {
+			logger.Error("scan stalled, giving up", "directory", stuck, "restarts", restarts)
+			return err
+		}
+		logger.Warn("scan stalled, restarting", "directory", stuck, "stalled_for", scanStallTimeout,
+			"restart", restarts+1, "max_restarts", scanStallRetries, "directories", result.visited.Load())
+		// Whatever hung is stuck on the old session; the connection
+		// manager reconnects, as it does after an SFTP timeout.
+		recordSFTPResult(fmt.Errorf("scan of %s: %w after %s", stuck, errSFTPTimeout, scanStallTimeout))
+		if client, err = awaitClient(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// walkWatched runs walkDirectories, cancelling it with errScanStalled
+// when result.visited stops moving for scanStallTimeout.
+func walkWatched(ctx context.Context, client *sftp.Client, pending *[]pendingDir, result *scanResult) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		ticker := time.NewTicker(max(scanStallTimeout/10, 10*time.Millisecond))
+		defer ticker.Stop()
+		last, since := result.visited.Load(), time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if visited := result.visited.Load(); visited != last {
+					last, since = visited, now
+				} else if now.Sub(since) >= scanStallTimeout {
+					cancel(errScanStalled)
+					return
+				}
+			}
+		}
+	}()
+	err := walkDirectories(ctx, client, pending, result)
+	if isContextError(err) && errors.Is(context.Cause(ctx), errScanStalled) {
+		return fmt.Errorf("%w: %w", errScanStalled, err)
+	}
+	return err
+}
+
+// awaitClient waits for the connection manager to have a client again.
+func awaitClient(ctx context.Context) (*sftp.Client, error) {
+	for {
+		client, err := nasConn.client()
+		if err == nil {
+			return client, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(max(nasConn.retryAfter(), 100*time.Millisecond)):
+		}
+	}
+}
+
+// saveIndexCache writes the live index to the index cache, if enabled.
+func saveIndexCache() {
+	if indexCacheFile == "" {
+		return
+	}
+	if err := writeIndexFile(indexCacheFile, imageIndex.export()); err != nil {
+		fmt.Printf("Warning: failed to write index cache: %v\n", err)
+	}
+}
+
+// underScanRoot reports whether dir is one of scanRoots or below one.
+func underScanRoot(dir string) bool {
+	return slices.ContainsFunc(scanRoots, func(root string) bool { return underDirectory(dir, root) })
+}
+
+// outermostDirectories cleans and sorts dirs, keeping only those not
+// inside another. The rest, duplicates included, are returned as nested.
+func outermostDirectories(dirs []string) (kept, nested []string) {
+	cleaned := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		cleaned = append(cleaned, path.Clean(dir))
+	}
+	slices.Sort(cleaned)
+	for _, dir := range cleaned {
+		if slices.ContainsFunc(kept, func(k string) bool { return underDirectory(dir, k) }) {
+			nested = append(nested, dir)
+			continue
+		}
+		kept = append(kept, dir)
+	}
+	return kept, nested
+}
+
+// underDirectory reports whether p is root or lies below it.
+func underDirectory(p, root string) bool {
+	return root == "/" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// loadIndexCache decides from mode and the index cache whether startup
+// needs a scan, installing the cached index when it does not.
+func loadIndexCache(mode string, maxAge time.Duration) (needScan bool) {
+	if mode == scanAlways || indexCacheFile == "" {
+		return true
+	}
+
+	cached, err := readIndexFile(indexCacheFile)
+	if err != nil {
+		if mode == scanNever {
+			fmt.Printf("Warning: no usable index cache (%v); starting with an empty index until /admin/rescan\n", err)
+			return false
+		}
+		fmt.Printf("No usable index cache (%v), scanning\n", err)
+		return true
+	}
+
+	age := time.Since(cached.ScannedAt).Round(time.Second)
+	if mode == scanAuto && age > maxAge {
+		fmt.Printf("Index cache is %s old (INDEX_MAX_AGE=%s), scanning\n", age, maxAge)
+		return true
+	}
+	imageIndex.restore(cached)
+	fmt.Printf("Loaded index cache %s: %d directories with images, scanned %s ago\n", indexCacheFile, len(cached.Directories), age)
+	return false
+}
+
+// rescan starts a scan in the background, of everything or with ?dir= of
+// one subtree. It stops when ctx is cancelled, which happens when the
+// server shuts down.
+func rescan(ctx context.Context, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := nasConn.client()
+		if err != nil {
+			respondSFTPError(c, "", err)
+			return
+		}
+		if _, ok := c.GetQuery("dir"); ok {
+			rescanSubtree(ctx, c, client, timeout)
+			return
+		}
+		if scanning.Load() {
+			c.JSON(http.StatusConflict, gin.H{"error": errScanInProgress.Error()})
+			return
+		}
+		subtreeScans.Lock()
+		subtrees := len(subtreeScans.running)
+		subtreeScans.Unlock()
+		if subtrees > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": errSubtreeScanRunning.Error()})
+			return
+		}
+		backgroundScans.Add(1)
+		go func() {
+			defer backgroundScans.Done()
+			err := scanIndex(ctx, client, timeout)
+			if errors.Is(err, errScanInProgress) || errors.Is(err, errSubtreeScanRunning) {
+				fmt.Println("Rescan skipped: " + err.Error())
+			}
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"status": "scan started"})
+	}
+}
+
+// cancelRescan stops the running scan at the next directory, keeping a
+// checkpoint for the next one. With ?dir= it stops that subtree scan.
+func cancelRescan(c *gin.Context) {
+	if dir, ok := c.GetQuery("dir"); ok {
+		if !cancelSubtreeScan(dir) {
+			c.JSON(http.StatusConflict, gin.H{"error": "no scan of " + dir + " is running"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "scan cancelling", "dir": path.Clean(dir)})
+		return
+	}
+	if !cancelScan() {
+		c.JSON(http.StatusConflict, gin.H{"error": "no scan is running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": "scan cancelling"})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// scanCommand runs "scan": one scan of the NAS with the server's
+// configuration, printing what would be indexed instead of serving it.
+// The server's index cache and checkpoint are left alone. It returns the
+// exit status, which is 1 if the scan failed or found no directory with
+// images.
+func scanCommand(args []string) int {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	var roots, excludes stringList
+	flags.Var(&roots, "root", "directory to scan instead of SCAN_ROOT (repeatable)")
+	flags.Var(&excludes, "exclude", "directory name pattern to skip, on top of SCAN_EXCLUDE (repeatable)")
+	out := flags.String("out", "", "write the index as JSON to this file, or - for stdout")
+	quiet := flags.Bool("quiet", false, "log only warnings, errors and the summary (LOG_LEVEL=warn)")
+	printTreeFlag := flags.Bool("print-tree", false, "print the directory tree while scanning (SCAN_VERBOSE=true)")
+	flags.Parse(args)
+
+	stdout := os.Stdout
+	if *out == "-" {
+		// Everything else goes to stderr so stdout is just the index.
+		os.Stdout = os.Stderr
+	}
+	cfg := mustLoadConfig()
+	if len(roots) > 0 {
+		for _, root := range roots {
+			if !path.IsAbs(root) {
+				fmt.Printf("Invalid --root %q: not an absolute path\n", root)
+				return 2
+			}
+		}
+		cfg.scanRoots, cfg.nestedScanRoots = outermostDirectories(roots)
+	}
+	extra, err := parseScanExcludes(strings.Join(excludes, ","))
+	if err != nil {
+		fmt.Println("Invalid --exclude:", err)
+		return 2
+	}
+	cfg.scanExcludes = append(cfg.scanExcludes, extra...)
+	if *quiet {
+		cfg.logLevel = slog.LevelWarn
+	}
+	if *printTreeFlag {
+		cfg.printTree = true
+	}
+	fmt.Println(cfg.summary())
+
+	logger = newLogger(cfg.logFormat, cfg.logLevel)
+	applyConfig(cfg)
+	if err := connectNAS(cfg); err != nil {
+		fmt.Println("Error:", err)
+		return exitCode(err)
+	}
+	defer nasConn.close()
+	client, err := nasConn.client()
+	if err != nil {
+		fmt.Println("Error: creating SFTP client:", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.scanTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.scanTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result := newScanResult()
+	pending := rootsPending()
+	err = walkWithWatchdog(ctx, client, &pending, result)
+	index := result.indexFile()
+	fmt.Printf("Scanned %s directories in %s: %s with images, %s images, %d files with suspicious dates\n",
+		formatCount(int(result.visited.Load())), time.Since(start).Round(time.Millisecond),
+		formatCount(len(index.Directories)), formatCount(len(index.Images)), index.SuspiciousDates)
+	if err != nil {
+		fmt.Println("Error: scan incomplete:", err)
+		return 1
+	}
+
+	switch *out {
+	case "":
+	case "-":
+		data, err := json.MarshalIndent(index, "", "  ")
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		stdout.Write(append(data, '\n'))
+	default:
+		if err := writeIndexFile(*out, index); err != nil {
+			fmt.Println("Error: writing index:", err)
+			return 1
+		}
+		fmt.Println("Index written to " + *out)
+	}
+	if len(index.Directories) == 0 {
+		fmt.Println("No directories with images found")
+		return 1
+	}
+	return 0
+}
+
+// indexFile is r in the form of the index cache, numbered as a complete
+// scan would number it.
+func (r *scanResult) indexFile() indexFile {
+	files := sortedFiles(r.images)
+	return indexFile{
+		Version:         indexFileVersion,
+		ScannedAt:       time.Now(),
+		Directories:     normalizeDirectories(r.dirs),
+		CreationDates:   r.dates,
+		SuspiciousDates: r.suspicious,
+		Tags:            r.tags,
+		Ratings:         r.ratings,
+		Timeline:        r.months,
+		Images:          filePaths(files),
+		Generation:      1,
+		Files:           files,
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// imageTypeGroups maps the semantic ?type= groups onto file extensions.
+var imageTypeGroups = map[string][]string{
+	"photo":    {".jpg", ".jpeg", ".png", ".webp", ".bmp", ".tiff", ".tif"},
+	"vector":   {".svg"},
+	"animated": {".gif"},
+}
+
+// selectionFilter narrows the images random selection may pick from.
+type selectionFilter struct {
+	typeGroup  string
+	extensions map[string]bool
+	excluded   map[string]bool
+	ext        string
+	excludeExt string
+	match      string
+	minWidth   int
+	minHeight  int
+	tag        string
+	minRating  int
+	// period is the ?year=&month= prefix of the months to pick from.
+	period string
+}
+
+func parseSelectionFilter(c *gin.Context) (selectionFilter, error) {
+	var f selectionFilter
+	if group := strings.ToLower(c.Query("type")); group != "" {
+		exts, ok := imageTypeGroups[group]
+		if !ok {
+			return f, fmt.Errorf("unsupported type %q (supported: photo, vector, animated)", group)
+		}
+		f.typeGroup = group
+		f.extensions = map[string]bool{}
+		for _, ext := range exts {
+			f.extensions[ext] = true
+		}
+	}
+	if f.ext = c.Query("ext"); f.ext != "" {
+		exts, err := parseExtensionList("ext", f.ext)
+		if err != nil {
+			return f, err
+		}
+		if f.extensions == nil {
+			f.extensions = exts
+		} else {
+			for ext := range f.extensions {
+				f.extensions[ext] = exts[ext]
+			}
+		}
+	}
+	if f.excludeExt = c.Query("exclude_ext"); f.excludeExt != "" {
+		exts, err := parseExtensionList("exclude_ext", f.excludeExt)
+		if err != nil {
+			return f, err
+		}
+		f.excluded = exts
+	}
+	f.match = strings.TrimSpace(c.Query("match"))
+
+	var err error
+	if f.tag, err = parseTagParam(c); err != nil {
+		return f, err
+	}
+	if f.minRating, err = parseMinRating(c); err != nil {
+		return f, err
+	}
+	if f.period, err = parsePeriod(c); err != nil {
+		return f, err
+	}
+	if f.minWidth, err = parseMinDimension(c, "min_width", minImageWidth); err != nil {
+		return f, err
+	}
+	if f.minHeight, err = parseMinDimension(c, "min_height", minImageHeight); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// parseMinDimension reads a resolution filter; min_width=0 turns off a
+// server default.
+func parseMinDimension(c *gin.Context, name string, defaultValue int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// parseExtensionList parses a comma-separated list such as "jpg,.png" into
+// a set of dotted, lower-case extensions, rejecting any that are not served.
+func parseExtensionList(param, value string) (map[string]bool, error) {
+	exts := map[string]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		ext := "." + strings.TrimPrefix(field, ".")
+		if !slices.Contains(imageExts, ext) {
+			return nil, fmt.Errorf("unsupported %s %q (supported: %s)", param, field, strings.Join(imageExts, ", "))
+		}
+		exts[ext] = true
+	}
+	if len(exts) == 0 {
+		return nil, fmt.Errorf("%s must list at least one extension", param)
+	}
+	return exts, nil
+}
+
+// directories narrows the candidate directories to those whose path
+// contains the ?match= keyword, ignoring case, and that hold an image
+// with the ?tag= tag, one rated at least ?min_rating= and one taken in the
+// ?year=&month= period.
+func (f selectionFilter) directories(dirs []string) []string {
+	if f.match == "" && f.tag == "" && f.minRating == 0 && f.period == "" {
+		return dirs
+	}
+	keyword := strings.ToLower(f.match)
+	var tagged, rated, dated map[string]bool
+	if f.tag != "" {
+		tagged = imageTags.directories(f.tag)
+	}
+	if f.minRating > 0 {
+		rated = imageRatings.directories(f.minRating)
+	}
+	if f.period != "" {
+		dated = imageTimeline.directories(f.period)
+	}
+	var matched []string
+	for _, dir := range dirs {
+		if !strings.Contains(strings.ToLower(dir), keyword) || tagged != nil && !tagged[dir] || rated != nil && !rated[dir] || dated != nil && !dated[dir] {
+			continue
+		}
+		matched = append(matched, dir)
+	}
+	return matched
+}
+
+func (f selectionFilter) active() bool {
+	return f.extensions != nil || f.excluded != nil || f.needsDimensions() || f.tag != "" || f.minRating > 0 || f.period != ""
+}
+
+// needsDimensions reports whether matching requires reading image headers.
+func (f selectionFilter) needsDimensions() bool {
+	return f.minWidth > 0 || f.minHeight > 0
+}
+
+// matches applies the filters that need only the directory entry. SVGs
+// have no intrinsic pixel size and never pass a resolution filter.
+func (f selectionFilter) matches(info ImageInfo) bool {
+	ext := strings.ToLower(filepath.Ext(info.Path))
+	if f.extensions != nil && !f.extensions[ext] {
+		return false
+	}
+	if f.needsDimensions() && ext == ".svg" {
+		return false
+	}
+	if f.tag != "" && !imageTags.has(info.Path, f.tag) {
+		return false
+	}
+	if rating, _ := imageRatings.of(info.Path); rating < f.minRating {
+		return false
+	}
+	if f.period != "" && !strings.HasPrefix(monthOf(info.CreationDate), f.period) {
+		return false
+	}
+	return !f.excluded[ext]
+}
+
+func (f selectionFilter) largeEnough(dims imageDimensions) bool {
+	return dims.width >= f.minWidth && dims.height >= f.minHeight && dims.width > 0
+}
+
+func (f selectionFilter) String() string {
+	var parts []string
+	if f.typeGroup != "" {
+		parts = append(parts, "type="+f.typeGroup)
+	}
+	if f.ext != "" {
+		parts = append(parts, "ext="+f.ext)
+	}
+	if f.excludeExt != "" {
+		parts = append(parts, "exclude_ext="+f.excludeExt)
+	}
+	if f.minWidth > 0 {
+		parts = append(parts, fmt.Sprintf("min_width=%d", f.minWidth))
+	}
+	if f.minHeight > 0 {
+		parts = append(parts, fmt.Sprintf("min_height=%d", f.minHeight))
+	}
+	if f.tag != "" {
+		parts = append(parts, "tag="+f.tag)
+	}
+	if f.minRating > 0 {
+		parts = append(parts, fmt.Sprintf("min_rating=%d", f.minRating))
+	}
+	if f.period != "" {
+		parts = append(parts, "taken="+f.period)
+	}
+	return strings.Join(parts, " ")
+}
+
+// directoryWeights multiplies the selection probability of directories
+// whose path has a matching component, from DIRECTORY_WEIGHTS.
+var directoryWeights map[string]float64
+
+// parseDirectoryWeights parses "2024-Japan:5,misc:0.2". A name is either a
+// single path component, matching that folder and everything below it, or
+// an absolute path prefix.
+func parseDirectoryWeights(value string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(field, ":")
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, "/") {
+			name = path.Clean(name)
+		} else if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("%q must be a single folder name or an absolute path", name)
+		}
+		if !ok || name == "" || name == "/" {
+			return nil, fmt.Errorf("invalid entry %q, want name:weight", field)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if err != nil || !(w > 0) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("weight for %s must be a positive number", name)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
+
+// directoryWeight is the configured weight of the deepest match for dir,
+// or 1 when nothing matches.
+func directoryWeight(dir string) float64 {
+	weight := 1.0
+	depth := -1
+	components := strings.Split(strings.Trim(dir, "/"), "/")
+	for name, w := range directoryWeights {
+		d := -1
+		if strings.HasPrefix(name, "/") {
+			if dir == name || strings.HasPrefix(dir, name+"/") {
+				d = strings.Count(name, "/") - 1
+			}
+		} else {
+			for i, component := range components {
+				if component == name {
+					d = i
+				}
+			}
+		}
+		if d > depth {
+			weight, depth = w, d
+		}
+	}
+	return weight
+}
+
+// pickDirectory returns the index of a random entry of dirs, weighted by
+// DIRECTORY_WEIGHTS.
+func pickDirectory(dirs []string) int {
+	if len(directoryWeights) == 0 {
+		return rand.Intn(len(dirs))
+	}
+	cumulative := make([]float64, len(dirs))
+	total := 0.0
+	for i, dir := range dirs {
+		total += directoryWeight(dir)
+		cumulative[i] = total
+	}
+	i, _ := slices.BinarySearch(cumulative, rand.Float64()*total)
+	return min(i, len(dirs)-1)
+}
+
+// recencyHalfLife is RECENCY_BIAS: when set, an image is half as likely to
+// be picked as one recencyHalfLife newer. The bias applies among the images
+// of the directory being picked from; which directory that is stays up to
+// DIRECTORY_WEIGHTS, so the two multiply rather than compete.
+var recencyHalfLife time.Duration
+
+func recencyWeight(info ImageInfo, now time.Time) float64 {
+	age := max(now.Sub(info.CreationDate), 0)
+	return math.Exp2(-age.Hours() / recencyHalfLife.Hours())
+}
+
+// imageOrder is the order in which pickImage tries images: uniformly
+// random, or a weighted random permutation under RECENCY_BIAS.
+func imageOrder(images []ImageInfo) []int {
+	if recencyHalfLife <= 0 {
+		return rand.Perm(len(images))
+	}
+	now := time.Now()
+	keys := make([]float64, len(images))
+	order := make([]int, len(images))
+	for i, image := range images {
+		// Efraimidis-Spirakis: sorting by u^(1/w) descending samples
+		// without replacement in proportion to w. Logs keep tiny
+		// weights from underflowing.
+		keys[i] = math.Log(rand.Float64()) / max(recencyWeight(image, now), math.SmallestNonzeroFloat64)
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(keys[b], keys[a])
+	})
+	return order
+}
+
+// pickImage returns a random entry of images that passes the resolution
+// filter, reading headers for at most maxDimensionProbes images per
+// request in total.
+func pickImage(c *gin.Context, client *sftp.Client, images []ImageInfo, filter selectionFilter, probes *int) (ImageInfo, bool, error) {
+	if len(images) == 0 {
+		return ImageInfo{}, false, nil
+	}
+	order := imageOrder(images)
+	if !filter.needsDimensions() {
+		return images[order[0]], true, nil
+	}
+	for _, n := range order {
+		if *probes >= maxDimensionProbes {
+			break
+		}
+		readStart := time.Now()
+		dims, cached, err := readDimensions(client, images[n])
+		if !cached {
+			*probes++
+			recordStage(c, stageSFTP, readStart)
+		}
+		if err != nil {
+			return ImageInfo{}, false, err
+		}
+		if filter.largeEnough(dims) {
+			return images[n], true, nil
+		}
+	}
+	return ImageInfo{}, false, nil
+}
+
+// selectRandomImage picks a random directory from candidates and a random
+// matching image within it, preferring images not recently served. When a
+// directory has nothing suitable another one is tried, up to
+// maxSelectionAttempts times. On failure the error response has already
+// been written.
+func selectRandomImage(c *gin.Context, client *sftp.Client, candidates []string, filter selectionFilter) (ImageInfo, bool) {
+	candidates = slices.Clone(candidates)
+	var fallback *ImageInfo
+	probes := 0
+	for attempt := 0; attempt < maxSelectionAttempts && len(candidates) > 0; attempt++ {
+		i := pickDirectory(candidates)
+		randomDir := candidates[i]
+
+		c.Set(nasPathKey, randomDir)
+		var entries []os.FileInfo
+		readStart := time.Now()
+		_, span := startSpan(c.Request.Context(), "sftp.readdir", pathAttr(randomDir))
+		err := sftpCall(func() (err error) {
+			entries, err = readImageDir(client, randomDir)
+			return err
+		})
+		span.SetAttributes(attribute.Int("entries", len(entries)))
+		endSpan(span, err)
+		recordStage(c, stageSFTP, readStart, phaseReadDir)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since the last scan: forget it and pick again.
+			imageIndex.remove(randomDir)
+			candidates = slices.Delete(candidates, i, i+1)
+			continue
+		}
+		if err != nil {
+			respondSFTPError(c, "Failed to read directory: ", err)
+			return ImageInfo{}, false
+		}
+
+		var images, fresh []ImageInfo
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(entry.Name()) {
+				continue
+			}
+			imagePath := joinImagePath(randomDir, entry.Name())
+			image := ImageInfo{
+				Path:         imagePath,
+				CreationDate: creationDate(imagePath, entry.ModTime()),
+				Size:         entry.Size(),
+			}
+			if !filter.matches(image) || verification.isQuarantined(image) {
+				continue
+			}
+			images = append(images, image)
+			if !globalHistory.contains(image.Path) {
+				fresh = append(fresh, image)
+			}
+		}
+
+		image, ok, err := pickImage(c, client, fresh, filter, &probes)
+		if err != nil {
+			respondSFTPError(c, "Failed to read image header: ", err)
+			return ImageInfo{}, false
+		}
+		if ok {
+			return image, true
+		}
+		if fallback == nil {
+			image, ok, err = pickImage(c, client, images, filter, &probes)
+			if err != nil {
+				respondSFTPError(c, "Failed to read image header: ", err)
+				return ImageInfo{}, false
+			}
+			if ok {
+				fallback = &image
+			}
+		}
+		if len(images) == 0 {
+			// Nothing here passes the filters; don't pick it again.
+			candidates = slices.Delete(candidates, i, i+1)
+		}
+	}
+
+	if fallback != nil {
+		return *fallback, true
+	}
+	if filter.active() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No images matching " + filter.String() + " found"})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No images found in selected directory"})
+	}
+	return ImageInfo{}, false
+}
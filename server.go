@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// draining is set once a shutdown signal arrives. While draining the server
+// keeps handling requests but reports itself unhealthy so a load balancer
+// stops routing new traffic here.
+var draining atomic.Bool
+
+// shuttingDown is closed when the servers start shutting down, so long
+// polls answer instead of holding the shutdown up.
+var shuttingDown = make(chan struct{})
+
+// listenAddresses are the addresses the server actually bound, which
+// differ from the configured ones when SERVER_PORT includes 0.
+var listenAddresses atomic.Value
+
+// listen binds host:port. The network is picked from the host so that
+// 0.0.0.0 means IPv4 only and :: means dual-stack, matching what the
+// operator wrote rather than Go's default of treating both as dual-stack.
+func listen(host, port string) (net.Listener, error) {
+	network := "tcp"
+	if addr, err := netip.ParseAddr(host); err == nil {
+		switch {
+		case addr.Is4():
+			network = "tcp4"
+		case addr.IsUnspecified():
+			network = "tcp"
+		default:
+			network = "tcp6"
+		}
+	}
+	return net.Listen(network, net.JoinHostPort(host, port))
+}
+
+// listenUnix binds a unix domain socket at path, replacing a stale socket
+// left behind by a previous run. Anything other than a socket at path is
+// left alone and reported as an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// writePortFile records the bound ports, one per line, for test harnesses
+// that start the server with SERVER_PORT=0.
+func writePortFile(path string, listeners []net.Listener) error {
+	var ports strings.Builder
+	for _, listener := range listeners {
+		ports.WriteString(strconv.Itoa(listener.Addr().(*net.TCPAddr).Port) + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(ports.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// httpTimeouts guard against clients that trickle requests in or never
+// read their responses. Zero disables a timeout. The write timeout covers
+// buffered responses; streamed originals clear it, see streamImage.
+type httpTimeouts struct {
+	readHeader time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// httpTuning shapes the servers beyond their timeouts. With a certificate
+// the servers speak TLS and negotiate HTTP/2 over ALPN; without one, h2c
+// adds prior-knowledge HTTP/2 on plaintext for a proxy in front that
+// multiplexes many small fetches over one connection.
+type httpTuning struct {
+	certificate          *tls.Certificate
+	h2c                  bool
+	maxHeaderBytes       int
+	maxConcurrentStreams int
+}
+
+func newHTTPServer(handler http.Handler, timeouts httpTimeouts, tuning httpTuning) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.readHeader,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+		MaxHeaderBytes:    tuning.maxHeaderBytes,
+		Protocols:         protocols,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: tuning.maxConcurrentStreams},
+	}
+	if tuning.certificate != nil {
+		protocols.SetHTTP2(true)
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*tuning.certificate}, MinVersion: tls.VersionTLS12}
+	} else if tuning.h2c {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// serve runs one server per listener, all sharing handler, until
+// SIGINT/SIGTERM. On the first signal the servers drain for drainTimeout (a
+// second signal cuts the drain short), then stop accepting connections and
+// wait up to shutdownTimeout for in-flight requests to finish. If any
+// server fails the others are shut down too.
+func serve(handler http.Handler, listeners []net.Listener, timeouts httpTimeouts, tuning httpTuning, drainTimeout, shutdownTimeout time.Duration) error {
+	servers := make([]*http.Server, len(listeners))
+	serveErr := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		servers[i] = newHTTPServer(handler, timeouts, tuning)
+		go func() {
+			if tuning.certificate != nil {
+				serveErr <- servers[i].ServeTLS(listener, "", "")
+				return
+			}
+			serveErr <- servers[i].Serve(listener)
+		}()
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var failed error
+	select {
+	case failed = <-serveErr:
+	case sig := <-signals:
+		fmt.Printf("Received %s, shutting down\n", sig)
+	}
+
+	if failed == nil && drainTimeout > 0 {
+		draining.Store(true)
+		fmt.Printf("Draining for %s before shutdown\n", drainTimeout)
+		select {
+		case <-time.After(drainTimeout):
+		case sig := <-signals:
+			fmt.Printf("Received %s, ending drain early\n", sig)
+		case failed = <-serveErr:
+		}
+	}
+
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrs[i] = srv.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	if err := errors.Join(shutdownErrs...); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	for range servers {
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestH2CMultiplexesThumbnails(t *testing.T) {
+	const fetches = 60
+	useEmptyIndex(t)
+	nas := newTestNAS(t, 0)
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatal(err)
+	}
+	nas.put(t, "/photos/2024-Japan/a.png", photo.Bytes())
+	if err := scanIndex(context.Background(), nas.client, 0); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *testConfig
+	cfg.maxConcurrentPerIP = fetches
+	router, err := newRouter(t.Context(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every thumbnail request waits for all of them to arrive, which one
+	// connection only allows if they share it as concurrent streams.
+	var arrived sync.WaitGroup
+	arrived.Add(fetches)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("request arrived over %s", r.Proto)
+		}
+		if strings.HasPrefix(r.URL.Path, "/image/") {
+			arrived.Done()
+			arrived.Wait()
+		}
+		router.ServeHTTP(w, r)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(handler, httpTimeouts{readHeader: 5 * time.Second}, httpTuning{h2c: true, maxConcurrentStreams: 250})
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	var dials atomic.Int32
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	// The page itself opens the connection the thumbnails then share.
+	base := "http://" + listener.Addr().String()
+	resp, err := client.Get(base + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	thumbnail := base + "/image/" + base64.RawURLEncoding.EncodeToString([]byte("/photos/2024-Japan/a.png")) + "?w=16"
+	var wg sync.WaitGroup
+	for range fetches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(thumbnail)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d: %s", resp.StatusCode, body)
+				return
+			}
+			thumb, err := png.DecodeConfig(bytes.NewReader(body))
+			if err != nil || thumb.Width != 16 {
+				t.Errorf("thumbnail %dx%d, %v; want 16 wide", thumb.Width, thumb.Height, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := dials.Load(); n != 1 {
+		t.Errorf("%d fetches took %d connections, want 1", fetches, n)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sharedLinkKey = "sharedLink"
+
+// defaultShareTTL is how long a share link lasts without ?ttl=.
+const defaultShareTTL = 24 * time.Hour
+
+// shareSigner signs and checks the links handed out by /image/:id/share.
+// A link names one pinned image version and an expiry, and stands in for
+// the bearer token on GET and HEAD /image/:id only.
+type shareSigner struct {
+	secret []byte
+	// keyID is a fingerprint of the secret carried in every link, so a link
+	// made before SHARE_SECRET was rotated can be told apart from a forged
+	// one in the logs.
+	keyID  string
+	maxTTL time.Duration
+}
+
+func newShareSigner(secret string, maxTTL time.Duration) *shareSigner {
+	sum := sha256.Sum256([]byte(secret))
+	return &shareSigner{secret: []byte(secret), keyID: hex.EncodeToString(sum[:4]), maxTTL: maxTTL}
+}
+
+func (s *shareSigner) sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(s.keyID + "\n" + id + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// middleware lets a request with a valid share link through to
+// /image/:id without a token. Signatures on any other route are ignored,
+// so the usual authentication still applies there.
+func (s *shareSigner) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sig := c.Query("sig")
+		if sig == "" || c.FullPath() != "/image/:id" || c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Next()
+			return
+		}
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid share link"})
+			return
+		}
+		if time.Now().Unix() > expires {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Share link has expired"})
+			return
+		}
+		if key := c.Query("key"); key != s.keyID {
+			logger.Info("rejected share link signed with another SHARE_SECRET; links made before a rotation no longer work",
+				"key", key, "current_key", s.keyID)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Share link is no longer valid"})
+			return
+		}
+		if !hmac.Equal([]byte(sig), []byte(s.sign(c.Param("id"), expires))) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid share link signature"})
+			return
+		}
+		c.Set(sharedLinkKey, true)
+		c.Next()
+	}
+}
+
+// share handles GET /image/:id/share, returning a link to the current
+// version of the image that works without a token until ?ttl= has passed.
+// Transform parameters may be added to the link; they are not signed.
+func (s *shareSigner) share(c *gin.Context) {
+	ttl := defaultShareTTL
+	if value := c.Query("ttl"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 || ttl > s.maxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a duration between 1s and " + s.maxTTL.String()})
+			return
+		}
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	info, _, ok := lookupImage(c, client)
+	if !ok {
+		return
+	}
+
+	id := imageID(info)
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{"expires": {strconv.FormatInt(expires, 10)}, "key": {s.keyID}, "sig": {s.sign(id, expires)}}
+	link := "/image/" + id + "?" + query.Encode()
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":         id,
+		"path":       link,
+		"url":        scheme + "://" + c.Request.Host + link,
+		"expires_at": time.Unix(expires, 0).UTC(),
+	})
+}
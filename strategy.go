@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// Selection strategies (STRATEGY, or ?strategy= per request).
+const (
+	strategyRandom      = "random"
+	strategySequential  = "sequential"
+	strategyShuffleOnce = "shuffle-once"
+)
+
+var strategies = []string{strategyRandom, strategySequential, strategyShuffleOnce}
+
+// selectionStrategy is the server default.
+var selectionStrategy = strategyRandom
+
+// maxWalkSessions bounds how many sessions keep a position; the least
+// recently used one is forgotten first.
+const maxWalkSessions = 10_000
+
+// walkSession is one client's place in a sequential or shuffled walk
+// through the numbered images of the last complete scan.
+type walkSession struct {
+	strategy   string
+	generation int
+	position   int
+	// last is the path served last, so a sequential walk carries on from
+	// there after a rescan renumbers the images.
+	last string
+	used time.Time
+}
+
+// walks holds the sessions and the shuffled order, which is drawn once
+// per scan generation and shared by every session, each starting at a
+// random point in it.
+var walks = struct {
+	sync.Mutex
+	sessions   map[string]*walkSession
+	generation int
+	shuffled   []int32
+}{sessions: map[string]*walkSession{}}
+
+func parseStrategy(c *gin.Context) (string, error) {
+	strategy := c.DefaultQuery("strategy", selectionStrategy)
+	if !slices.Contains(strategies, strategy) {
+		return "", fmt.Errorf("unsupported strategy %q (supported: random, sequential, shuffle-once)", strategy)
+	}
+	return strategy, nil
+}
+
+// walkSessionKey identifies the client whose position is tracked: ?session=,
+// an X-Session-ID header, or failing those the client address.
+func walkSessionKey(c *gin.Context) string {
+	if session := c.Query("session"); session != "" {
+		return "session:" + session
+	}
+	if session := c.GetHeader("X-Session-ID"); session != "" {
+		return "session:" + session
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// numberedImages returns the numbered images and their generation.
+func (x *directoryIndex) numberedImages() ([]string, int) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.images, x.generation
+}
+
+// nextInWalk advances the session key by one step and returns the next
+// image for which eligible holds, along with its position in the walk.
+func nextInWalk(key, strategy string, eligible func(p string) bool) (string, int, int, bool) {
+	images, generation := imageIndex.numberedImages()
+	n := len(images)
+	if n == 0 {
+		return "", 0, 0, false
+	}
+	walks.Lock()
+	defer walks.Unlock()
+
+	if strategy == strategyShuffleOnce && (walks.generation != generation || len(walks.shuffled) != n) {
+		walks.shuffled = make([]int32, n)
+		for i := range walks.shuffled {
+			walks.shuffled[i] = int32(i)
+		}
+		rand.Shuffle(n, func(i, j int) { walks.shuffled[i], walks.shuffled[j] = walks.shuffled[j], walks.shuffled[i] })
+		walks.generation = generation
+	}
+	s := walkSessionFor(key)
+	if s.strategy != strategy {
+		*s = walkSession{strategy: strategy, generation: -1}
+	}
+	if s.generation != generation {
+		s.position = 0
+		switch {
+		case strategy == strategySequential && s.last != "":
+			i, found := slices.BinarySearch(images, s.last)
+			if found {
+				i++
+			}
+			s.position = i % n
+		case strategy == strategyShuffleOnce:
+			s.position = rand.Intn(n)
+		}
+		s.generation = generation
+	}
+	s.used = time.Now()
+
+	for range n {
+		position := s.position
+		s.position = (s.position + 1) % n
+		i := position
+		if strategy == strategyShuffleOnce {
+			i = int(walks.shuffled[position])
+		}
+		if eligible(images[i]) {
+			s.last = images[i]
+			return images[i], position, n, true
+		}
+	}
+	return "", 0, n, false
+}
+
+// walkSessionFor returns the session for key, creating it if needed.
+// walks must be locked.
+func walkSessionFor(key string) *walkSession {
+	if s, ok := walks.sessions[key]; ok {
+		return s
+	}
+	if len(walks.sessions) >= maxWalkSessions {
+		var oldest string
+		for k, s := range walks.sessions {
+			if oldest == "" || s.used.Before(walks.sessions[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(walks.sessions, oldest)
+	}
+	s := &walkSession{generation: -1}
+	walks.sessions[key] = s
+	return s
+}
+
+// selectImage picks an image from candidates by strategy. On failure the
+// error response has already been written.
+func selectImage(c *gin.Context, client *sftp.Client, candidates []string, filter selectionFilter, strategy string) (ImageInfo, bool) {
+	if strategy == strategyRandom {
+		return selectRandomImage(c, client, candidates, filter)
+	}
+	if _, images := imageIndex.numbering(); images == 0 {
+		// Nothing is numbered until a complete scan has run.
+		return selectRandomImage(c, client, candidates, filter)
+	}
+	return selectWalkImage(c, client, candidates, filter, strategy)
+}
+
+// selectWalkImage takes the session's next image in the walk that passes
+// the filters, skipping ones that have gone from the NAS since the scan.
+func selectWalkImage(c *gin.Context, client *sftp.Client, candidates []string, filter selectionFilter, strategy string) (ImageInfo, bool) {
+	dirs := make(map[string]bool, len(candidates))
+	for _, dir := range candidates {
+		dirs[dir] = true
+	}
+	eligible := func(p string) bool {
+		return dirs[imageDirectory(p)] && filter.matches(ImageInfo{Path: p})
+	}
+	key := walkSessionKey(c)
+	for range maxSelectionAttempts {
+		p, position, n, ok := nextInWalk(key, strategy, eligible)
+		if !ok {
+			break
+		}
+		c.Set(nasPathKey, p)
+		var stat os.FileInfo
+		err := sftpCall(func() (err error) {
+			stat, err = statImage(client, p)
+			return err
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			respondSFTPError(c, "Failed to stat image: ", err)
+			return ImageInfo{}, false
+		}
+		info := ImageInfo{Path: p, CreationDate: creationDate(p, stat.ModTime()), Size: stat.Size()}
+		if verification.isQuarantined(info) {
+			continue
+		}
+		if filter.needsDimensions() {
+			dims, _, err := readDimensions(client, info)
+			if err != nil {
+				respondSFTPError(c, "Failed to read image header: ", err)
+				return ImageInfo{}, false
+			}
+			if !filter.largeEnough(dims) {
+				continue
+			}
+		}
+		c.Header("X-Walk-Position", strconv.Itoa(position+1)+"/"+strconv.Itoa(n))
+		return info, true
+	}
+	if filter.active() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No images matching " + filter.String() + " found"})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No images found in the selected directories"})
+	}
+	return ImageInfo{}, false
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Streaming settings. With streamBufferSize zero the SFTP file is copied to
+// the client with sftp.File.WriteTo, which pipelines reads when the client
+// allows concurrent reads; otherwise reads are batched into buffers of
+// that size.
+// A non-zero streamReadAhead additionally reads that many buffers ahead in
+// a separate goroutine, so a slow NAS round trip and a slow client write
+// overlap instead of alternating.
+var (
+	streamBufferSize int
+	streamReadAhead  int
+)
+
+// streamImage copies info straight from the NAS to the client without
+// holding the whole file in memory. Used when the bytes are served as
+// stored and nothing needs to be cached.
+func streamImage(c *gin.Context, client *sftp.Client, info ImageInfo, contentType string, opts transformOptions) {
+	openStart := time.Now()
+	_, span := startSpan(c.Request.Context(), "sftp.open", pathAttr(info.Path))
+	var file *sftp.File
+	err := sftpCall(func() (err error) {
+		file, err = client.Open(info.Path)
+		return err
+	})
+	endSpan(span, err)
+	recordStage(c, stageSFTP, openStart, phaseOpen)
+	if err != nil {
+		respondSFTPError(c, "Failed to open image file: ", err)
+		return
+	}
+	defer file.Close()
+	// Closing the file unblocks a read stuck waiting on the NAS once the
+	// client has gone.
+	ctx := c.Request.Context()
+	defer context.AfterFunc(ctx, func() { file.Close() })()
+
+	key := imageCacheKey(info)
+	sum, hashed := checksums.get(key)
+	hash := sha256.New()
+
+	setImageHeaders(c, info, contentType, info.Size, opts)
+	if hashed && contentSHA256Enabled {
+		c.Header("X-Content-SHA256", sum)
+	}
+	c.Status(http.StatusOK)
+
+	// WRITE_TIMEOUT is sized for buffered responses; a large original on a
+	// slow link may take longer, and a stalled client is still caught by
+	// the context once the connection drops.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	writeStart := time.Now()
+	var dst io.Writer = c.Writer
+	if contentSHA256Enabled && !hashed {
+		dst = io.MultiWriter(dst, hash)
+	}
+	_, span = startSpan(ctx, "sftp.stream", pathAttr(info.Path))
+	var n int64
+	var readErr error
+	if streamBufferSize == 0 && streamReadAhead == 0 {
+		n, readErr, err = writeFile(ctx, file, dst, info.Size, writeStart)
+	} else {
+		n, readErr, err = copyBuffered(ctx, file, dst, info.Size, writeStart)
+	}
+	span.SetAttributes(attribute.Int64("bytes", n))
+	endSpan(span, cmp.Or(readErr, err))
+	recordStage(c, stageWrite, writeStart, phaseTransfer)
+
+	recordSFTPResult(readErr)
+	if readErr != nil && !isContextError(readErr) {
+		recordRequestError(c, readErr)
+	}
+	if err = cmp.Or(readErr, err); err != nil {
+		c.Error(fmt.Errorf("streaming %s: %w", info.Path, err))
+		return
+	}
+	if contentSHA256Enabled && !hashed && n == info.Size {
+		checksums.put(key, info.Path, hex.EncodeToString(hash.Sum(nil)))
+	}
+}
+
+// errShortRead is a file that ended before its listed size. It is not a
+// NAS failure: the file may have shrunk since it was listed.
+var errShortRead = errors.New("file ended early")
+
+// writeFile copies file, size bytes long, to dst. For an *sftp.File that
+// goes through WriteTo, so the sftp package can keep several read requests
+// in flight. Read and write errors are returned separately; once ctx is
+// done the read error is ctx's.
+func writeFile(ctx context.Context, file io.Reader, dst io.Writer, size int64, start time.Time) (int64, error, error) {
+	w := &transferWriter{w: dst, ctx: ctx, start: start}
+	n, err := copyPooled(w, file)
+	switch {
+	case w.err != nil:
+		return n, nil, w.err
+	case err != nil && ctx.Err() != nil:
+		return n, ctx.Err(), nil
+	case err != nil:
+		return n, err, nil
+	case n < size:
+		// WriteTo skips what the NAS leaves out of short reads, as when
+		// SFTP_MAX_PACKET is more than it serves at once.
+		return n, fmt.Errorf("read %d of %d bytes: %w", n, size, errShortRead), nil
+	}
+	return n, nil, nil
+}
+
+// copyBuffered copies up to size bytes of file to dst through the
+// STREAM_BUFFER_SIZE and STREAM_READ_AHEAD buffering.
+func copyBuffered(ctx context.Context, file io.Reader, dst io.Writer, size int64, start time.Time) (int64, error, error) {
+	source := &readErrorRecorder{r: &firstByteReader{r: contextReader{ctx: ctx, r: file}, ctx: ctx, start: start}}
+	var r io.Reader = source
+	switch {
+	case streamReadAhead > 0:
+		ahead := newReadAheadReader(source, max(streamBufferSize, 32*1024), streamReadAhead)
+		defer ahead.Close()
+		r = ahead
+	case streamBufferSize > 0:
+		br := getBufferedReader(source, streamBufferSize)
+		defer putBufferedReader(br)
+		r = br
+	}
+	n, err := copyPooled(dst, io.LimitReader(r, size))
+	// Once size bytes are through, a read-ahead failing past them is moot.
+	if readErr := source.firstError(); readErr != nil && n < size {
+		return n, readErr, nil
+	}
+	if err == nil && n < size {
+		return n, fmt.Errorf("read %d of %d bytes: %w", n, size, errShortRead), nil
+	}
+	return n, nil, err
+}
+
+// transferWriter records phaseFirstByte on the first write and remembers
+// the first write error, which WriteTo would otherwise mix with read
+// errors.
+type transferWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	start   time.Time
+	started bool
+	err     error
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		recordTiming(w.ctx, w.start, phaseFirstByte)
+	}
+	n, err := w.w.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// readErrorRecorder remembers the first read error other than EOF, so NAS
+// failures can be told apart from the client going away mid-copy. With
+// read-ahead it is read from a goroutine that may outlive the copy, hence
+// the mutex.
+type readErrorRecorder struct {
+	r   io.Reader
+	mu  sync.Mutex
+	err error
+}
+
+func (e *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.mu.Lock()
+		if e.err == nil {
+			e.err = err
+		}
+		e.mu.Unlock()
+	}
+	return n, err
+}
+
+func (e *readErrorRecorder) firstError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// firstByteReader records phaseFirstByte when the first data arrives.
+type firstByteReader struct {
+	r     io.Reader
+	ctx   context.Context
+	start time.Time
+	done  bool
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.done && (n > 0 || err != nil) {
+		r.done = true
+		recordTiming(r.ctx, r.start, phaseFirstByte)
+	}
+	return n, err
+}
+
+// contextReader fails reads with ctx's error once ctx is done, so a copy
+// stops at the next read after the client disconnects.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if err != nil && r.ctx.Err() != nil {
+		err = r.ctx.Err()
+	}
+	return n, err
+}
+
+type readAheadChunk struct {
+	buf  *[]byte
+	data []byte
+	err  error
+}
+
+// readAheadReader reads src in chunkSize pieces from a background
+// goroutine, keeping up to depth chunks queued. Chunks come from the
+// buffer pool and go back once read.
+type readAheadReader struct {
+	chunks     chan readAheadChunk
+	done       chan struct{}
+	current    []byte
+	currentBuf *[]byte
+	err        error
+}
+
+func newReadAheadReader(src io.Reader, chunkSize, depth int) *readAheadReader {
+	r := &readAheadReader{
+		chunks: make(chan readAheadChunk, depth),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.chunks)
+		for {
+			buf := getBuffer(chunkSize)
+			n, err := io.ReadFull(src, *buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case r.chunks <- readAheadChunk{buf: buf, data: (*buf)[:n], err: err}:
+			case <-r.done:
+				putBuffer(buf)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.currentBuf != nil {
+			putBuffer(r.currentBuf)
+			r.currentBuf = nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		r.current, r.currentBuf, r.err = chunk.data, chunk.buf, chunk.err
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close stops the background reader and returns its buffers to the pool.
+// It does not close src.
+func (r *readAheadReader) Close() error {
+	close(r.done)
+	if r.currentBuf != nil {
+		putBuffer(r.currentBuf)
+		r.currentBuf, r.current = nil, nil
+	}
+	go func() {
+		for chunk := range r.chunks {
+			putBuffer(chunk.buf)
+		}
+	}()
+	return nil
+}
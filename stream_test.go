@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// setStreaming sets the STREAM_BUFFER_SIZE and STREAM_READ_AHEAD globals
+// for the rest of the test.
+func setStreaming(tb testing.TB, bufferSize, readAhead int) {
+	tb.Helper()
+	oldSize, oldAhead := streamBufferSize, streamReadAhead
+	streamBufferSize, streamReadAhead = bufferSize, readAhead
+	tb.Cleanup(func() { streamBufferSize, streamReadAhead = oldSize, oldAhead })
+}
+
+// overlongReader has more bytes than the image claims, then fails.
+type overlongReader struct {
+	remaining int
+}
+
+func (r *overlongReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, errors.New("read past the end")
+	}
+	n := min(len(p), r.remaining)
+	r.remaining -= n
+	return n, nil
+}
+
+func TestCopyBufferedReadAheadStopsAtSize(t *testing.T) {
+	setStreaming(t, 0, 4)
+	const size = 100 * 1024
+	// The read-ahead goroutine is still reading, and failing, after the
+	// copy has taken size bytes; run with -race.
+	for range 50 {
+		var dst bytes.Buffer
+		n, readErr, writeErr := copyBuffered(context.Background(), &overlongReader{remaining: size + 8*1024}, &dst, size, time.Now())
+		if n != size || readErr != nil || writeErr != nil {
+			t.Fatalf("copyBuffered = %d, %v, %v; want %d, nil, nil", n, readErr, writeErr, size)
+		}
+	}
+}
+
+func TestCopyBufferedReportsShortRead(t *testing.T) {
+	for _, ahead := range []int{0, 4} {
+		setStreaming(t, 64*1024, ahead)
+		n, readErr, _ := copyBuffered(context.Background(), &overlongReader{remaining: 1000}, io.Discard, 5000, time.Now())
+		if n != 1000 || readErr == nil {
+			t.Errorf("read-ahead %d: copyBuffered = %d, %v; want 1000 and the read error", ahead, n, readErr)
+		}
+		// A file that shrank since it was listed ends early without error.
+		n, readErr, _ = copyBuffered(context.Background(), bytes.NewReader(make([]byte, 1000)), io.Discard, 5000, time.Now())
+		if n != 1000 || !errors.Is(readErr, errShortRead) {
+			t.Errorf("read-ahead %d: copyBuffered of a short file = %d, %v; want 1000 and errShortRead", ahead, n, readErr)
+		}
+	}
+}
+
+// stalledFile returns one read's worth of data, then blocks like a file
+// on a NAS that stopped answering until it is closed.
+type stalledFile struct {
+	stalled   chan struct{}
+	closed    chan struct{}
+	reads     int
+	closeOnce sync.Once
+}
+
+func newStalledFile() *stalledFile {
+	return &stalledFile{stalled: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (f *stalledFile) Read(p []byte) (int, error) {
+	if f.reads++; f.reads == 1 {
+		return len(p), nil
+	}
+	if f.reads == 2 {
+		close(f.stalled)
+	}
+	<-f.closed
+	return 0, os.ErrClosed
+}
+
+func (f *stalledFile) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func TestStreamStopsWhenClientGoes(t *testing.T) {
+	modes := []struct {
+		name                  string
+		bufferSize, readAhead int
+	}{
+		{"plain", 0, 0},
+		{"buffered", 64 * 1024, 0},
+		{"read-ahead", 64 * 1024, 4},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			setStreaming(t, mode.bufferSize, mode.readAhead)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			file := newStalledFile()
+			// As streamImage does.
+			defer context.AfterFunc(ctx, func() { file.Close() })()
+
+			done := make(chan error, 1)
+			go func() {
+				var readErr error
+				if mode.bufferSize == 0 && mode.readAhead == 0 {
+					_, readErr, _ = writeFile(ctx, file, io.Discard, 1<<30, time.Now())
+				} else {
+					_, readErr, _ = copyBuffered(ctx, file, io.Discard, 1<<30, time.Now())
+				}
+				done <- readErr
+			}()
+
+			<-file.stalled
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("read error %v, want context.Canceled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("copy still running 5s after the client went")
+			}
+		})
+	}
+}
+
+func TestWriteFileReportsSkippedData(t *testing.T) {
+	const size = 1 << 20
+	nas := newTestNAS(t, 0, sftp.UseConcurrentReads(true), sftp.MaxPacketUnchecked(2*maxTestRead))
+	nas.put(t, "/photos/big.tif", bytes.Repeat([]byte{0x5a}, size))
+	file, err := nas.client.Open("/photos/big.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	// Every read comes back half full, and WriteTo carries on regardless.
+	n, readErr, _ := writeFile(context.Background(), file, io.Discard, size, time.Now())
+	if !errors.Is(readErr, errShortRead) {
+		t.Errorf("writeFile = %d, %v; want errShortRead", n, readErr)
+	}
+}
+
+// pacedWriter is a client downloading at rate bytes per second.
+type pacedWriter struct {
+	rate int
+}
+
+func (w pacedWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * time.Second / time.Duration(w.rate))
+	return len(p), nil
+}
+
+// BenchmarkStreamHighLatency streams a 1MB image from a NAS 2ms away to a
+// 100MB/s client through each buffering mode. Compare MB/s: plain copying
+// waits out a round trip per read, larger buffers need fewer round trips,
+// and read-ahead overlaps them with writing to the client.
+func BenchmarkStreamHighLatency(b *testing.B) {
+	const size = 1 << 20
+	nas := newTestNAS(b, 2*time.Millisecond)
+	nas.put(b, "/photos/big.tif", bytes.Repeat([]byte{0x5a}, size))
+
+	modes := []struct {
+		name                  string
+		bufferSize, readAhead int
+	}{
+		{"plain", 0, 0},
+		{"buffer=256KB", 256 * 1024, 0},
+		{"buffer=256KB,read-ahead=4", 256 * 1024, 4},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			setStreaming(b, mode.bufferSize, mode.readAhead)
+			b.SetBytes(size)
+			for range b.N {
+				file, err := nas.client.Open("/photos/big.tif")
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Hide WriteTo, so plain is the sequential io.Copy the
+				// buffering replaced.
+				n, readErr, writeErr := copyBuffered(context.Background(), struct{ io.Reader }{file}, pacedWriter{100 << 20}, size, time.Now())
+				file.Close()
+				if n != size || readErr != nil || writeErr != nil {
+					b.Fatal(fmt.Sprint(n, readErr, writeErr))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWriteFile serves an 8MB original from a NAS 2ms away the way
+// streamImage does by default. Compare MB/s: sequential is a plain copy
+// waiting out a round trip per 32KB packet, WriteTo lets the sftp package
+// keep reads in flight, and larger packets need fewer of them.
+func BenchmarkWriteFile(b *testing.B) {
+	const size = 8 << 20
+	modes := []struct {
+		name    string
+		writeTo bool
+		opts    []sftp.ClientOption
+	}{
+		{"sequential", false, []sftp.ClientOption{sftp.UseConcurrentReads(false)}},
+		{"WriteTo", true, []sftp.ClientOption{sftp.UseConcurrentReads(true)}},
+		{"WriteTo,max-packet=128KB", true, []sftp.ClientOption{sftp.UseConcurrentReads(true), sftp.MaxPacketUnchecked(128 * 1024)}},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			nas := newTestNAS(b, 2*time.Millisecond, mode.opts...)
+			nas.put(b, "/photos/big.tif", bytes.Repeat([]byte{0x5a}, size))
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				file, err := nas.client.Open("/photos/big.tif")
+				if err != nil {
+					b.Fatal(err)
+				}
+				var src io.Reader = file
+				if !mode.writeTo {
+					src = struct{ io.Reader }{file}
+				}
+				n, readErr, writeErr := writeFile(context.Background(), src, io.Discard, size, time.Now())
+				file.Close()
+				if n != size || readErr != nil || writeErr != nil {
+					b.Fatal(fmt.Sprint(n, readErr, writeErr))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// Subtree scan states.
+const (
+	subtreeRunning   = "running"
+	subtreeDone      = "done"
+	subtreeFailed    = "failed"
+	subtreeCancelled = "cancelled"
+)
+
+// maxRecentSubtreeScans bounds how many finished subtree scans the status
+// endpoint remembers.
+const maxRecentSubtreeScans = 20
+
+var errSubtreeScanRunning = errors.New("a subtree scan is running")
+
+// subtreeScan is one POST /admin/rescan?dir= scan, which re-walks a single
+// directory and merges what it finds into the live index.
+type subtreeScan struct {
+	Dir         string     `json:"dir"`
+	State       string     `json:"state"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Directories int        `json:"directories_with_images"`
+	Images      int        `json:"images"`
+	Added       int        `json:"added"`
+	Removed     int        `json:"removed"`
+	Error       string     `json:"error,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// subtreeScans tracks running subtree scans by directory, plus the most
+// recent finished ones. Running scans never overlap each other or a full
+// scan.
+var subtreeScans = struct {
+	sync.Mutex
+	running map[string]*subtreeScan
+	recent  []subtreeScan
+}{running: map[string]*subtreeScan{}}
+
+// startSubtreeScan registers a scan of dir, failing if it would overlap a
+// running one.
+func startSubtreeScan(dir string, cancel context.CancelFunc) (*subtreeScan, error) {
+	subtreeScans.Lock()
+	defer subtreeScans.Unlock()
+	if scanning.Load() {
+		return nil, errScanInProgress
+	}
+	for other := range subtreeScans.running {
+		if underDirectory(dir, other) || underDirectory(other, dir) {
+			return nil, fmt.Errorf("a scan of %s is already running", other)
+		}
+	}
+	scan := &subtreeScan{Dir: dir, State: subtreeRunning, StartedAt: time.Now(), cancel: cancel}
+	subtreeScans.running[dir] = scan
+	return scan, nil
+}
+
+// finishSubtreeScan moves scan from running to recent.
+func finishSubtreeScan(scan *subtreeScan, state string, err error) {
+	subtreeScans.Lock()
+	defer subtreeScans.Unlock()
+	now := time.Now()
+	scan.State, scan.FinishedAt = state, &now
+	if err != nil {
+		scan.Error = err.Error()
+	}
+	delete(subtreeScans.running, scan.Dir)
+	subtreeScans.recent = append(subtreeScans.recent, *scan)
+	if len(subtreeScans.recent) > maxRecentSubtreeScans {
+		subtreeScans.recent = slices.Delete(subtreeScans.recent, 0, len(subtreeScans.recent)-maxRecentSubtreeScans)
+	}
+}
+
+// scanSubtree walks dir and merges the result into the index: image
+// directories found under dir are added, ones under it that have gone are
+// removed, and everything outside it is left alone. New images get
+// /image/123 numbers at the next full scan.
+func scanSubtree(ctx context.Context, client *sftp.Client, scan *subtreeScan, timeout time.Duration) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result := newScanResult()
+	pending := []pendingDir{{Path: scan.Dir}}
+	err := walkDirectories(ctx, client, &pending, result)
+
+	complete := err == nil
+	added, removed := imageIndex.replaceSubtree(scan.Dir, result.dirs, complete)
+	if complete {
+		creationDates.replaceSubtree(scan.Dir, result.dates)
+		imageTags.replaceSubtree(scan.Dir, result.tags)
+		imageRatings.replaceSubtree(scan.Dir, result.ratings)
+		imageTimeline.replaceSubtree(scan.Dir, result.months)
+		saveIndexCache()
+	}
+
+	subtreeScans.Lock()
+	scan.Directories, scan.Images, scan.Added, scan.Removed = len(result.dirs), len(result.images), added, removed
+	subtreeScans.Unlock()
+	state := subtreeDone
+	switch {
+	case isContextError(err):
+		state = subtreeCancelled
+		logger.Warn("scan stopped early; kept the directories found so far", "dir", scan.Dir, "reason", err, "pending", len(pending))
+	case err != nil:
+		state = subtreeFailed
+		logger.Error("scan failed", "dir", scan.Dir, "error", err)
+		recentErrors.record("scan", scan.Dir, err)
+	}
+	logSummary("scan finished", "dir", scan.Dir, "duration", time.Since(start).Round(time.Millisecond),
+		"with_images", len(result.dirs), "added", added, "removed", removed)
+	finishSubtreeScan(scan, state, err)
+}
+
+// rescanSubtree handles POST /admin/rescan?dir=.
+func rescanSubtree(ctx context.Context, c *gin.Context, client *sftp.Client, timeout time.Duration) {
+	dir := c.Query("dir")
+	switch {
+	case !path.IsAbs(dir):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dir must be an absolute path"})
+		return
+	case !underScanRoot(path.Clean(dir)):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dir is outside the scan roots " + strings.Join(scanRoots, ", ")})
+		return
+	}
+	dir = path.Clean(dir)
+
+	var info os.FileInfo
+	err := sftpCall(func() (err error) {
+		info, err = client.Stat(dir)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": dir + " does not exist"})
+		return
+	}
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	if !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": dir + " is not a directory"})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	scan, err := startSubtreeScan(dir, cancel)
+	if err != nil {
+		cancel()
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	backgroundScans.Add(1)
+	go func() {
+		defer backgroundScans.Done()
+		defer cancel()
+		scanSubtree(ctx, client, scan, timeout)
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"status": "scan started", "dir": dir})
+}
+
+// cancelSubtreeScan stops the running scan of dir.
+func cancelSubtreeScan(dir string) bool {
+	subtreeScans.Lock()
+	defer subtreeScans.Unlock()
+	scan, ok := subtreeScans.running[path.Clean(dir)]
+	if ok {
+		scan.cancel()
+	}
+	return ok
+}
+
+// getScanStatus reports the full scan and every running or recent
+// subtree scan.
+func getScanStatus(c *gin.Context) {
+	subtreeScans.Lock()
+	subtrees := slices.Clone(subtreeScans.recent)
+	for _, scan := range subtreeScans.running {
+		subtrees = append(subtrees, *scan)
+	}
+	subtreeScans.Unlock()
+	slices.SortFunc(subtrees, func(a, b subtreeScan) int { return a.StartedAt.Compare(b.StartedAt) })
+
+	c.JSON(http.StatusOK, gin.H{"scanning": scanning.Load(), "subtrees": subtrees})
+}
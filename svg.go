@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// SVG_SAFE_MODE values. An SVG served as image/svg+xml can run embedded
+// scripts when opened directly or embedded from the same origin, so the
+// default strips them; attachment serves the file untouched as text/plain
+// for download, and off serves it as stored, scripts included.
+const (
+	svgModeSanitize   = "sanitize"
+	svgModeAttachment = "attachment"
+	svgModeOff        = "off"
+)
+
+// sanitizeSVG re-serializes an SVG document without script elements,
+// event-handler attributes and javascript: links. DOCTYPE declarations are
+// dropped, so external or custom entities can't be defined; a document that
+// still references one fails to parse and is reported as malformed.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+
+	var out bytes.Buffer
+	var open []string
+	skipDepth := 0
+	sawRoot := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := qualifiedName(t.Name)
+			open = append(open, name)
+			if skipDepth > 0 || isScriptElement(t.Name) {
+				skipDepth++
+				continue
+			}
+			if len(open) == 1 {
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, errors.New("root element is not <svg>")
+				}
+				sawRoot = true
+			}
+			out.WriteByte('<')
+			out.WriteString(name)
+			for _, attr := range t.Attr {
+				if unsafeSVGAttr(attr) {
+					continue
+				}
+				out.WriteByte(' ')
+				out.WriteString(qualifiedName(attr.Name))
+				out.WriteString(`="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+		case xml.EndElement:
+			name := qualifiedName(t.Name)
+			if len(open) == 0 || open[len(open)-1] != name {
+				return nil, errors.New("mismatched closing tag </" + name + ">")
+			}
+			open = open[:len(open)-1]
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</")
+			out.WriteString(name)
+			out.WriteByte('>')
+		case xml.CharData:
+			if skipDepth == 0 {
+				xml.EscapeText(&out, t)
+			}
+		case xml.Comment:
+			// Comments are dropped; they can hide conditional markup.
+		case xml.ProcInst:
+			if t.Target == "xml" && out.Len() == 0 {
+				out.WriteString("<?xml ")
+				out.Write(t.Inst)
+				out.WriteString("?>")
+			}
+		case xml.Directive:
+			// DOCTYPE and entity declarations are dropped.
+		}
+	}
+
+	if len(open) != 0 || !sawRoot {
+		return nil, errors.New("incomplete SVG document")
+	}
+	return out.Bytes(), nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func isScriptElement(name xml.Name) bool {
+	local := strings.ToLower(name.Local)
+	return local == "script" || local == "handler"
+}
+
+func unsafeSVGAttr(attr xml.Attr) bool {
+	local := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(local, "on") {
+		return true
+	}
+	if local == "href" || local == "src" || local == "action" || local == "formaction" {
+		value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+		return strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "data:text/html")
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// Tag sidecars are written by other tools: "<image>.tags" next to an image
+// (or "<image without extension>.tags"), and "_tags" for every image in its
+// folder. One tag per line; blank lines and lines starting with # are
+// ignored.
+const (
+	tagsSuffix     = ".tags"
+	directoryTags  = "_tags"
+	maxSidecarSize = 64 * 1024
+	maxTagLength   = 64
+)
+
+// tagStore holds the tags found by the last complete scan, keyed by image
+// path.
+type tagStore struct {
+	mu     sync.RWMutex
+	byPath map[string][]string
+}
+
+var imageTags = &tagStore{byPath: map[string][]string{}}
+
+func (t *tagStore) replace(byPath map[string][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byPath = byPath
+}
+
+// replaceSubtree swaps in tags for the images under root.
+func (t *tagStore) replaceSubtree(root string, byPath map[string][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := maps.Clone(t.byPath)
+	maps.DeleteFunc(next, func(p string, _ []string) bool { return underDirectory(p, root) })
+	maps.Copy(next, byPath)
+	t.byPath = next
+}
+
+func (t *tagStore) export() map[string][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.byPath
+}
+
+func (t *tagStore) of(p string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.byPath[p]
+}
+
+func (t *tagStore) has(p, tag string) bool {
+	return slices.Contains(t.of(p), tag)
+}
+
+// directories returns the set of directories holding an image tagged tag.
+func (t *tagStore) directories(tag string) map[string]bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dirs := map[string]bool{}
+	for p, tags := range t.byPath {
+		if slices.Contains(tags, tag) {
+			dirs[path.Dir(p)] = true
+		}
+	}
+	return dirs
+}
+
+// counts tallies tags over images in dirs.
+func (t *tagStore) counts(dirs []string) map[string]int {
+	allowed := map[string]bool{}
+	for _, dir := range dirs {
+		allowed[dir] = true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	counts := map[string]int{}
+	for p, tags := range t.byPath {
+		if !allowed[path.Dir(p)] {
+			continue
+		}
+		for _, tag := range tags {
+			counts[tag]++
+		}
+	}
+	return counts
+}
+
+// normalizeTag lower-cases tag and rejects anything that is not a short
+// line of printable text.
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || !utf8.ValidString(tag) {
+		return "", false
+	}
+	for _, r := range tag {
+		if !unicode.IsPrint(r) {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+func parseTags(data []byte) []string {
+	var tags []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if tag, ok := normalizeTag(line); ok && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// collectTags reads the sidecars among the entries of dir into tags.
+// Unreadable sidecars are reported and skipped; they never affect whether
+// the images themselves are indexed.
+func collectTags(ctx context.Context, client *sftp.Client, dir string, entries []os.FileInfo, tags map[string][]string) {
+	sidecars := map[string][]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (name != directoryTags && !strings.HasSuffix(name, tagsSuffix)) || ctx.Err() != nil {
+			continue
+		}
+		sidecarPath := filepath.Join(dir, name)
+		if entry.Size() > maxSidecarSize {
+			fmt.Printf("Skipping tag file %s: larger than %d bytes\n", sidecarPath, maxSidecarSize)
+			continue
+		}
+		var data []byte
+		err := sftpCall(func() error {
+			file, err := client.Open(sidecarPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			data, err = io.ReadAll(io.LimitReader(file, maxSidecarSize))
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Skipping tag file %s: %v\n", sidecarPath, err)
+			continue
+		}
+		sidecars[name] = parseTags(data)
+	}
+	if len(sidecars) == 0 {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isImageFile(name) {
+			continue
+		}
+		var merged []string
+		for _, sidecar := range []string{directoryTags, name + tagsSuffix, strings.TrimSuffix(name, filepath.Ext(name)) + tagsSuffix} {
+			for _, tag := range sidecars[sidecar] {
+				if !slices.Contains(merged, tag) {
+					merged = append(merged, tag)
+				}
+			}
+		}
+		if len(merged) > 0 {
+			slices.Sort(merged)
+			tags[filepath.Join(dir, name)] = merged
+		}
+	}
+}
+
+// parseTagParam reads ?tag=; an empty value means no tag filter.
+func parseTagParam(c *gin.Context) (string, error) {
+	value := c.Query("tag")
+	if value == "" {
+		return "", nil
+	}
+	tag, ok := normalizeTag(value)
+	if !ok {
+		return "", fmt.Errorf("invalid tag %q", value)
+	}
+	return tag, nil
+}
+
+func listTags(c *gin.Context) {
+	counts := imageTags.counts(allowedDirectories(c, imageIndex.snapshot()))
+	list := make([]gin.H, 0, len(counts))
+	for tag, count := range counts {
+		list = append(list, gin.H{"tag": tag, "count": count})
+	}
+	slices.SortFunc(list, func(a, b gin.H) int {
+		if n := cmp.Compare(b["count"].(int), a["count"].(int)); n != 0 {
+			return n
+		}
+		return cmp.Compare(a["tag"].(string), b["tag"].(string))
+	})
+	c.JSON(http.StatusOK, gin.H{"tags": list})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timelineStore counts images by the month they were taken, per directory,
+// as of the last complete scan. Months are "2006-01" in DISPLAY_TIMEZONE,
+// taken from the same creation date responses report.
+type timelineStore struct {
+	mu    sync.RWMutex
+	byDir map[string]map[string]int
+}
+
+var imageTimeline = &timelineStore{byDir: map[string]map[string]int{}}
+
+func monthOf(t time.Time) string {
+	return t.In(displayLocation).Format("2006-01")
+}
+
+func (t *timelineStore) replace(byDir map[string]map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byDir = byDir
+}
+
+// replaceSubtree swaps in the counts for the directories under root.
+func (t *timelineStore) replaceSubtree(root string, byDir map[string]map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := maps.Clone(t.byDir)
+	maps.DeleteFunc(next, func(dir string, _ map[string]int) bool { return underDirectory(dir, root) })
+	maps.Copy(next, byDir)
+	t.byDir = next
+}
+
+func (t *timelineStore) export() map[string]map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.byDir
+}
+
+// directories returns the set of directories holding an image taken in a
+// month starting with period, a year ("2023") or a month ("2023-06").
+func (t *timelineStore) directories(period string) map[string]bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dirs := map[string]bool{}
+	for dir, months := range t.byDir {
+		for month := range months {
+			if strings.HasPrefix(month, period) {
+				dirs[dir] = true
+				break
+			}
+		}
+	}
+	return dirs
+}
+
+// counts tallies images per month over dirs.
+func (t *timelineStore) counts(dirs []string) map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	counts := map[string]int{}
+	for _, dir := range dirs {
+		for month, n := range t.byDir[dir] {
+			counts[month] += n
+		}
+	}
+	return counts
+}
+
+// parsePeriod reads ?year= and ?month= into the prefix of the months they
+// select: "2023", "2023-06" or "" for any time. A month needs a year.
+func parsePeriod(c *gin.Context) (string, error) {
+	yearValue, monthValue := c.Query("year"), c.Query("month")
+	if yearValue == "" {
+		if monthValue != "" {
+			return "", fmt.Errorf("month needs year")
+		}
+		return "", nil
+	}
+	year, err := strconv.Atoi(yearValue)
+	if err != nil || year < 1 || year > 9999 {
+		return "", fmt.Errorf("year must be a year such as 2023")
+	}
+	if monthValue == "" {
+		return fmt.Sprintf("%04d", year), nil
+	}
+	month, err := strconv.Atoi(monthValue)
+	if err != nil || month < 1 || month > 12 {
+		return "", fmt.Errorf("month must be between 1 and 12")
+	}
+	return fmt.Sprintf("%04d-%02d", year, month), nil
+}
+
+type timelineMonth struct {
+	Month int `json:"month"`
+	Count int `json:"count"`
+}
+
+type timelineYear struct {
+	Year   int             `json:"year"`
+	Count  int             `json:"count"`
+	Months []timelineMonth `json:"months"`
+}
+
+// timelineYears groups month counts by year, oldest first.
+func timelineYears(counts map[string]int) []timelineYear {
+	years := []timelineYear{}
+	for _, key := range slices.Sorted(maps.Keys(counts)) {
+		t, err := time.Parse("2006-01", key)
+		if err != nil {
+			continue
+		}
+		if len(years) == 0 || years[len(years)-1].Year != t.Year() {
+			years = append(years, timelineYear{Year: t.Year()})
+		}
+		y := &years[len(years)-1]
+		y.Count += counts[key]
+		y.Months = append(y.Months, timelineMonth{Month: int(t.Month()), Count: counts[key]})
+	}
+	return years
+}
+
+// getTimeline handles GET /timeline: how many images the caller may see
+// were taken in each year and month, for building ?year=&month= links.
+func getTimeline(c *gin.Context) {
+	counts := imageTimeline.counts(allowedDirectories(c, imageIndex.snapshot()))
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"timezone": displayLocation.String(),
+		"total":    total,
+		"years":    timelineYears(counts),
+	})
+}
+
+// respondEmptyPeriod answers a ?year=&month= selection with nothing in
+// it, listing the periods that do have images among dirs.
+func respondEmptyPeriod(c *gin.Context, period string, dirs []string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error":   "No images taken in " + period,
+		"buckets": timelineYears(imageTimeline.counts(dirs)),
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const serviceName = "nas-sftp-api"
+
+// tracer stays a no-op unless OTEL_EXPORTER_OTLP_ENDPOINT is set, and
+// tracingEnabled lets callers skip building span attributes entirely.
+// tracingMiddleware starts a span per request, continuing any incoming
+// traceparent; it is nil while tracing is off.
+var (
+	tracer            trace.Tracer = noop.NewTracerProvider().Tracer(serviceName)
+	tracingEnabled    bool
+	tracingMiddleware gin.HandlerFunc
+)
+
+// setupTracing starts exporting spans over OTLP/HTTP. The exporter reads
+// the standard OTEL_EXPORTER_OTLP_* variables itself, so headers and
+// timeouts can be set there too. The returned function flushes and stops
+// the exporter.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName), semconv.ServiceVersion(version)))
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME, if set, still wins.
+	if fromEnv, err := resource.New(ctx, resource.WithFromEnv()); err == nil {
+		res, _ = resource.Merge(res, fromEnv)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	tracer = provider.Tracer(serviceName)
+	tracingEnabled = true
+	tracingMiddleware = otelgin.Middleware(serviceName,
+		otelgin.WithTracerProvider(provider),
+		otelgin.WithPropagators(propagator))
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a child span of whatever span ctx carries.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !tracingEnabled {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks span failed if err is set and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// pathAttr identifies a NAS path in spans by hash, keeping folder and file
+// names out of the tracing backend.
+func pathAttr(p string) attribute.KeyValue {
+	if !tracingEnabled {
+		return attribute.KeyValue{}
+	}
+	sum := sha256.Sum256([]byte(p))
+	return attribute.String("nas.path_hash", hex.EncodeToString(sum[:8]))
+}
+
+func cacheAttr(hit bool) attribute.KeyValue {
+	if hit {
+		return attribute.String("cache.outcome", "hit")
+	}
+	return attribute.String("cache.outcome", "miss")
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const maxTransformDimension = 8192
+
+// defaultJPEGQuality is used for JPEG encodes when the request has no q
+// parameter. WebP sources are re-encoded as JPEG (there is no WebP encoder
+// in the standard library or x/image), so it applies to them as well.
+var defaultJPEGQuality = 82
+
+// reencodeJPEGQuality, when non-zero, makes every JPEG response a re-encode
+// at that quality, trading fidelity for bandwidth. Zero serves originals
+// untouched unless the request asks for a quality.
+var reencodeJPEGQuality int
+
+// Colour modes, for e-ink frames and other monochrome displays.
+const (
+	colorOriginal  = "original"
+	colorGrayscale = "grayscale"
+	colorDither    = "dither"
+)
+
+var colorModes = []string{colorOriginal, colorGrayscale, colorDither}
+
+// defaultColorMode applies to requests that don't pick a colour mode.
+var defaultColorMode = colorOriginal
+
+// transformOptions are the resize/conversion parameters of an image request.
+type transformOptions struct {
+	width      int
+	height     int
+	fit        string
+	gravity    string
+	upscale    bool
+	format     string
+	quality    int
+	reencode   bool
+	firstFrame bool
+	// color is empty for colorOriginal.
+	color string
+	// pipeline, from ?pipeline=, replaces the geometry and colour options.
+	pipeline []pipelineStep
+}
+
+var outputFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// transformParams are the query parameters parseTransformOptions reads.
+var transformParams = []string{"w", "h", "fit", "mode", "color", "gravity", "upscale", "format", "quality", "q", "frame", "pipeline"}
+
+func parseTransformOptions(c *gin.Context) (transformOptions, error) {
+	if value := c.Query("pipeline"); value != "" {
+		return parsePipelineOptions(c, value)
+	}
+	var opts transformOptions
+	var err error
+	if opts.width, err = parseDimension(c, "w"); err != nil {
+		return opts, err
+	}
+	if opts.height, err = parseDimension(c, "h"); err != nil {
+		return opts, err
+	}
+
+	// mode=grayscale and mode=dither are shorthands for color=; the other
+	// mode values pick the fit mode and never overlap with them.
+	mode := c.Query("mode")
+	colorMode := c.Query("color")
+	if slices.Contains(colorModes, mode) {
+		if colorMode != "" {
+			return opts, fmt.Errorf("mode=%s cannot be combined with color", mode)
+		}
+		colorMode, mode = mode, ""
+	}
+	switch colorMode {
+	case "":
+		colorMode = defaultColorMode
+	case colorOriginal, colorGrayscale, colorDither:
+	default:
+		return opts, fmt.Errorf("unsupported color %q (supported: %s)", colorMode, strings.Join(colorModes, ", "))
+	}
+	if colorMode != colorOriginal {
+		opts.color = colorMode
+	}
+
+	// fit=1920x1080 sets both dimensions at once, with mode choosing how
+	// the image is fitted to them.
+	fit := c.DefaultQuery("fit", "contain")
+	if width, height, ok := parseFitSize(fit); ok {
+		if opts.width != 0 || opts.height != 0 {
+			return opts, fmt.Errorf("fit=%s cannot be combined with w or h", fit)
+		}
+		if width < 1 || height < 1 || width > maxTransformDimension || height > maxTransformDimension {
+			return opts, fmt.Errorf("fit dimensions must be between 1 and %d", maxTransformDimension)
+		}
+		opts.width, opts.height = width, height
+		fit = cmp.Or(mode, "letterbox")
+		if !slices.Contains([]string{"contain", "letterbox", "cover", "crop"}, fit) {
+			return opts, fmt.Errorf("unsupported mode %q (supported: letterbox, contain, cover, crop, grayscale, dither)", fit)
+		}
+	} else if mode != "" {
+		return opts, fmt.Errorf("mode requires fit=WIDTHxHEIGHT")
+	}
+
+	switch opts.fit = fit; opts.fit {
+	case "contain":
+	case "cover", "crop", "letterbox":
+		if opts.width == 0 || opts.height == 0 {
+			return opts, fmt.Errorf("fit=%s requires both w and h", opts.fit)
+		}
+	default:
+		return opts, fmt.Errorf("unsupported fit %q (supported: contain, cover, crop, letterbox or WIDTHxHEIGHT)", opts.fit)
+	}
+
+	switch opts.gravity = c.DefaultQuery("gravity", "center"); opts.gravity {
+	case "center", "top", "smart":
+	default:
+		return opts, fmt.Errorf("unsupported gravity %q (supported: center, top, smart)", opts.gravity)
+	}
+
+	if value := c.Query("upscale"); value != "" {
+		if opts.upscale, err = strconv.ParseBool(value); err != nil {
+			return opts, fmt.Errorf("upscale must be true or false")
+		}
+	}
+
+	if format := strings.ToLower(c.Query("format")); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if _, ok := outputFormats[format]; !ok {
+			return opts, fmt.Errorf("unsupported format %q (supported: jpeg, png, gif)", format)
+		}
+		opts.format = format
+	}
+
+	opts.quality = defaultJPEGQuality
+	if reencodeJPEGQuality > 0 {
+		opts.quality = reencodeJPEGQuality
+		opts.reencode = true
+	}
+	qualityParam := "quality"
+	value := c.Query(qualityParam)
+	if value == "" {
+		qualityParam = "q"
+		value = c.Query(qualityParam)
+	}
+	if value != "" {
+		q, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be an integer between 1 and 100", qualityParam)
+		}
+		opts.quality = max(min(q, 100), 1)
+		opts.reencode = true
+		if opts.quality != q {
+			c.Header("Warning", fmt.Sprintf(`299 - "%s=%d is out of range, clamped to %d"`, qualityParam, q, opts.quality))
+		}
+	}
+
+	switch frame := c.Query("frame"); frame {
+	case "":
+	case "first":
+		opts.firstFrame = true
+	default:
+		return opts, fmt.Errorf("unsupported frame %q (supported: first)", frame)
+	}
+	return opts, nil
+}
+
+// parseFitSize parses a WIDTHxHEIGHT fit value.
+func parseFitSize(value string) (int, int, bool) {
+	w, h, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return 0, 0, false
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return 0, 0, false
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+func parseDimension(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxTransformDimension {
+		return 0, fmt.Errorf("%s must be an integer between 1 and %d", name, maxTransformDimension)
+	}
+	return n, nil
+}
+
+func (o transformOptions) requested() bool {
+	return o.width > 0 || o.height > 0 || o.format != "" || o.color != "" || len(o.pipeline) > 0
+}
+
+// appliesTo reports whether serving an image of contentType involves a
+// transform. A bare quality only affects JPEGs, and a bare format only
+// images stored in another one; everything else is served as stored.
+func (o transformOptions) appliesTo(contentType string) bool {
+	if contentType == "image/svg+xml" {
+		return false
+	}
+	// Asking for the format the image is stored in is not a conversion.
+	if outputFormats[o.format] == contentType && !o.firstFrame {
+		o.format = ""
+	}
+	return o.requested() || (o.reencode && contentType == "image/jpeg")
+}
+
+func (o transformOptions) String() string {
+	if !o.requested() && !o.reencode {
+		return ""
+	}
+	if len(o.pipeline) > 0 {
+		steps := make([]string, len(o.pipeline))
+		for i, step := range o.pipeline {
+			steps[i] = step.String()
+		}
+		s := fmt.Sprintf("pipeline=%s,format=%s,q=%d", strings.Join(steps, "|"), o.format, o.quality)
+		if o.firstFrame {
+			s += ",frame=first"
+		}
+		return s
+	}
+	s := fmt.Sprintf("w=%d,h=%d,fit=%s,format=%s,q=%d", o.width, o.height, o.fit, o.format, o.quality)
+	if o.fit == "cover" || o.fit == "crop" {
+		s += ",gravity=" + o.gravity
+	}
+	if o.upscale {
+		s += ",upscale"
+	}
+	if o.firstFrame {
+		s += ",frame=first"
+	}
+	if o.color != "" {
+		s += ",color=" + o.color
+	}
+	return s
+}
+
+// transformImage applies opts to the encoded image in data. Animated GIFs
+// are resized frame by frame; other animated images, and animated GIFs
+// asked for in another format, are returned untouched unless the first
+// frame was asked for, since decoding them into a single image.Image would
+// silently drop the animation; colour modes are not applied to them. SVGs
+// have no raster to work on and always pass through.
+func transformImage(data []byte, contentType string, opts transformOptions) ([]byte, string, error) {
+	if contentType == "image/svg+xml" {
+		return data, contentType, nil
+	}
+	// An animation stays one unless another format is asked for, which
+	// gets its first frame below.
+	if isAnimated(data) && !opts.firstFrame && (opts.format == "" || opts.format == "gif" && isGIF(data)) {
+		if isGIF(data) && (opts.width > 0 || opts.height > 0) {
+			out, err := resizeAnimatedGIF(data, opts)
+			if err != nil {
+				return nil, "", err
+			}
+			return out, "image/gif", nil
+		}
+		return data, contentType, nil
+	}
+
+	source := data
+	if isWebP(data) && len(webpChunks(data, "ANMF")) > 0 {
+		frame, err := firstWebPFrame(data)
+		if err != nil {
+			return nil, "", err
+		}
+		source = frame
+	}
+
+	img, sourceFormat, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image: %w", err)
+	}
+
+	if len(opts.pipeline) > 0 {
+		img = applyPipeline(img, opts.pipeline, exifOrientation(source))
+	} else {
+		img = convertColor(resizeImage(img, opts), opts.color)
+	}
+
+	format := opts.format
+	if format == "" {
+		switch {
+		case opts.color == colorDither:
+			// JPEG artefacts would smear the dither pattern.
+			format = "png"
+		case sourceFormat == "jpeg" || sourceFormat == "webp":
+			format = "jpeg"
+		case sourceFormat == "gif":
+			format = "gif"
+		default:
+			format = "png"
+		}
+	}
+
+	out, err := encodeImage(img, format, opts.quality)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, outputFormats[format], nil
+}
+
+// resizeImage applies the geometry part of opts. Results never exceed the
+// source resolution unless opts.upscale is set; cover and crop then keep the
+// requested aspect ratio by cropping a smaller region instead.
+func resizeImage(img image.Image, opts transformOptions) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW == 0 || srcH == 0 || (opts.width == 0 && opts.height == 0) {
+		return img
+	}
+
+	switch opts.fit {
+	case "letterbox":
+		contained := opts
+		contained.fit = "contain"
+		return letterbox(resizeImage(img, contained), opts.width, opts.height)
+	case "cover":
+		scale := max(float64(opts.width)/float64(srcW), float64(opts.height)/float64(srcH))
+		if scale > 1 && !opts.upscale {
+			cropW, cropH := fitAspect(srcW, srcH, opts.width, opts.height)
+			return cropAt(img, cropW, cropH, opts.gravity)
+		}
+		// Crop the source region that maps onto the output, then scale it.
+		cropW := min(int(float64(opts.width)/scale+0.5), srcW)
+		cropH := min(int(float64(opts.height)/scale+0.5), srcH)
+		return scaleImage(cropAt(img, cropW, cropH, opts.gravity), opts.width, opts.height)
+	case "crop":
+		cropW, cropH := opts.width, opts.height
+		if !opts.upscale || cropW <= srcW && cropH <= srcH {
+			cropW, cropH = min(cropW, srcW), min(cropH, srcH)
+			return cropAt(img, cropW, cropH, opts.gravity)
+		}
+		cropW, cropH = fitAspect(srcW, srcH, cropW, cropH)
+		return scaleImage(cropAt(img, cropW, cropH, opts.gravity), opts.width, opts.height)
+	default:
+		scale := 0.0
+		if opts.width > 0 {
+			scale = float64(opts.width) / float64(srcW)
+		}
+		if opts.height > 0 {
+			if s := float64(opts.height) / float64(srcH); scale == 0 || s < scale {
+				scale = s
+			}
+		}
+		if scale >= 1 && !opts.upscale {
+			return img
+		}
+		return scaleImage(img, max(int(float64(srcW)*scale+0.5), 1), max(int(float64(srcH)*scale+0.5), 1))
+	}
+}
+
+// convertColor applies a colour mode to img. Transparent areas are laid
+// over white first, the colour of a blank e-ink panel. Dithering reduces
+// the image to pure black and white with Floyd-Steinberg error diffusion,
+// which keeps far more tonal detail than a flat threshold.
+func convertColor(img image.Image, mode string) image.Image {
+	if mode != colorGrayscale && mode != colorDither {
+		return img
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Over)
+	if mode == colorGrayscale {
+		return gray
+	}
+	bw := image.NewPaletted(bounds, color.Palette{color.Black, color.White})
+	draw.FloydSteinberg.Draw(bw, bounds, gray, bounds.Min)
+	return bw
+}
+
+// fitAspect returns the largest width x height with the aspect ratio of
+// w x h that fits inside srcW x srcH.
+func fitAspect(srcW, srcH, w, h int) (int, int) {
+	scale := min(float64(srcW)/float64(w), float64(srcH)/float64(h))
+	return max(min(int(float64(w)*scale), srcW), 1), max(min(int(float64(h)*scale), srcH), 1)
+}
+
+// letterbox centres img on a black width x height canvas.
+func letterbox(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+	offset := image.Pt((width-bounds.Dx())/2, (height-bounds.Dy())/2)
+	draw.Draw(dst, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+	return dst
+}
+
+func scaleImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// cropAt cuts a width x height region out of img, positioned by gravity.
+func cropAt(img image.Image, width, height int, gravity string) image.Image {
+	bounds := img.Bounds()
+	freeX, freeY := bounds.Dx()-width, bounds.Dy()-height
+	if freeX == 0 && freeY == 0 {
+		return img
+	}
+
+	offset := image.Pt(freeX/2, freeY/2)
+	switch gravity {
+	case "top":
+		offset.Y = 0
+	case "smart":
+		offset = smartCropOffset(img, width, height)
+	}
+
+	rect := image.Rect(0, 0, width, height).Add(bounds.Min).Add(offset)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+// smartCropOffset slides the crop window along the free axis and keeps the
+// position with the most edge detail, which tends to be where the subject
+// is. Ties are broken towards the rule-of-thirds line rather than the
+// center, since subjects usually sit slightly above the middle.
+func smartCropOffset(img image.Image, width, height int) image.Point {
+	bounds := img.Bounds()
+	freeX, freeY := bounds.Dx()-width, bounds.Dy()-height
+	const steps = 8
+
+	best := image.Pt(freeX/2, freeY/3)
+	bestScore := edgeEnergy(img, image.Rect(0, 0, width, height).Add(bounds.Min).Add(best))
+	for i := 0; i <= steps; i++ {
+		offset := image.Pt(freeX*i/steps, freeY*i/steps)
+		score := edgeEnergy(img, image.Rect(0, 0, width, height).Add(bounds.Min).Add(offset))
+		if score > bestScore {
+			best, bestScore = offset, score
+		}
+	}
+	return best
+}
+
+// edgeEnergy estimates how much detail rect contains by sampling luminance
+// differences on a coarse grid.
+func edgeEnergy(img image.Image, rect image.Rectangle) float64 {
+	const grid = 32
+	stepX := max(rect.Dx()/grid, 1)
+	stepY := max(rect.Dy()/grid, 1)
+
+	luma := func(x, y int) float64 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	}
+
+	total := 0.0
+	for y := rect.Min.Y; y+stepY < rect.Max.Y; y += stepY {
+		for x := rect.Min.X; x+stepX < rect.Max.X; x += stepX {
+			here := luma(x, y)
+			total += abs(here-luma(x+stepX, y)) + abs(here-luma(x, y+stepY))
+		}
+	}
+	return total
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+
+	buf := getEncodeBuffer()
+	defer putEncodeBuffer(buf)
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		err = png.Encode(buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", format, err)
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+)
+
+// transformFlights lets concurrent requests for the same transform, keyed
+// like transformCache, share one computation instead of each reading and
+// encoding the image on a cache miss.
+var (
+	transformFlights singleflight.Group
+	transformsRun    atomic.Uint64
+	transformsShared atomic.Uint64
+)
+
+// transformError is a failure of the transform itself rather than of
+// reading the image.
+type transformError struct {
+	err error
+}
+
+func (e *transformError) Error() string { return e.err.Error() }
+func (e *transformError) Unwrap() error { return e.err }
+
+type transformResult struct {
+	data        []byte
+	contentType string
+}
+
+// transformShared returns info transformed by opts, from transformCache or
+// by reading and transforming it once for every caller asking for key at
+// the same time. A follower's wait counts as encoding time. The shared
+// computation outlives a caller that gives up, since others may still be
+// waiting for it.
+func transformShared(ctx context.Context, client *sftp.Client, info ImageInfo, contentType string, opts transformOptions, key string) ([]byte, string, error) {
+	start := time.Now()
+	led := false
+	v, err, _ := transformFlights.Do(key, func() (any, error) {
+		led = true
+		// The previous flight for key may have finished just after the
+		// caller's cache lookup.
+		if data, cachedType, ok := transformCache.get(key); ok {
+			return transformResult{data, cachedType}, nil
+		}
+		if !transformLimiter.acquire() {
+			return nil, errOverloaded
+		}
+		defer transformLimiter.release()
+
+		flightCtx := context.WithoutCancel(ctx)
+		readStart := time.Now()
+		data, err := readImage(flightCtx, client, info)
+		recordTiming(flightCtx, readStart, stageSFTP)
+		if err != nil {
+			return nil, err
+		}
+
+		encodeStart := time.Now()
+		_, span := startSpan(flightCtx, "transform",
+			attribute.String("transform.options", opts.String()), attribute.Int("bytes.in", len(data)))
+		data, transformedType, err := transformImage(data, contentType, opts)
+		span.SetAttributes(attribute.Int("bytes.out", len(data)))
+		endSpan(span, err)
+		recordTiming(flightCtx, encodeStart, stageEncode)
+		if err != nil {
+			return nil, &transformError{err}
+		}
+		transformsRun.Add(1)
+		transformCache.put(key, info.Path, data, transformedType)
+		return transformResult{data, transformedType}, nil
+	})
+	if !led {
+		transformsShared.Add(1)
+		recordTiming(ctx, start, stageEncode)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	result := v.(transformResult)
+	return result.data, result.contentType, nil
+}
+
+// writeTransformMetrics appends how many transforms ran and how many
+// requests shared one, in the Prometheus text format.
+func writeTransformMetrics(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP image_transforms_total Images transformed on a transform cache miss.\n# TYPE image_transforms_total counter\nimage_transforms_total %d\n", transformsRun.Load())
+	fmt.Fprintf(b, "# HELP image_transforms_shared_total Requests that shared a transform already in flight for the same image and options.\n# TYPE image_transforms_shared_total counter\nimage_transforms_shared_total %d\n", transformsShared.Load())
+}
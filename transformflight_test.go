@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransformSharedRunsOnce(t *testing.T) {
+	const requests = 20
+	// Reads from a NAS 50ms away keep the first transform in flight while
+	// the other requests arrive.
+	nas := newTestNAS(t, 50*time.Millisecond)
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatal(err)
+	}
+	nas.put(t, "/photos/a.png", photo.Bytes())
+	info := ImageInfo{Path: "/photos/a.png", Size: int64(photo.Len()), CreationDate: time.Now()}
+	opts := transformOptions{width: 16, fit: "contain", format: "png"}
+	key := imageCacheKey(info) + "|" + opts.String()
+	t.Cleanup(func() { transformCache.purge() })
+
+	run, shared := transformsRun.Load(), transformsShared.Load()
+	results := make([][]byte, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, contentType, err := transformShared(context.Background(), nas.client, info, "image/png", opts, key)
+			if err != nil || contentType != "image/png" {
+				t.Errorf("request %d: %s, %v", i, contentType, err)
+			}
+			results[i] = data
+		}()
+	}
+	wg.Wait()
+
+	if n := transformsRun.Load() - run; n != 1 {
+		t.Errorf("%d identical requests ran %d transforms, want 1", requests, n)
+	}
+	if n := transformsShared.Load() - shared; n != requests-1 {
+		t.Errorf("%d requests shared the transform, want %d", n, requests-1)
+	}
+	for i, data := range results {
+		if !bytes.Equal(data, results[0]) {
+			t.Fatalf("request %d got different bytes from request 0", i)
+		}
+	}
+	thumb, err := png.DecodeConfig(bytes.NewReader(results[0]))
+	if err != nil || thumb.Width != 16 {
+		t.Errorf("transformed image %dx%d, %v; want 16 wide", thumb.Width, thumb.Height, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// treeNode is one directory in a /tree response. Directories without
+// images of their own appear when they lead to ones that have some.
+type treeNode struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+	// Images are directly in this directory; TotalImages also counts
+	// every subdirectory.
+	Images      int `json:"images"`
+	TotalImages int `json:"total_images"`
+	// Children counts the subdirectories, including any left out of
+	// Subdirectories by ?depth=.
+	Children       int         `json:"children"`
+	Subdirectories []*treeNode `json:"subdirectories,omitempty"`
+}
+
+// imageCounts returns how many numbered images each directory holds.
+func (x *directoryIndex) imageCounts() map[string]int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	counts := map[string]int{}
+	for _, p := range x.images {
+		if archive, _, ok := splitZipPath(p); ok {
+			counts[archive]++
+		} else {
+			counts[path.Dir(p)]++
+		}
+	}
+	return counts
+}
+
+// buildTree arranges dirs, and the directories between them and root, into
+// a tree under root. Image counts come from the last complete scan.
+func buildTree(root string, dirs []string, counts map[string]int) *treeNode {
+	nodes := map[string]*treeNode{root: {Path: root, Name: path.Base(root)}}
+	var node func(p string) *treeNode
+	node = func(p string) *treeNode {
+		if n, ok := nodes[p]; ok {
+			return n
+		}
+		n := &treeNode{Path: p, Name: path.Base(p)}
+		nodes[p] = n
+		parent := node(path.Dir(p))
+		parent.Subdirectories = append(parent.Subdirectories, n)
+		return n
+	}
+	for _, dir := range dirs {
+		if underDirectory(dir, root) {
+			node(dir).Images = counts[dir]
+		}
+	}
+	var total func(n *treeNode) int
+	total = func(n *treeNode) int {
+		slices.SortFunc(n.Subdirectories, func(a, b *treeNode) int { return strings.Compare(a.Name, b.Name) })
+		n.TotalImages = n.Images
+		for _, child := range n.Subdirectories {
+			n.TotalImages += total(child)
+		}
+		return n.TotalImages
+	}
+	total(nodes[root])
+	return nodes[root]
+}
+
+// prune drops subtrees with fewer than minImages images and cuts the tree
+// off depth levels below n; a negative depth means no limit.
+func (n *treeNode) prune(depth, minImages int) {
+	n.Subdirectories = slices.DeleteFunc(n.Subdirectories, func(child *treeNode) bool { return child.TotalImages < minImages })
+	n.Children = len(n.Subdirectories)
+	if depth == 0 {
+		n.Subdirectories = nil
+		return
+	}
+	for _, child := range n.Subdirectories {
+		child.prune(depth-1, minImages)
+	}
+}
+
+// getTree returns the indexed directories under ?root= as a tree, from
+// memory alone. ?depth= limits how many levels are expanded and
+// ?min_images= leaves out directories with fewer images below them.
+func getTree(c *gin.Context) {
+	root := c.DefaultQuery("root", "/")
+	if len(scanRoots) == 1 && c.Query("root") == "" {
+		root = scanRoots[0]
+	}
+	if !path.IsAbs(root) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "root must be an absolute path"})
+		return
+	}
+	root = path.Clean(root)
+	depth, err := parseMinDimension(c, "depth", -1)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	minImages, err := parseMinDimension(c, "min_images", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tree := buildTree(root, allowedDirectories(c, imageIndex.snapshot()), imageIndex.imageCounts())
+	tree.prune(depth, minImages)
+	c.JSON(http.StatusOK, tree)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// VERIFY_IMAGES modes. header decodes only as far as the image size, which
+// catches files that are not images at all; full decodes every pixel and
+// also catches truncated files.
+const (
+	verifyOff    = "off"
+	verifyHeader = "header"
+	verifyFull   = "full"
+)
+
+var verifyMode = verifyOff
+
+// maxVerifyAttempts bounds how many corrupt picks getRandomImage skips
+// before giving up.
+const maxVerifyAttempts = 5
+
+type quarantineEntry struct {
+	Path   string    `json:"path"`
+	Key    string    `json:"key"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// verificationStore records which image versions, by imageCacheKey, have
+// been checked and which paths failed. A quarantined path stays excluded
+// until the file changes on the NAS or the entry is cleared.
+type verificationStore struct {
+	mu sync.RWMutex
+	// verified maps keys to their image's path, which is empty for keys
+	// restored from the index cache.
+	verified    map[string]string
+	quarantined map[string]quarantineEntry
+}
+
+var verification = &verificationStore{verified: map[string]string{}, quarantined: map[string]quarantineEntry{}}
+
+func (v *verificationStore) isQuarantined(info ImageInfo) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	entry, ok := v.quarantined[info.Path]
+	return ok && entry.Key == imageCacheKey(info)
+}
+
+func (v *verificationStore) isVerified(key string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	_, ok := v.verified[key]
+	return ok
+}
+
+func (v *verificationStore) markVerified(key, path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.verified[key] = path
+}
+
+func (v *verificationStore) quarantine(info ImageInfo, reason string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.quarantined[info.Path] = quarantineEntry{Path: info.Path, Key: imageCacheKey(info), Reason: reason, Since: time.Now()}
+}
+
+func (v *verificationStore) entries() []quarantineEntry {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	entries := make([]quarantineEntry, 0, len(v.quarantined))
+	for _, entry := range v.quarantined {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b quarantineEntry) int { return strings.Compare(a.Path, b.Path) })
+	return entries
+}
+
+// release removes path from quarantine, or every entry when path is empty.
+func (v *verificationStore) release(path string) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if path == "" {
+		n := len(v.quarantined)
+		clear(v.quarantined)
+		return n
+	}
+	if _, ok := v.quarantined[path]; !ok {
+		return 0
+	}
+	delete(v.quarantined, path)
+	return 1
+}
+
+func (v *verificationStore) purge() (verified, released int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verified, released = len(v.verified), len(v.quarantined)
+	clear(v.verified)
+	clear(v.quarantined)
+	return verified, released
+}
+
+// purgeMatching forgets the results for images match accepts, and those
+// whose image is unknown, so they are checked again when next served.
+func (v *verificationStore) purgeMatching(match func(path string) bool) (verified, released int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verified, released = len(v.verified), len(v.quarantined)
+	maps.DeleteFunc(v.verified, func(_, path string) bool { return path == "" || match(path) })
+	maps.DeleteFunc(v.quarantined, func(path string, _ quarantineEntry) bool { return match(path) })
+	return verified - len(v.verified), released - len(v.quarantined)
+}
+
+func (v *verificationStore) export() ([]string, []quarantineEntry) {
+	v.mu.RLock()
+	verified := make([]string, 0, len(v.verified))
+	for key := range v.verified {
+		verified = append(verified, key)
+	}
+	v.mu.RUnlock()
+	slices.Sort(verified)
+	return verified, v.entries()
+}
+
+func (v *verificationStore) restore(verified []string, quarantined []quarantineEntry) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	clear(v.verified)
+	for _, key := range verified {
+		v.verified[key] = ""
+	}
+	clear(v.quarantined)
+	for _, entry := range quarantined {
+		v.quarantined[entry.Path] = entry
+	}
+}
+
+// verifyImage checks info according to verifyMode, quarantining it if it
+// does not decode. Only SFTP failures are returned as errors.
+func verifyImage(ctx context.Context, client *sftp.Client, info ImageInfo) (ok bool, err error) {
+	key := imageCacheKey(info)
+	if verifyMode == verifyOff || getContentType(info.Path) == "image/svg+xml" || verification.isVerified(key) {
+		return true, nil
+	}
+
+	var decodeErr error
+	if verifyMode == verifyHeader {
+		dims, _, err := readDimensions(client, info)
+		if err != nil {
+			return false, err
+		}
+		if dims.width == 0 {
+			decodeErr = fmt.Errorf("unreadable image header")
+		}
+	} else {
+		data, err := readImage(ctx, client, info)
+		if err != nil {
+			return false, err
+		}
+		_, _, decodeErr = image.Decode(bytes.NewReader(data))
+	}
+
+	if decodeErr != nil {
+		fmt.Printf("Quarantining %s: %v\n", info.Path, decodeErr)
+		verification.quarantine(info, decodeErr.Error())
+		return false, nil
+	}
+	verification.markVerified(key, info.Path)
+	return true, nil
+}
+
+func getQuarantine(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"quarantine": verification.entries()})
+}
+
+// clearQuarantine releases ?path= from quarantine, or everything without it.
+func clearQuarantine(c *gin.Context) {
+	path := c.Query("path")
+	removed := verification.release(path)
+	if path != "" && removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path is not quarantined"})
+		return
+	}
+	saveIndexCache()
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set at build time for releases:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Left empty, commit and buildDate fall back to the VCS stamp go build
+// records, and then to "unknown".
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+)
+
+// versionInfo describes the running binary for /version and the startup
+// line.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	SFTP      string `json:"sftp"`
+	SSH       string `json:"ssh"`
+}
+
+var buildVersion = sync.OnceValue(func() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		SFTP:      "unknown",
+		SSH:       "unknown",
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			switch dep.Path {
+			case "github.com/pkg/sftp":
+				info.SFTP = dep.Version
+			case "golang.org/x/crypto":
+				info.SSH = dep.Version
+			}
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true" && commit == ""
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+})
+
+func (v versionInfo) String() string {
+	revision := v.Commit
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if v.Modified {
+		revision += "+dirty"
+	}
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s, pkg/sftp %s, x/crypto %s)",
+		serviceName, v.Version, revision, v.BuildDate, v.GoVersion, v.SFTP, v.SSH)
+}
+
+// getVersion handles GET /version.
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, buildVersion())
+}
+
+// serverHeader sets the Server header to the name and version
+// (SERVER_HEADER).
+func serverHeader() gin.HandlerFunc {
+	value := serviceName + "/" + version
+	return func(c *gin.Context) {
+		c.Header("Server", value)
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// warmCache walks the indexed directories once in the background after
+// startup (WARM_CACHE), so the first slideshow requests for each of them
+// don't pay for a cold NAS. Every listing is read, which warms the NAS's
+// own directory cache, and the first image of each directory has its
+// dimensions recorded. With prefetch the whole image is read as well,
+// which fills the disk cache when DISK_CACHE_DIR is set.
+func warmCache(ctx context.Context, prefetch bool) {
+	start := time.Now()
+	dirs := imageIndex.snapshot()
+	logger.Info("warming caches", "directories", len(dirs), "prefetch", prefetch)
+	var listed, fetched, failed int
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			break
+		}
+		client, err := nasConn.client()
+		if err != nil {
+			logger.Warn("cache warming stopped", "error", err)
+			break
+		}
+		entries, err := readDirContext(ctx, client, dir)
+		if errors.Is(err, errCircuitOpen) {
+			logger.Warn("cache warming stopped", "error", err)
+			break
+		}
+		if err != nil {
+			failed++
+			logger.Debug("cache warming skipped directory", "dir", dir, "error", err)
+			continue
+		}
+		listed++
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(entry.Name()) {
+				continue
+			}
+			p := joinImagePath(dir, entry.Name())
+			info := ImageInfo{Path: p, Size: entry.Size(), CreationDate: creationDate(p, entry.ModTime())}
+			if _, _, err := readDimensions(client, info); err != nil {
+				logger.Debug("cache warming could not read image", "path", p, "error", err)
+				break
+			}
+			if prefetch {
+				if _, err := readImage(ctx, client, info); err != nil {
+					logger.Debug("cache warming could not read image", "path", p, "error", err)
+					break
+				}
+			}
+			fetched++
+			break
+		}
+	}
+	fmt.Printf("Cache warming finished in %s: %d of %d directories listed, %d images warmed, %d failed\n",
+		time.Since(start).Round(time.Millisecond), listed, len(dirs), fetched, failed)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+)
+
+// davPrefix is where the WebDAV view of the index is mounted
+// (WEBDAV_LISTING).
+const davPrefix = "/dav"
+
+// The PROPFIND response, in the "D:" prefixed form photo-frame clients
+// tend to expect.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// davHref is the URL of the NAS path p, with a trailing slash for
+// collections.
+func davHref(p string, collection bool) string {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	href := davPrefix + "/" + strings.Join(segments, "/")
+	if collection && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func davCollection(p string) davResponse {
+	return davResponse{
+		Href: davHref(p, true),
+		Propstat: davPropstat{
+			Prop:   davProp{DisplayName: path.Base(p), ResourceType: davResourceType{Collection: &struct{}{}}},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func davFile(info ImageInfo, name string) davResponse {
+	size := info.Size
+	return davResponse{
+		Href: davHref(info.Path, false),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:   name,
+				ContentLength: &size,
+				ContentType:   getContentType(info.Path),
+				LastModified:  info.CreationDate.UTC().Format(http.TimeFormat),
+				ETag:          imageETag(info, ""),
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// davChildren lists the directories directly below dir that are indexed or
+// lead to indexed ones.
+func davChildren(dir string, indexed []string) []string {
+	var children []string
+	for _, d := range indexed {
+		if d == dir || !underDirectory(d, dir) {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(d, dir), "/")
+		first, _, _ := strings.Cut(rest, "/")
+		children = append(children, path.Join(dir, first))
+	}
+	slices.Sort(children)
+	return slices.Compact(children)
+}
+
+// davPath reads the NAS path from the route.
+func davPath(c *gin.Context) string {
+	return path.Clean("/" + c.Param("path"))
+}
+
+// propfind answers PROPFIND for the indexed directories, the directories
+// leading to them and the images in them. Only Depth 0 and 1 are
+// supported, and the request body is ignored: every response carries the
+// same handful of properties.
+func propfind(c *gin.Context) {
+	depth := c.GetHeader("Depth")
+	if depth == "infinity" {
+		c.Data(http.StatusForbidden, "application/xml; charset=utf-8",
+			[]byte(xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+		return
+	}
+	p := davPath(c)
+	c.Set(nasPathKey, p)
+	if !pathAllowed(c, p) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not grant access to this path"})
+		return
+	}
+	indexed := allowedDirectories(c, imageIndex.snapshot())
+	_, isIndexed := slices.BinarySearch(indexed, p)
+	children := davChildren(p, indexed)
+
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+
+	ms := davMultistatus{XMLNS: "DAV:"}
+	switch {
+	case isIndexed || len(children) > 0:
+		ms.Responses = append(ms.Responses, davCollection(p))
+		if depth == "0" {
+			break
+		}
+		for _, child := range children {
+			ms.Responses = append(ms.Responses, davCollection(child))
+		}
+		if !isIndexed {
+			break
+		}
+		entries, err := readDirContext(c.Request.Context(), client, p)
+		if err != nil {
+			respondSFTPError(c, "Failed to list directory: ", err)
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isImageFile(entry.Name()) {
+				continue
+			}
+			imagePath := joinImagePath(p, entry.Name())
+			info := ImageInfo{Path: imagePath, Size: entry.Size(), CreationDate: creationDate(imagePath, entry.ModTime())}
+			ms.Responses = append(ms.Responses, davFile(info, path.Base(entry.Name())))
+		}
+	default:
+		info, ok := lookupDAVImage(c, client, p, indexed)
+		if !ok {
+			return
+		}
+		ms.Responses = append(ms.Responses, davFile(info, path.Base(p)))
+	}
+
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
+
+// lookupDAVImage stats the image at p, which must be in one of the
+// indexed directories. On failure the error response has already been
+// written.
+func lookupDAVImage(c *gin.Context, client *sftp.Client, p string, indexed []string) (ImageInfo, bool) {
+	if _, found := slices.BinarySearch(indexed, imageDirectory(p)); !found || !isImageFile(p) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return ImageInfo{}, false
+	}
+	var stat os.FileInfo
+	err := sftpCall(func() (err error) {
+		stat, err = statImage(client, p)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) || err == nil && stat.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return ImageInfo{}, false
+	}
+	if err != nil {
+		respondSFTPError(c, "Failed to stat image: ", err)
+		return ImageInfo{}, false
+	}
+	return ImageInfo{Path: p, CreationDate: creationDate(p, stat.ModTime()), Size: stat.Size()}, true
+}
+
+// getDAVFile serves an image by its WebDAV path.
+func getDAVFile(c *gin.Context) {
+	opts, err := parseTransformOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client, err := nasConn.client()
+	if err != nil {
+		respondSFTPError(c, "", err)
+		return
+	}
+	p := davPath(c)
+	c.Set(nasPathKey, p)
+	info, ok := lookupDAVImage(c, client, p, allowedDirectories(c, imageIndex.snapshot()))
+	if !ok {
+		return
+	}
+	serveImage(c, client, info, opts)
+}
+
+// davOptions advertises a read-only WebDAV class 1 server.
+func davOptions(c *gin.Context) {
+	c.Header("DAV", "1")
+	c.Header("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// scanZips makes the scan look inside .zip files (SCAN_ZIPS). An archive
+// holding images is indexed like a directory, and the images in it get
+// virtual paths such as /albums/trip.zip#photo.jpg. Every listing of an
+// archive reads its central directory over SFTP, so this is off by default.
+var scanZips bool
+
+// zipSeparator separates an archive's path from the entry inside it.
+const zipSeparator = "#"
+
+func isZipFile(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".zip")
+}
+
+// isZipDirectory reports whether the indexed directory dir is an archive.
+func isZipDirectory(dir string) bool {
+	return scanZips && isZipFile(dir)
+}
+
+// splitZipPath splits a virtual image path into archive and entry name.
+func splitZipPath(p string) (archive, name string, ok bool) {
+	archive, name, ok = strings.Cut(p, zipSeparator)
+	return archive, name, ok && name != "" && isZipDirectory(archive)
+}
+
+// joinImagePath names the image called name in the indexed directory dir.
+func joinImagePath(dir, name string) string {
+	if isZipDirectory(dir) {
+		return dir + zipSeparator + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// imageDirectory is the indexed directory the image at p belongs to.
+func imageDirectory(p string) string {
+	if archive, _, ok := splitZipPath(p); ok {
+		return archive
+	}
+	return path.Dir(p)
+}
+
+// zipEntryInfo reports the entry's full name within the archive, so
+// images in the archive's subdirectories keep distinct paths.
+type zipEntryInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i zipEntryInfo) Name() string { return i.name }
+
+// openZip opens archive and reads its central directory. The returned
+// file must be closed once the reader is no longer needed.
+func openZip(client *sftp.Client, archive string) (*sftp.File, *zip.Reader, error) {
+	file, err := client.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err == nil {
+		var zr *zip.Reader
+		if zr, err = zip.NewReader(file, stat.Size()); err == nil {
+			return file, zr, nil
+		}
+	}
+	file.Close()
+	return nil, nil, fmt.Errorf("reading %s: %w", archive, err)
+}
+
+// readZipDir lists the files in archive. Directories, encrypted entries
+// and names that would not make clean paths are left out.
+func readZipDir(client *sftp.Client, archive string) ([]os.FileInfo, error) {
+	file, zr, err := openZip(client, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []os.FileInfo
+	for _, f := range zr.File {
+		if usableZipEntry(f) {
+			entries = append(entries, zipEntryInfo{FileInfo: f.FileInfo(), name: f.Name})
+		}
+	}
+	return entries, nil
+}
+
+func usableZipEntry(f *zip.File) bool {
+	const encrypted = 0x1
+	return !f.FileInfo().IsDir() && f.Flags&encrypted == 0 &&
+		fs.ValidPath(f.Name) && !strings.Contains(f.Name, zipSeparator)
+}
+
+// readImageDir lists the indexed directory dir, which may be an archive.
+func readImageDir(client *sftp.Client, dir string) ([]os.FileInfo, error) {
+	if isZipDirectory(dir) {
+		return readZipDir(client, dir)
+	}
+	return client.ReadDir(dir)
+}
+
+// statImage is client.Stat for image paths, which may point into an
+// archive.
+func statImage(client *sftp.Client, p string) (os.FileInfo, error) {
+	archive, name, ok := splitZipPath(p)
+	if !ok {
+		return client.Stat(p)
+	}
+	entries, err := readZipDir(client, archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return entry, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+}
+
+// zipEntryReader reads one archive entry and closes the archive with it.
+type zipEntryReader struct {
+	io.ReadCloser
+	archive *sftp.File
+}
+
+func (r zipEntryReader) Close() error {
+	r.ReadCloser.Close()
+	return r.archive.Close()
+}
+
+// openImage opens the image at p, which may point into an archive. Plain
+// files come back as *sftp.File, which copies faster through WriteTo.
+func openImage(client *sftp.Client, p string) (io.ReadCloser, error) {
+	archive, name, ok := splitZipPath(p)
+	if !ok {
+		return client.Open(p)
+	}
+	file, zr, err := openZip(client, archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name != name || !usableZipEntry(f) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("opening %s: %w", p, err)
+		}
+		return zipEntryReader{ReadCloser: rc, archive: file}, nil
+	}
+	file.Close()
+	return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+}
+
+// scanZip records the images in archive in result, as scanDirectory does
+// for a directory, and returns how many there are. Sidecar tags, ratings
+// and EXIF dates are not looked for inside archives.
+func scanZip(ctx context.Context, client *sftp.Client, archive string, result *scanResult) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	entries, err := readZipDir(client, archive)
+	if err != nil {
+		return 0, err
+	}
+	images := 0
+	for _, entry := range entries {
+		if !isImageFile(entry.Name()) {
+			continue
+		}
+		images++
+		p := joinImagePath(archive, entry.Name())
+		result.images = append(result.images, indexedFile{Path: p, Size: entry.Size(), ModTime: entry.ModTime()})
+		taken := entry.ModTime()
+		if !plausibleDate(taken) {
+			result.suspicious++
+			taken = fixDate(entry.ModTime(), nil)
+			result.dates[p] = taken
+		}
+		result.countMonth(archive, taken)
+	}
+	if images > 0 {
+		result.dirs = append(result.dirs, archive)
+	}
+	return images, nil
+}